@@ -2,8 +2,6 @@ package entrypoint
 
 import (
 	"bufio"
-	"bytes"
-	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
@@ -13,7 +11,9 @@ import (
 	"github.com/chigopher/pathlib"
 	"github.com/samber/lo"
 	"github.com/spf13/afero"
+	"github.com/wrouesnel/nix-sigman/pkg/narcheck"
 	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"github.com/wrouesnel/nix-sigman/pkg/resigning"
 	"go.uber.org/zap"
 )
 
@@ -165,6 +165,81 @@ func loadPublicKeys(logger *zap.Logger) ([]nixtypes.NamedPublicKey, error) {
 	return publicKeys, nil
 }
 
+func loadRevocations(logger *zap.Logger) (nixtypes.RevocationList, error) {
+	revoked := nixtypes.RevocationList{}
+	for _, path := range CLI.RevokedKeyFiles {
+		fh, err := os.Open(path)
+		if err != nil {
+			return revoked, err
+		}
+		fileRevoked, err := nixtypes.ParseRevocations(fh)
+		fh.Close()
+		if err != nil {
+			return revoked, err
+		}
+		revoked = revoked.Merge(fileRevoked)
+	}
+	for _, key := range CLI.RevokedKeys {
+		r, err := nixtypes.ParseRevocation(key)
+		if err != nil {
+			return revoked, err
+		}
+		revoked = revoked.Merge(r)
+	}
+	logger.Debug("Loaded Revoked Keys", zap.Int("revoked_keys_count", len(revoked.Names)+len(revoked.Keys)))
+	return revoked, nil
+}
+
+// selectSigningKeys filters the private keys down to the named keys. "*" selects all keys.
+func selectSigningKeys(l *zap.Logger, privateKeys []nixtypes.NamedPrivateKey, keyNames []string) []nixtypes.NamedPrivateKey {
+	if lo.Contains(keyNames, "*") {
+		l.Debug("Sign with ALL private keys")
+		return privateKeys
+	}
+	desiredKeyNames := lo.SliceToMap(keyNames, func(item string) (string, struct{}) {
+		return item, struct{}{}
+	})
+	return lo.Filter(privateKeys, func(item nixtypes.NamedPrivateKey, index int) bool {
+		return lo.HasKey(desiredKeyNames, item.KeyName)
+	})
+}
+
+// loadSigners builds the resigners for a command. If a signing map is configured then it is used,
+// otherwise every narinfo is signed with the signing keys.
+func loadSigners(l *zap.Logger, resigningConfig *resigning.ResigningConfig, signingKeys []nixtypes.NamedPrivateKey,
+	privateKeys []nixtypes.NamedPrivateKey, publicKeys []nixtypes.NamedPublicKey,
+	revoked nixtypes.RevocationList) (*resigning.Manager, error) {
+	if resigningConfig.HasSigningRules() {
+		l.Info("Conditional resigning requested")
+		return resigning.LoadManager(l, resigningConfig, privateKeys, publicKeys, revoked)
+	}
+
+	l.Info("Unconditional resigning requested")
+	if len(signingKeys) == 0 {
+		return nil, errors.New("no private keys selected")
+	}
+	return resigning.NewManager(l, []resigning.SigningRule{{
+		Name:            "signing-keys",
+		SignWith:        lo.Map(signingKeys, func(item nixtypes.NamedPrivateKey, _ int) string { return item.KeyName }),
+		ReplaceExisting: true,
+	}}, signingKeys, publicKeys, revoked)
+}
+
+// listNarInfos returns the narinfo files at the root of a binary cache
+func listNarInfos(rootDir *pathlib.Path) ([]*pathlib.Path, error) {
+	dirNames, err := rootDir.ReadDir()
+	if err != nil {
+		return nil, err
+	}
+	ninfoPaths := []*pathlib.Path{}
+	for _, entry := range dirNames {
+		if strings.HasSuffix(entry.Name(), ".narinfo") {
+			ninfoPaths = append(ninfoPaths, rootDir.Join(entry.Name()))
+		}
+	}
+	return ninfoPaths, nil
+}
+
 func loadNarInfo(l *zap.Logger, path *pathlib.Path) (nixtypes.NarInfo, error) {
 	fileBytes, err := path.ReadFile()
 	if err != nil {
@@ -180,34 +255,30 @@ func loadNarInfo(l *zap.Logger, path *pathlib.Path) (nixtypes.NarInfo, error) {
 	return ninfo, nil
 }
 
-// narHashCheck checks the actual file hash.
-// TODO: consider moving to a NarInfo function.
+// narHashCheck checks the NAR file of a narinfo against its FileHash and FileSize, and its
+// decompressed content against NarHash and NarSize. The obtained NarHash is returned.
 func narHashCheck(l *zap.Logger, path *pathlib.Path, ninfo nixtypes.NarInfo) (bool, nixtypes.TypedNixHash, error) {
 	narPath := path.Parent().Join(ninfo.URL)
 	nl := l.With(zap.String("nar_path", narPath.String()))
 	nl.Debug("Hash Verification")
+
 	fh, err := narPath.Open()
-	defer fh.Close()
 	if err != nil {
 		nl.Warn("Could not find file", zap.Error(err))
 		return false, nixtypes.TypedNixHash{}, err
 	}
-	if ninfo.FileHash.HashName != "sha256" {
-		nl.Warn("Unsupported hash", zap.String("hash_name", ninfo.FileHash.HashName))
-		return false, nixtypes.TypedNixHash{}, errors.New("unsupported hash")
-	}
-	// Only handle sha256 for now
-	hasher := sha256.New()
-	sizeBytes, err := io.Copy(hasher, fh)
-	nl.Debug("Read Bytes", zap.Int64("read_bytes", sizeBytes))
+	defer fh.Close()
+
+	obtainedNarHash, err := narcheck.Check(fh, ninfo)
 	if err != nil {
-		return false, nixtypes.TypedNixHash{}, err
-	}
-	obtainedHash := nixtypes.TypedNixHash{
-		HashName: ninfo.FileHash.HashName,
-		Hash:     hasher.Sum(nil),
+		if _, mismatch := errors.AsType[*narcheck.ErrHashMismatch](err); mismatch {
+			nl.Debug("Hash verification failed", zap.Error(err))
+		} else {
+			nl.Warn("Could not verify NAR file", zap.Error(err))
+		}
+		return false, obtainedNarHash, err
 	}
-	return bytes.Equal(obtainedHash.Hash, ninfo.FileHash.Hash), obtainedHash, nil
+	return true, obtainedNarHash, nil
 }
 
 func backNinfo(l *zap.Logger, path *pathlib.Path) error {
@@ -225,8 +296,14 @@ func backNinfo(l *zap.Logger, path *pathlib.Path) error {
 // outputDir adapts the output directory path based on the backing file handler type
 // namely "." gets reinterpreted as bucket root in S3 mode.
 func NormalizeOutputDir(outputDir string) string {
-	switch CLI.FsBackend {
-	case "s3":
+	return normalizeOutputDirFor(CLI.FsBackend, outputDir)
+}
+
+// normalizeOutputDirFor adapts the output directory path for a specific backend
+func normalizeOutputDirFor(fsBackend string, outputDir string) string {
+	switch fsBackend {
+	case "s3", "layered":
+		// Layers are rooted by their store URIs, so relative paths are relative to that root
 		if strings.HasPrefix(outputDir, ".") {
 			outputDir = fmt.Sprintf("/%s", outputDir[1:])
 		}
@@ -246,17 +323,10 @@ func writeNInfo(l *zap.Logger, path *pathlib.Path, ninfo nixtypes.NarInfo) error
 		l.Warn("Failed to serialize narinfo file - signing aborted", zap.Error(err))
 		return err
 	}
-	switch CLI.FsBackend {
-	case "s3", "nix-http-cache":
-		// For S3, just do an in-place PUT
-		// While the nix-cache-http FS can't (yet) write files, if it could, then
-		// it would work the same way (since it's pretty much identical to S3).
-		l.Debug("In-place PUT due to object-type storage")
-		if err := path.WriteFileMode(newBytes, os.FileMode(0644)); err != nil {
-			l.Warn("Failed to write narinfo file - signing aborted")
-			return err
-		}
-	default:
+	// The storage type is determined from the path itself since commands like copy work with
+	// more than one backend.
+	switch {
+	case fsIsFileLike(path.Fs()):
 		l.Debug("Atomic replace with temporary file due to file-like storage")
 		if err := newPath.WriteFileMode(newBytes, os.FileMode(0644)); err != nil {
 			l.Warn("Failed to write narinfo file - signing aborted")
@@ -266,7 +336,31 @@ func writeNInfo(l *zap.Logger, path *pathlib.Path, ninfo nixtypes.NarInfo) error
 			l.Warn("Failed to atomically replace narinfo file")
 			return err
 		}
+	default:
+		// For S3 and nix-http-cache, just do an in-place PUT
+		l.Debug("In-place PUT due to object-type storage")
+		if err := path.WriteFileMode(newBytes, os.FileMode(0644)); err != nil {
+			l.Warn("Failed to write narinfo file - signing aborted")
+			return err
+		}
 	}
 
 	return nil
 }
+
+// abortWrite closes a partially written file. Backends which stream uploads (such as
+// nix-http-cache) are told to abort the upload, rather than completing it with what was written.
+func abortWrite(f afero.File, err error) {
+	// pathlib wraps the backend file, which hides the Abort method
+	switch wrapped := f.(type) {
+	case *pathlib.File:
+		f = wrapped.File
+	case pathlib.File:
+		f = wrapped.File
+	}
+	if aborter, ok := f.(interface{ Abort(err error) error }); ok {
+		_ = aborter.Abort(err)
+		return
+	}
+	_ = f.Close()
+}
@@ -0,0 +1,110 @@
+package entrypoint
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/chigopher/pathlib"
+	"github.com/spf13/afero"
+	"github.com/wrouesnel/nix-sigman/pkg/narcheck"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+)
+
+// NarHashCheckSuite checks NAR files are verified against every hash and size in their narinfo
+type NarHashCheckSuite struct {
+	root *pathlib.Path
+}
+
+var _ = Suite(&NarHashCheckSuite{})
+
+func (s *NarHashCheckSuite) SetUpTest(c *C) {
+	s.root = pathlib.NewPath("/cache", pathlib.PathWithAfero(afero.NewMemMapFs()))
+	c.Assert(s.root.Join("nar").MkdirAll(), IsNil)
+}
+
+// compressNar compresses a NAR the way bundle does. An empty compression means bzip2, which is
+// what nix assumes when a narinfo has no Compression field.
+func compressNar(c *C, narBytes []byte, compression string) []byte {
+	if compression == "" {
+		compression = "bzip2"
+	}
+	compressor, err := narCompressor(compression, 0)
+	c.Assert(err, IsNil)
+	compressed := &bytes.Buffer{}
+	wr, err := compressor.OpenWriter(compressed)
+	c.Assert(err, IsNil)
+	_, err = wr.Write(narBytes)
+	c.Assert(err, IsNil)
+	c.Assert(wr.Close(), IsNil)
+	return compressed.Bytes()
+}
+
+// writeNar writes a NAR file and returns a narinfo for it. The file hash and size are always
+// those of fileBytes, the NAR hash and size those of narBytes.
+func (s *NarHashCheckSuite) writeNar(c *C, compression string, fileBytes []byte, narBytes []byte) (*pathlib.Path, nixtypes.NarInfo) {
+	fileHash := sha256.Sum256(fileBytes)
+	narHash := sha256.Sum256(narBytes)
+	ninfo := nixtypes.NarInfo{
+		StorePath:   fmt.Sprintf("/nix/store/%s-test", testHashPart),
+		URL:         fmt.Sprintf("nar/%s.nar", nixtypes.NixBase32Field(fileHash[:]).String()),
+		Compression: compression,
+		FileHash:    nixtypes.TypedNixHash{HashName: "sha256", Hash: fileHash[:]},
+		FileSize:    uint64(len(fileBytes)),
+		NarHash:     nixtypes.TypedNixHash{HashName: "sha256", Hash: narHash[:]},
+		NarSize:     uint64(len(narBytes)),
+		References:  []string{},
+		Extra:       map[string]string{},
+	}
+	c.Assert(s.root.Join(ninfo.URL).WriteFile(fileBytes), IsNil)
+	return s.root.Join(fmt.Sprintf("%s.narinfo", testHashPart)), ninfo
+}
+
+// checkMismatch runs narHashCheck and checks it failed on the given narinfo field
+func checkMismatch(c *C, ninfoPath *pathlib.Path, ninfo nixtypes.NarInfo, field string, comment CommentInterface) {
+	valid, _, err := narHashCheck(zap.NewNop(), ninfoPath, ninfo)
+	c.Check(valid, Equals, false, comment)
+	c.Assert(err, FitsTypeOf, &narcheck.ErrHashMismatch{}, comment)
+	c.Check(err.(*narcheck.ErrHashMismatch).Field, Equals, field, comment)
+}
+
+func (s *NarHashCheckSuite) TestNarHashCheck(c *C) {
+	for _, compression := range []string{"xz", "zstd", ""} {
+		comment := Commentf("compression %q", compression)
+		narBytes := testNar(c)
+		narHash := sha256.Sum256(narBytes)
+		compressed := compressNar(c, narBytes, compression)
+
+		ninfoPath, ninfo := s.writeNar(c, compression, compressed, narBytes)
+		valid, obtainedHash, err := narHashCheck(zap.NewNop(), ninfoPath, ninfo)
+		c.Check(err, IsNil, comment)
+		c.Check(valid, Equals, true, comment)
+		c.Check(obtainedHash.Hash, DeepEquals, nixtypes.NixBase32Field(narHash[:]), comment)
+
+		wrongHash := ninfo
+		otherHash := sha256.Sum256([]byte("something else"))
+		wrongHash.NarHash = nixtypes.TypedNixHash{HashName: "sha256", Hash: otherHash[:]}
+		checkMismatch(c, ninfoPath, wrongHash, "NarHash", comment)
+
+		wrongSize := ninfo
+		wrongSize.NarSize++
+		checkMismatch(c, ninfoPath, wrongSize, "NarSize", comment)
+	}
+}
+
+func (s *NarHashCheckSuite) TestCorruptArchive(c *C) {
+	for _, compression := range []string{"xz", "zstd", ""} {
+		comment := Commentf("compression %q", compression)
+		narBytes := testNar(c)
+		corrupt := compressNar(c, narBytes, compression)
+		corrupt[len(corrupt)/2] ^= 0xff
+
+		// The narinfo describes the corrupt file, so only the content checks can catch it
+		ninfoPath, ninfo := s.writeNar(c, compression, corrupt, narBytes)
+		valid, _, err := narHashCheck(zap.NewNop(), ninfoPath, ninfo)
+		c.Check(valid, Equals, false, comment)
+		c.Check(err, NotNil, comment)
+	}
+}
@@ -0,0 +1,476 @@
+package entrypoint
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/chigopher/pathlib"
+	s3 "github.com/fclairamb/afero-s3"
+	"github.com/samber/lo"
+	"github.com/spf13/afero"
+	nix_http_cachefs "github.com/wrouesnel/nix-http-cachefs"
+	"github.com/wrouesnel/nix-sigman/pkg/httpcachefs"
+	"github.com/wrouesnel/nix-sigman/pkg/layeredfs"
+	"go.uber.org/zap"
+)
+
+type ErrUnsupportedStore struct {
+	Store string
+}
+
+func (e ErrUnsupportedStore) Error() string {
+	return fmt.Sprintf("unsupported store URI: %s", e.Store)
+}
+
+type ErrInvalidFsOpts struct {
+	FsBackend string
+	Reason    string
+}
+
+func (e ErrInvalidFsOpts) Error() string {
+	return fmt.Sprintf("invalid fs-opts for %s backend: %s", e.FsBackend, e.Reason)
+}
+
+// CacheConfig selects a binary cache for commands which work with more than one. It mirrors the
+// global --store, --fs-backend and --fs-opts flags.
+type CacheConfig struct {
+	Store     string `help:"Nix store URI for the binary cache (overrides fs-backend and fs-opts)"`
+	FsBackend string `help:"Filesystem backend for the binary cache (layered only writes and deletes in its write layer, and deleting an object in another layer fails)" enum:"os,s3,nix-http-cache,layered" default:"os"`
+	FsOpts    string `help:"Additional options for the filesystem handler" default:""`
+	Root      string `help:"Root path of the binary cache" default:"."`
+}
+
+// RootPath initializes the filesystem backend and returns the root path of the cache on it
+func (c *CacheConfig) RootPath(l *zap.Logger) (*pathlib.Path, error) {
+	var fs afero.Fs
+	var err error
+	fsBackend := c.FsBackend
+	if c.Store != "" {
+		fs, fsBackend, err = newFsFromStore(l, c.Store)
+	} else {
+		fs, err = newFs(l, c.FsBackend, c.FsOpts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pathlib.NewPath(normalizeOutputDirFor(fsBackend, c.Root), pathlib.PathWithAfero(fs)).Clean(), nil
+}
+
+// prefixFs roots a backend at a path while keeping track of the underlying backend so its
+// storage semantics are still known.
+type prefixFs struct {
+	*afero.BasePathFs
+	source afero.Fs
+}
+
+func newPrefixFs(source afero.Fs, prefix string) afero.Fs {
+	return &prefixFs{
+		BasePathFs: afero.NewBasePathFs(source, prefix).(*afero.BasePathFs),
+		source:     source,
+	}
+}
+
+// fsIsFileLike reports if a filesystem has file semantics (i.e. atomic renames) rather than being
+// an object store.
+func fsIsFileLike(fs afero.Fs) bool {
+	switch typedFs := fs.(type) {
+	case *afero.OsFs:
+		return true
+	case *prefixFs:
+		return fsIsFileLike(typedFs.source)
+	case *layeredfs.LayeredFs:
+		return fsIsFileLike(typedFs.WriteLayer())
+	default:
+		return false
+	}
+}
+
+// newFs initializes a filesystem backend from its name and options string
+func newFs(logger *zap.Logger, fsBackend string, fsOpts string) (afero.Fs, error) {
+	switch fsBackend {
+	case "os":
+		if fsOpts != "" {
+			return nil, &ErrInvalidFsOpts{FsBackend: fsBackend, Reason: "fs-opts has no effect for the OS backend and must be blank"}
+		}
+		return afero.NewOsFs(), nil
+	case "s3":
+		opts, err := parseS3FsOpts(fsOpts)
+		if err != nil {
+			return nil, err
+		}
+		return newS3Fs(logger, opts)
+	case "nix-http-cache":
+		return newNixHttpCacheFs(logger, fsOpts)
+	case "layered":
+		return newLayeredFs(logger, fsOpts)
+	default:
+		return nil, fmt.Errorf("invalid filesystem backend: %s", fsBackend)
+	}
+}
+
+// newFsFromStore initializes a filesystem backend from a Nix store URI such as file:///srv/cache,
+// s3://bucket?region=eu-west-1 or https://cache.example.org. The name of the backend the URI maps
+// onto is also returned.
+func newFsFromStore(logger *zap.Logger, store string) (afero.Fs, string, error) {
+	storeUrl, err := url.Parse(store)
+	if err != nil {
+		return nil, "", errors.Join(&ErrUnsupportedStore{Store: store}, err)
+	}
+	params := storeUrl.Query()
+	paramNames := lo.Keys(params)
+	sort.Strings(paramNames)
+
+	switch storeUrl.Scheme {
+	case "file":
+		if storeUrl.Host != "" && storeUrl.Host != "localhost" {
+			return nil, "", &ErrUnsupportedStore{Store: store}
+		}
+		for _, name := range paramNames {
+			logger.Warn("Ignoring unsupported store parameter", zap.String("store", store), zap.String("param", name))
+		}
+		return newPrefixFs(afero.NewOsFs(), storeUrl.Path), "os", nil
+	case "s3":
+		opts, err := parseS3Store(logger, store, storeUrl)
+		if err != nil {
+			return nil, "", err
+		}
+		fs, err := newS3Fs(logger, opts)
+		return fs, "s3", err
+	case "http", "https":
+		cacheUrl, opts, err := parseHttpStore(logger, store, storeUrl)
+		if err != nil {
+			return nil, "", err
+		}
+		fs, err := buildNixHttpCacheFs(logger, []*url.URL{cacheUrl}, opts)
+		return fs, "nix-http-cache", err
+	default:
+		return nil, "", &ErrUnsupportedStore{Store: store}
+	}
+}
+
+// parseS3Store converts an s3:// store URI into S3 backend options. Parameters nix supports but
+// which don't apply here are ignored with a warning.
+func parseS3Store(logger *zap.Logger, store string, storeUrl *url.URL) (s3Options, error) {
+	params := storeUrl.Query()
+	paramNames := lo.Keys(params)
+	sort.Strings(paramNames)
+
+	opts := s3Options{Bucket: storeUrl.Host, Prefix: storeUrl.Path}
+	scheme := params.Get("scheme")
+	for _, name := range paramNames {
+		if name == "scheme" {
+			continue
+		}
+		if err := opts.set(name, params.Get(name)); errors.Is(err, errUnknownOpt) {
+			logger.Warn("Ignoring unsupported store parameter", zap.String("store", store), zap.String("param", name))
+		} else if err != nil {
+			return opts, &ErrInvalidFsOpts{FsBackend: "s3", Reason: fmt.Sprintf("%s: %s", name, err.Error())}
+		}
+	}
+	// Nix allows the endpoint to be a bare host with the scheme given separately
+	if opts.Endpoint != "" && !strings.Contains(opts.Endpoint, "://") {
+		if scheme == "" {
+			scheme = "https"
+		}
+		opts.Endpoint = fmt.Sprintf("%s://%s", scheme, opts.Endpoint)
+	}
+	return opts, nil
+}
+
+// parseHttpStore converts an http(s):// store URI into the cache URL and nix-http-cache backend
+// options. Parameters nix supports but which don't apply here are ignored with a warning.
+func parseHttpStore(logger *zap.Logger, store string, storeUrl *url.URL) (*url.URL, nixHttpCacheOptions, error) {
+	params := storeUrl.Query()
+	paramNames := lo.Keys(params)
+	sort.Strings(paramNames)
+
+	cacheUrl := *storeUrl
+	cacheUrl.RawQuery = ""
+	opts := nixHttpCacheOptions{}
+	for _, name := range paramNames {
+		if err := opts.set(name, params.Get(name)); errors.Is(err, errUnknownOpt) {
+			logger.Warn("Ignoring unsupported store parameter", zap.String("store", store), zap.String("param", name))
+		} else if err != nil {
+			return nil, opts, &ErrInvalidFsOpts{FsBackend: "nix-http-cache", Reason: fmt.Sprintf("%s: %s", name, err.Error())}
+		}
+	}
+	return &cacheUrl, opts, nil
+}
+
+// s3Options configures the S3 backend
+type s3Options struct {
+	Bucket   string
+	Region   string
+	Endpoint string
+	Profile  string
+	// PathStyle forces path-style (true) or virtual-host (false) addressing. If unset, path-style
+	// is used only with a custom endpoint.
+	PathStyle *bool
+	// Prefix is a key prefix the cache lives under within the bucket
+	Prefix string
+}
+
+// set sets an option by its key-value name
+func (o *s3Options) set(key string, value string) error {
+	switch key {
+	case "bucket":
+		o.Bucket = value
+	case "region":
+		o.Region = value
+	case "endpoint":
+		o.Endpoint = value
+	case "profile":
+		o.Profile = value
+	case "prefix":
+		o.Prefix = value
+	case "path-style":
+		pathStyle, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		o.PathStyle = &pathStyle
+	default:
+		return errUnknownOpt
+	}
+	return nil
+}
+
+// parseS3FsOpts parses the fs-opts for the S3 backend. This is a single-line CSV of the bucket
+// name followed by key=value options, e.g. my-bucket,region=eu-west-1,prefix=caches/team-a
+func parseS3FsOpts(fsOpts string) (s3Options, error) {
+	opts := s3Options{}
+	rdr := csv.NewReader(strings.NewReader(fsOpts))
+	rdr.LazyQuotes = true
+	rdr.TrimLeadingSpace = true
+	record, err := rdr.Read()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return opts, errors.Join(errors.New("error parsing FS opts"), err)
+	}
+	for idx, field := range record {
+		key, value, ok := strings.Cut(field, "=")
+		if idx == 0 && !ok {
+			opts.Bucket = field
+			continue
+		}
+		if !ok {
+			return opts, &ErrInvalidFsOpts{FsBackend: "s3", Reason: fmt.Sprintf("unparseable field option found: %s", field)}
+		}
+		if err := opts.set(key, value); errors.Is(err, errUnknownOpt) {
+			return opts, &ErrInvalidFsOpts{FsBackend: "s3", Reason: fmt.Sprintf("unknown field key found: %s", field)}
+		} else if err != nil {
+			return opts, &ErrInvalidFsOpts{FsBackend: "s3", Reason: fmt.Sprintf("%s: %s", field, err.Error())}
+		}
+	}
+	if opts.Bucket == "" {
+		return opts, &ErrInvalidFsOpts{FsBackend: "s3", Reason: "must specify a bucket"}
+	}
+	return opts, nil
+}
+
+// s3Addressing returns the endpoint override (nil for AWS) and whether path-style addressing is
+// used for the S3 backend.
+func s3Addressing(opts s3Options, getenv func(string) string) (*string, *bool) {
+	// In truly frustrating style, endpoint overrides aren't supported till V2,
+	// which this library isn't based on. Hack them in here.
+	var endpointUrl *string
+	for _, endpoint := range []string{getenv("AWS_ENDPOINT_URL"), getenv("AWS_ENDPOINT_URL_S3"), opts.Endpoint} {
+		if endpoint != "" {
+			endpointUrl = aws.String(endpoint)
+		}
+	}
+	// Custom endpoints (i.e. minio) usually don't do virtual-host addressing
+	forcePathStyle := aws.Bool(endpointUrl != nil)
+	if opts.PathStyle != nil {
+		forcePathStyle = opts.PathStyle
+	}
+	return endpointUrl, forcePathStyle
+}
+
+func newS3Fs(logger *zap.Logger, opts s3Options) (afero.Fs, error) {
+	// At debug level, print some logging about what which AWS environment variables are set
+	// since this is *very* annoying to debug.
+	for _, env := range os.Environ() {
+		envname, envvalue, _ := strings.Cut(env, "=")
+		if strings.HasPrefix(envname, "AWS_") {
+			fields := []zap.Field{zap.String("name", envname)}
+			if envname != "AWS_SECRET_ACCESS_KEY" {
+				fields = append(fields, zap.String("value", envvalue))
+			} else {
+				fields = append(fields, zap.String("value", "**OMITTED**"),
+					zap.Bool("ellided_value", true))
+			}
+			if envvalue != "" {
+				logger.Debug("AWS Environment variable is set", fields...)
+			} else {
+				logger.Debug("AWS Environment variable is NOT set", fields...)
+			}
+		}
+	}
+	endpointUrl, forcePathStyle := s3Addressing(opts, os.Getenv)
+	logger.Debug("S3 configuration", zap.String("bucket", opts.Bucket), zap.String("prefix", opts.Prefix),
+		zap.Stringp("endpoint", endpointUrl), zap.Boolp("path_style", forcePathStyle))
+	config := aws.Config{Endpoint: endpointUrl, S3ForcePathStyle: forcePathStyle}
+	if opts.Region != "" {
+		config.Region = aws.String(opts.Region)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            config,
+		Profile:           opts.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, errors.Join(errors.New("error creating S3 session"), err)
+	}
+	s3fs := s3.NewFs(opts.Bucket, sess)
+	if s3fs == nil {
+		return nil, errors.New("error initializing the S3 FS")
+	}
+	if prefix := strings.Trim(opts.Prefix, "/"); prefix != "" {
+		return newPrefixFs(s3fs, "/"+prefix), nil
+	}
+	return s3fs, nil
+}
+
+func newNixHttpCacheFs(logger *zap.Logger, fsOpts string) (afero.Fs, error) {
+	rdr := csv.NewReader(strings.NewReader(fsOpts))
+	rdr.LazyQuotes = true
+	rdr.TrimLeadingSpace = true
+	record, err := rdr.Read()
+	if err != nil {
+		return nil, errors.Join(errors.New("error parsing FS opts"), err)
+	}
+	if len(record) == 0 {
+		return nil, &ErrInvalidFsOpts{FsBackend: "nix-http-cache", Reason: "must specify at least an URL to an HTTP nix cache server"}
+	}
+	cacheUrls := []*url.URL{}
+	urlsFinished := false
+	opts := nixHttpCacheOptions{}
+	for _, field := range record {
+		key, value, ok := strings.Cut(field, "=")
+		if !urlsFinished && !ok {
+			cacheUrl, err := url.Parse(field)
+			if err != nil {
+				return nil, errors.Join(errors.New("error parsing supplied URL for nix-http-cache type"), err)
+			}
+			cacheUrls = append(cacheUrls, cacheUrl)
+			continue
+		} else if !urlsFinished {
+			urlsFinished = true
+		}
+		if !ok {
+			return nil, &ErrInvalidFsOpts{FsBackend: "nix-http-cache", Reason: fmt.Sprintf("unparseable field option found: %s", field)}
+		}
+		if err := opts.set(key, value); err != nil {
+			return nil, &ErrInvalidFsOpts{FsBackend: "nix-http-cache", Reason: fmt.Sprintf("unknown field key found: %s", field)}
+		}
+	}
+	return buildNixHttpCacheFs(logger, cacheUrls, opts)
+}
+
+var errUnknownOpt = errors.New("unknown option")
+
+// nixHttpCacheOptions configures the nix-http-cache backend
+type nixHttpCacheOptions struct {
+	// NetrcFile supplies credentials for both reading and uploading
+	NetrcFile       string
+	PersistentCache string
+}
+
+// set applies a key-value option, returning errUnknownOpt for unrecognized keys
+func (o *nixHttpCacheOptions) set(key string, value string) error {
+	switch key {
+	case "netrc-file":
+		o.NetrcFile = value
+	case "persistent-cache":
+		o.PersistentCache = value
+	default:
+		return errUnknownOpt
+	}
+	return nil
+}
+
+// buildNixHttpCacheFs initializes the nix-http-cache backend. Reads may be served by any of the
+// cache URLs, but uploads always go to the first one.
+func buildNixHttpCacheFs(logger *zap.Logger, cacheUrls []*url.URL, opts nixHttpCacheOptions) (afero.Fs, error) {
+	readOpts := []nix_http_cachefs.Opt{
+		nix_http_cachefs.ErrorLogger(func(msg string) {
+			logger.Error(msg, zap.String("fs-backend", "nix-http-cache"))
+		}),
+		nix_http_cachefs.DebugLogger(func(msg string) {
+			logger.Debug(msg, zap.String("fs-backend", "nix-http-cache"))
+		}),
+	}
+	if opts.NetrcFile != "" {
+		readOpts = append(readOpts, nix_http_cachefs.NetrcFile(opts.NetrcFile))
+	}
+	if opts.PersistentCache != "" {
+		localCachePath := pathlib.NewPath(opts.PersistentCache, pathlib.PathWithAfero(afero.NewOsFs()))
+		readOpts = append(readOpts, nix_http_cachefs.PersistentCache(localCachePath))
+	}
+	readFs, err := nix_http_cachefs.NewNixHttpCacheFs(cacheUrls, readOpts...)
+	if err != nil {
+		return nil, errors.Join(errors.New("bad configuration for nix-cache-httpfs backend"), err)
+	}
+
+	fs, err := httpcachefs.NewHttpCacheFs(logger.With(zap.String("fs-backend", "nix-http-cache")),
+		readFs, cacheUrls[0], opts.NetrcFile, nil)
+	if err != nil {
+		return nil, errors.Join(errors.New("bad upload configuration for nix-cache-httpfs backend"), err)
+	}
+	return fs, nil
+}
+
+// newLayeredFs stacks the backends given as store URIs in fsOpts into a single cache. Layers are
+// listed in priority order and writes go to the first layer unless write-layer is set.
+func newLayeredFs(logger *zap.Logger, fsOpts string) (afero.Fs, error) {
+	rdr := csv.NewReader(strings.NewReader(fsOpts))
+	rdr.LazyQuotes = true
+	rdr.TrimLeadingSpace = true
+	record, err := rdr.Read()
+	if err != nil {
+		return nil, errors.Join(errors.New("error parsing FS opts"), err)
+	}
+
+	layers := []afero.Fs{}
+	writeLayer := 0
+	for _, field := range record {
+		if strings.Contains(field, "://") {
+			layer, layerBackend, err := newFsFromStore(logger, field)
+			if err != nil {
+				return nil, errors.Join(&ErrInvalidFsOpts{FsBackend: "layered", Reason: fmt.Sprintf("could not configure layer: %s", field)}, err)
+			}
+			logger.Debug("Configured cache layer", zap.Int("layer", len(layers)),
+				zap.String("store", field), zap.String("fs-backend", layerBackend))
+			layers = append(layers, layer)
+			continue
+		}
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "write-layer":
+			writeLayer, err = strconv.Atoi(value)
+			if err != nil {
+				return nil, &ErrInvalidFsOpts{FsBackend: "layered", Reason: fmt.Sprintf("write-layer must be an integer: %s", value)}
+			}
+		default:
+			return nil, &ErrInvalidFsOpts{FsBackend: "layered", Reason: fmt.Sprintf("unknown field key found: %s", field)}
+		}
+	}
+	if len(layers) == 0 {
+		return nil, &ErrInvalidFsOpts{FsBackend: "layered", Reason: "must specify at least one store URI as a layer"}
+	}
+
+	fs, err := layeredfs.NewLayeredFs(layers, writeLayer)
+	if err != nil {
+		return nil, errors.Join(&ErrInvalidFsOpts{FsBackend: "layered", Reason: "invalid write layer"}, err)
+	}
+	return fs, nil
+}
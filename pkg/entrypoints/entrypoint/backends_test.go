@@ -0,0 +1,115 @@
+package entrypoint
+
+import (
+	"net/url"
+
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+)
+
+// BackendsSuite checks store URIs and fs-opts are parsed into backend options
+type BackendsSuite struct{}
+
+var _ = Suite(&BackendsSuite{})
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func (s *BackendsSuite) TestFileStore(c *C) {
+	for _, store := range []string{"file:///srv/cache", "file://localhost/srv/cache", "file:///srv/cache?compression=xz"} {
+		fs, fsBackend, err := newFsFromStore(zap.NewNop(), store)
+		c.Assert(err, IsNil, Commentf("store %s", store))
+		c.Check(fsBackend, Equals, "os")
+		c.Check(fsIsFileLike(fs), Equals, true)
+	}
+
+	_, _, err := newFsFromStore(zap.NewNop(), "file://otherhost/srv/cache")
+	c.Check(err, FitsTypeOf, &ErrUnsupportedStore{})
+	_, _, err = newFsFromStore(zap.NewNop(), "ssh://otherhost")
+	c.Check(err, FitsTypeOf, &ErrUnsupportedStore{})
+}
+
+func (s *BackendsSuite) TestS3Store(c *C) {
+	for store, expected := range map[string]s3Options{
+		"s3://my-bucket": {Bucket: "my-bucket"},
+		"s3://my-bucket/caches/team-a?region=eu-west-1&profile=ci": {
+			Bucket: "my-bucket", Prefix: "/caches/team-a", Region: "eu-west-1", Profile: "ci",
+		},
+		"s3://my-bucket?endpoint=minio.local:9000":             {Bucket: "my-bucket", Endpoint: "https://minio.local:9000"},
+		"s3://my-bucket?endpoint=minio.local:9000&scheme=http": {Bucket: "my-bucket", Endpoint: "http://minio.local:9000"},
+		"s3://my-bucket?endpoint=http://minio.local:9000":      {Bucket: "my-bucket", Endpoint: "http://minio.local:9000"},
+		"s3://my-bucket?path-style=false":                      {Bucket: "my-bucket", PathStyle: boolPtr(false)},
+		// Parameters nix understands but which don't apply are ignored
+		"s3://my-bucket?compression=zstd&parallel-compression=true": {Bucket: "my-bucket"},
+	} {
+		storeUrl, err := url.Parse(store)
+		c.Assert(err, IsNil)
+		opts, err := parseS3Store(zap.NewNop(), store, storeUrl)
+		c.Assert(err, IsNil, Commentf("store %s", store))
+		c.Check(opts, DeepEquals, expected, Commentf("store %s", store))
+	}
+
+	storeUrl, err := url.Parse("s3://my-bucket?path-style=maybe")
+	c.Assert(err, IsNil)
+	_, err = parseS3Store(zap.NewNop(), storeUrl.String(), storeUrl)
+	c.Check(err, FitsTypeOf, &ErrInvalidFsOpts{})
+}
+
+func (s *BackendsSuite) TestS3FsOpts(c *C) {
+	for fsOpts, expected := range map[string]s3Options{
+		"my-bucket": {Bucket: "my-bucket"},
+		"my-bucket,region=eu-west-1,prefix=caches/team-a": {
+			Bucket: "my-bucket", Region: "eu-west-1", Prefix: "caches/team-a",
+		},
+		"bucket=my-bucket,endpoint=http://minio.local:9000,path-style=true": {
+			Bucket: "my-bucket", Endpoint: "http://minio.local:9000", PathStyle: boolPtr(true),
+		},
+	} {
+		opts, err := parseS3FsOpts(fsOpts)
+		c.Assert(err, IsNil, Commentf("fs-opts %s", fsOpts))
+		c.Check(opts, DeepEquals, expected, Commentf("fs-opts %s", fsOpts))
+	}
+
+	for _, fsOpts := range []string{"", "my-bucket,region", "my-bucket,colour=blue", "my-bucket,path-style=maybe"} {
+		_, err := parseS3FsOpts(fsOpts)
+		c.Check(err, FitsTypeOf, &ErrInvalidFsOpts{}, Commentf("fs-opts %s", fsOpts))
+	}
+}
+
+func (s *BackendsSuite) TestS3Addressing(c *C) {
+	noEnv := func(string) string { return "" }
+
+	endpoint, pathStyle := s3Addressing(s3Options{Bucket: "my-bucket"}, noEnv)
+	c.Check(endpoint, IsNil)
+	c.Check(*pathStyle, Equals, false)
+
+	// Custom endpoints default to path-style addressing
+	endpoint, pathStyle = s3Addressing(s3Options{Bucket: "my-bucket", Endpoint: "http://minio.local:9000"}, noEnv)
+	c.Assert(endpoint, NotNil)
+	c.Check(*endpoint, Equals, "http://minio.local:9000")
+	c.Check(*pathStyle, Equals, true)
+
+	endpoint, pathStyle = s3Addressing(s3Options{Bucket: "my-bucket"}, func(name string) string {
+		if name == "AWS_ENDPOINT_URL" {
+			return "http://env.local:9000"
+		}
+		return ""
+	})
+	c.Assert(endpoint, NotNil)
+	c.Check(*endpoint, Equals, "http://env.local:9000")
+	c.Check(*pathStyle, Equals, true)
+
+	_, pathStyle = s3Addressing(s3Options{Bucket: "my-bucket", Endpoint: "http://minio.local:9000", PathStyle: boolPtr(false)}, noEnv)
+	c.Check(*pathStyle, Equals, false)
+}
+
+func (s *BackendsSuite) TestHttpStore(c *C) {
+	store := "https://cache.example.org/team-a?netrc-file=/etc/nix/netrc&persistent-cache=/var/cache/nix-sigman&priority=30"
+	storeUrl, err := url.Parse(store)
+	c.Assert(err, IsNil)
+	cacheUrl, opts, err := parseHttpStore(zap.NewNop(), store, storeUrl)
+	c.Assert(err, IsNil)
+	c.Check(cacheUrl.String(), Equals, "https://cache.example.org/team-a")
+	c.Check(opts, DeepEquals, nixHttpCacheOptions{NetrcFile: "/etc/nix/netrc", PersistentCache: "/var/cache/nix-sigman"})
+}
@@ -1,6 +1,7 @@
 package entrypoint
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
@@ -8,26 +9,35 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/1lann/countwriter"
 	"github.com/chigopher/pathlib"
 	"github.com/jmoiron/sqlx"
 	"github.com/mholt/archives"
 	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"github.com/wrouesnel/nix-sigman/pkg/resigning"
 	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
 	_ "modernc.org/sqlite"
 	"zombiezen.com/go/nix/nar"
 )
 
 //nolint:gochecknoglobals
 type BundleConfig struct {
-	NixDB        string `help:"Path to the nix database" default:"/nix/var/nix/db/db.sqlite"`
-	Compression  string `help:"NAR file compression" enum:"xz" default:"xz"`
-	OutputDir    string `help:"Output directory to write the bundles too" default:"."`
-	NarOutputDir string `help:"Subdirectory to save NAR files too" default:"nar"`
-	// TODO: ShardStore - build a sharded store with multiple directory trees
-	Paths []string `arg:"" help:"nix paths or hashes to bundle"`
+	resigning.ResigningConfig `embed:""`
+	SigningKeys               []string `help:"Names of keys to sign generated narinfo files with (* for all)"`
+	NixDB                     string   `help:"Path to the nix database" default:"/nix/var/nix/db/db.sqlite"`
+	Compression               string   `help:"NAR file compression (${enum})" enum:"xz,zstd,gzip,bzip2,br,none" default:"xz"`
+	CompressionLevel          int      `help:"NAR file compression level (0 uses the algorithm default, not supported for xz and none)" default:"0"`
+	Closure                   bool     `help:"Bundle the runtime closure of the given paths, skipping paths already in the output"`
+	Jobs                      int      `help:"Number of paths to bundle concurrently (0 for the number of CPUs)" short:"j" default:"0"`
+	OutputDir                 string   `help:"Output directory to write the bundles too" default:"."`
+	NarOutputDir              string   `help:"Subdirectory to save NAR files too" default:"nar"`
+	ShardLevels               int      `help:"Number of directory levels to shard NAR files into (0 for a flat layout)" default:"0"`
+	Paths                     []string `arg:"" help:"nix paths or hashes to bundle"`
 }
 
 // NixDBValidPaths is the DTO for interfacing to the nix database
@@ -51,6 +61,10 @@ const NixCacheInfoName = "nix-cache-info"
 func Bundle(cmdCtx *CmdContext) error {
 	l := cmdCtx.logger
 
+	if err := validateCompressionLevel(CLI.Bundle.Compression, CLI.Bundle.CompressionLevel); err != nil {
+		return errors.Join(&ErrCommand{}, err)
+	}
+
 	var nixDbPath string
 
 	nixDbPath = CLI.Bundle.NixDB
@@ -105,205 +119,446 @@ func Bundle(cmdCtx *CmdContext) error {
 		return errors.Join(&ErrCommand{}, errors.New("could not make nar output directory"), err)
 	}
 
-	var compressor archives.Compressor
-	switch CLI.Bundle.Compression {
-	case "xz":
-		compressor = new(archives.Xz)
-	default:
-		l.Error("BUG: Unknown compressor")
-		return errors.New("unknown compressor")
+	if err := validateShardLevels(CLI.Bundle.ShardLevels); err != nil {
+		return errors.Join(&ErrCommand{}, err)
 	}
 
-	nixStore := new(string)
-
-	err = readPaths(cmdCtx, CLI.Bundle.Paths, func(path *pathlib.Path) error {
-		shortPath := path.Name()
-		narId, _, _ := strings.Cut(shortPath, "-")
-
-		l := l.With(zap.String("path_id", narId))
-
-		nixRows := make([]NixDBValidPaths, 0)
+	compressor, err := narCompressor(CLI.Bundle.Compression, CLI.Bundle.CompressionLevel)
+	if err != nil {
+		l.Error("BUG: Unknown compressor", zap.String("compression", CLI.Bundle.Compression))
+		return errors.Join(&ErrCommand{}, err)
+	}
+	narExt, err := narExtension(CLI.Bundle.Compression)
+	if err != nil {
+		l.Error("BUG: Unknown compressor", zap.String("compression", CLI.Bundle.Compression))
+		return errors.Join(&ErrCommand{}, err)
+	}
 
-		// TODO: fix this inefficient query as well
-		if err := db.Select(&nixRows, "SELECT * FROM ValidPaths WHERE path LIKE  '%/' || ? || '-%';", narId); err != nil {
-			l.Warn("Failed to query path ID", zap.String("path", path.String()))
-			return err
+	var signers *resigning.Manager
+	if len(CLI.Bundle.SigningKeys) > 0 || CLI.Bundle.HasSigningRules() {
+		privateKeys, err := loadPrivateKeys(l)
+		if err != nil {
+			l.Error("Error loading private keys", zap.Error(err))
+			return errors.Join(&ErrCommand{}, err)
 		}
 
-		if len(nixRows) > 1 {
-			l.Warn("Got multiple matches for NixID? Is your database corrupt?")
-			return errors.New("got more then 1 match for given path")
+		publicKeys, err := loadPublicKeys(l)
+		if err != nil {
+			l.Error("Error loading public keys", zap.Error(err))
+			return errors.Join(&ErrCommand{}, err)
 		}
 
-		if len(nixRows) == 0 {
-			l.Warn("Could not find the requested path in the store")
-			return nil
+		revoked, err := loadRevocations(l)
+		if err != nil {
+			l.Error("Error loading revoked keys", zap.Error(err))
+			return errors.Join(&ErrCommand{}, err)
 		}
 
-		nixRow := nixRows[0]
+		signingKeys := selectSigningKeys(l, privateKeys, CLI.Bundle.SigningKeys)
+		l.Debug("Signing Keys Set", zap.Int("num_signing_keys", len(signingKeys)))
 
-		if nixStore == nil {
-			*nixStore = filepath.Dir(nixRow.Path)
+		signers, err = loadSigners(l, &CLI.Bundle.ResigningConfig, signingKeys, privateKeys, publicKeys, revoked)
+		if err != nil {
+			return errors.Join(&ErrCommand{}, err)
 		}
+	}
 
-		l.Debug("Found store object", zap.Int64("id", nixRow.ID))
-
-		l.Info("Generating NAR file")
-		narPath := narOutputDir.Join(fmt.Sprintf("%s.nar.%s", narId, CLI.Bundle.Compression))
-		outputFile, err := narPath.Create()
+	// Resolve all the requested paths before doing any work
+	nixRows := []NixDBValidPaths{}
+	err = readPaths(cmdCtx, CLI.Bundle.Paths, func(path *pathlib.Path) error {
+		nixRow, err := lookupNixPath(l, db, path)
 		if err != nil {
-			l.Error("Could not create output file", zap.Error(err))
-			return errors.Join(errors.New("could not create output file"), err)
+			return err
 		}
-		defer outputFile.Close()
-
-		// We need two hashes here: the filehash, and the NAR hash so we need several tees
-		// NAR -> -> compressor -> file
-		//        \-> narhasher \
-		//						 \-> filehasher
-		fileHasher := sha256.New()
-		narHasher := sha256.New()
+		if nixRow != nil {
+			nixRows = append(nixRows, *nixRow)
+		}
+		return nil
+	})
+	if err != nil {
+		l.Error("Error during path processing")
+		return errors.Join(&ErrCommand{}, err)
+	}
 
-		fileWr := countwriter.NewWriter(io.MultiWriter(outputFile, fileHasher))
-		compWr, err := compressor.OpenWriter(fileWr)
+	if CLI.Bundle.Closure {
+		l.Debug("Resolving closure of requested paths", zap.Int("num_paths", len(nixRows)))
+		nixRows, err = nixPathClosure(db, nixRows)
 		if err != nil {
-			l.Error("Could not create compression writer")
-			return err
+			l.Error("Error while resolving closure", zap.Error(err))
+			return errors.Join(&ErrCommand{}, err)
 		}
-		defer compWr.Close()
+		l.Info("Resolved closure", zap.Int("closure_paths", len(nixRows)))
+	}
 
-		narWr := countwriter.NewWriter(io.MultiWriter(compWr, narHasher))
+	nixStore := ""
+	if len(nixRows) > 0 {
+		nixStore = filepath.Dir(nixRows[0].Path)
+	}
 
-		// Wire the nar stream to the start of the pipe
-		if err := nar.DumpPath(narWr, nixRow.Path); err != nil {
-			l.Error("Failed to dump path to NAR file", zap.Error(err))
-			return err
+	jobs := CLI.Bundle.Jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+	l.Debug("Bundling paths", zap.Int("num_paths", len(nixRows)), zap.Int("jobs", jobs))
+
+	sem := semaphore.NewWeighted(int64(jobs))
+	wg := new(sync.WaitGroup)
+	resultsMtx := new(sync.Mutex)
+	var bundleErr error
+	added := 0
+	present := 0
+	failed := 0
+	for _, nixRow := range nixRows {
+		if err := sem.Acquire(cmdCtx.ctx, 1); err != nil {
+			l.Warn("Context closed during iteration", zap.String("msg", err.Error()))
+			resultsMtx.Lock()
+			bundleErr = errors.Join(bundleErr, err)
+			resultsMtx.Unlock()
+			break
 		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer sem.Release(1)
+
+			narId, _, _ := strings.Cut(filepath.Base(nixRow.Path), "-")
+			l := l.With(zap.String("path_id", narId))
+
+			if CLI.Bundle.Closure {
+				exists, err := outputDir.Join(fmt.Sprintf("%s.narinfo", narId)).Exists()
+				if err != nil {
+					l.Error("Could not check for existing narinfo", zap.Error(err))
+					resultsMtx.Lock()
+					bundleErr = errors.Join(bundleErr, &ErrBundlePath{Path: nixRow.Path}, err)
+					failed++
+					resultsMtx.Unlock()
+					return
+				}
+				if exists {
+					l.Debug("Skipping path already present in output")
+					resultsMtx.Lock()
+					present++
+					resultsMtx.Unlock()
+					return
+				}
+			}
 
-		narFileSize := narWr.Count()
-		narHash := narHasher.Sum(nil)
-		fileSize := fileWr.Count()
-		fileHash := fileHasher.Sum(nil)
-
-		l.Debug("Successfully wrote NAR file",
-			zap.String("file", outputFile.Name()),
-			zap.Uint64("file_size", fileSize),
-			zap.String("file_hash", hex.EncodeToString(narHash)),
-			zap.Uint64("nar_file_size", narFileSize),
-			zap.String("nar_file_hash", hex.EncodeToString(fileHash)),
-		)
-
-		// Cross-check the narSize against the DB size
-		if nixRow.NarSize != nil {
-			if *nixRow.NarSize != narFileSize {
-				l.Warn("Obtained NAR filesize does not match database",
-					zap.Uint64("obtained_size", narFileSize), zap.Uint64("written_size", *nixRow.NarSize))
+			err := bundleNixPath(cmdCtx.ctx, l, db, nixRow, outputDir, narOutputDir, compressor, narExt, signers)
+			resultsMtx.Lock()
+			defer resultsMtx.Unlock()
+			if err != nil {
+				l.Error("Error during path processing", zap.Error(err))
+				bundleErr = errors.Join(bundleErr, &ErrBundlePath{Path: nixRow.Path}, err)
+				failed++
+				return
 			}
-		}
+			added++
+		}()
+	}
+	wg.Wait()
 
-		// Decode the hash out of the database
-		hashType, hashHex, found := strings.Cut(nixRow.Hash, ":")
-		if !found {
-			l.Error("Hash field does not look like a hash", zap.String("hash", nixRow.Hash))
-			return errors.New("hash field can't be identified")
-		}
+	l.Info("Bundled paths", zap.Int("added", added), zap.Int("present", present), zap.Int("failed", failed))
+	fmt.Fprintf(cmdCtx.stdOut, "added:%d present:%d failed:%d\n", added, present, failed)
 
-		var hashBytes []byte
-		switch hashType {
-		case "sha256":
-			hashBytes, err = hex.DecodeString(hashHex)
-			if err != nil {
-				l.Error("NAR hash could not be decoded", zap.String("hash", nixRow.Hash))
-				return errors.New("hash was not a valid hex string")
+	if bundleErr != nil {
+		l.Error("Errors during path processing - not writing the nix cache info file")
+		return errors.Join(&ErrCommand{}, bundleErr)
+	}
+
+	if nixStore == "" {
+		l.Warn("No paths were found in the store - not writing the nix cache info file")
+		return nil
+	}
+
+	l.Debug("Writing the nix cache info file")
+	metadata := fmt.Sprintf(
+		`StoreDir: %s
+WantMassQuery: 1
+Priority: 10
+`, nixStore,
+	)
+
+	err = outputDir.Join(NixCacheInfoName).WriteFileMode([]byte(metadata), os.FileMode(0644))
+	if err != nil {
+		l.Error("Failed to write the nix-cache-info file", zap.Error(err))
+		return errors.Join(&ErrCommand{}, err)
+	}
+
+	return err
+}
+
+// lookupNixPath finds the database row for a store path or hash. nil is returned if the path
+// is not in the store.
+func lookupNixPath(l *zap.Logger, db *sqlx.DB, path *pathlib.Path) (*NixDBValidPaths, error) {
+	shortPath := path.Name()
+	narId, _, _ := strings.Cut(shortPath, "-")
+
+	l = l.With(zap.String("path_id", narId))
+
+	nixRows := make([]NixDBValidPaths, 0)
+
+	// TODO: fix this inefficient query as well
+	if err := db.Select(&nixRows, "SELECT * FROM ValidPaths WHERE path LIKE  '%/' || ? || '-%';", narId); err != nil {
+		l.Warn("Failed to query path ID", zap.String("path", path.String()))
+		return nil, err
+	}
+
+	if len(nixRows) > 1 {
+		l.Warn("Got multiple matches for NixID? Is your database corrupt?")
+		return nil, errors.New("got more then 1 match for given path")
+	}
+
+	if len(nixRows) == 0 {
+		l.Warn("Could not find the requested path in the store")
+		return nil, nil
+	}
+
+	l.Debug("Found store object", zap.Int64("id", nixRows[0].ID))
+	return &nixRows[0], nil
+}
+
+// nixPathReferences returns the rows for the references of a store path
+func nixPathReferences(db *sqlx.DB, id int64) ([]NixDBValidPaths, error) {
+	referenceRows := make([]NixDBValidPaths, 0)
+	if err := db.Select(&referenceRows, "SELECT * FROM ValidPaths WHERE id in (SELECT reference FROM Refs WHERE referrer = ?);", id); err != nil {
+		return nil, err
+	}
+	return referenceRows, nil
+}
+
+// nixPathClosure follows the Refs table from the given paths and returns every path in their
+// runtime closure (including the paths themselves).
+func nixPathClosure(db *sqlx.DB, roots []NixDBValidPaths) ([]NixDBValidPaths, error) {
+	seen := map[int64]struct{}{}
+	closure := []NixDBValidPaths{}
+	nextPaths := roots[:]
+	for len(nextPaths) > 0 {
+		currentPaths := nextPaths
+		nextPaths = []NixDBValidPaths{}
+		for _, row := range currentPaths {
+			if _, found := seen[row.ID]; found {
+				continue
 			}
-		default:
-			l.Error("unknown hash type", zap.String("hashtype", hashType))
-			return errors.New("unknown hash type")
-		}
+			seen[row.ID] = struct{}{}
+			closure = append(closure, row)
 
-		sig := make([]nixtypes.NixSignature, 0)
-		if nixRow.Sigs != nil {
-			for _, sigString := range strings.Split(*nixRow.Sigs, " ") {
-				s := nixtypes.NixSignature{}
-				if err := s.UnmarshalText([]byte(sigString)); err != nil {
-					l.Error("Could not unmarshal a signature on the row", zap.String("sig_string", sigString))
-					return errors.New("unparseable signature")
+			references, err := nixPathReferences(db, row.ID)
+			if err != nil {
+				return closure, err
+			}
+			for _, reference := range references {
+				if _, found := seen[reference.ID]; !found {
+					nextPaths = append(nextPaths, reference)
 				}
-				sig = append(sig, s)
 			}
 		}
+	}
+	return closure, nil
+}
 
-		deriver := ""
-		if nixRow.Deriver != nil {
-			deriver = *nixRow.Deriver
-		}
+type ErrBundlePath struct {
+	Path string
+}
 
-		// Get references
-		referenceRows := make([]NixDBValidPaths, 0)
+func (e ErrBundlePath) Error() string {
+	return fmt.Sprintf("error while bundling path: %v", e.Path)
+}
 
-		if err := db.Select(&referenceRows, "SELECT * FROM ValidPaths WHERE id in (SELECT reference FROM Refs WHERE referrer = ?);", nixRow.ID); err != nil {
-			l.Warn("Failed to query references", zap.String("path", path.String()))
-			return err
-		}
+// ctxWriter aborts writes once its context is cancelled, since NAR dumping has no other way to
+// be interrupted.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
 
-		references := []string{}
-		for _, row := range referenceRows {
-			references = append(references, filepath.Base(row.Path))
-		}
+func (c ctxWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
 
-		extra := map[string]string{}
-		if nixRow.Ca != nil {
-			extra["CA"] = *nixRow.Ca
+// bundleNixPath writes the NAR file and narinfo for a single store path to the output directory.
+// The narinfo is signed by the signers (if any) before it is written. A partially written NAR file
+// is removed on failure.
+func bundleNixPath(ctx context.Context, l *zap.Logger, db *sqlx.DB, nixRow NixDBValidPaths, outputDir *pathlib.Path, narOutputDir *pathlib.Path,
+	compressor archives.Compressor, narExt string, signers *resigning.Manager) error {
+	narId, _, _ := strings.Cut(filepath.Base(nixRow.Path), "-")
+
+	l.Info("Generating NAR file")
+	narPath := narOutputDir.Join(shardedName(fmt.Sprintf("%s%s", narId, narExt), CLI.Bundle.ShardLevels))
+	if CLI.Bundle.ShardLevels > 0 {
+		if err := narPath.Parent().MkdirAllMode(os.FileMode(0755)); err != nil {
+			l.Error("Could not create shard directory", zap.Error(err))
+			return errors.Join(errors.New("could not create shard directory"), err)
+		}
+	}
+	outputFile, err := narPath.Create()
+	if err != nil {
+		l.Error("Could not create output file", zap.Error(err))
+		return errors.Join(errors.New("could not create output file"), err)
+	}
+	// Once the output file is closed the backend has the whole NAR, and later failures can only
+	// remove it. Until then, streaming backends are told to abort rather than publish it.
+	outputClosed := false
+	narComplete := false
+	defer func() {
+		if !outputClosed {
+			abortWrite(outputFile, errors.New("NAR was not completely written"))
 		}
+		if !narComplete {
+			l.Debug("Attempting to remove partially written file")
+			if err := narPath.Remove(); err != nil {
+				l.Warn("Could not remove partially written file", zap.Error(err))
+			}
+		}
+	}()
 
-		ninfoPath := outputDir.Join(fmt.Sprintf("%s.narinfo", narId))
-		// Try and figure out the URL of the nar file relative to us
-		relNarPath, err := narPath.RelativeTo(ninfoPath.Parent())
-		if err != nil {
-			l.Error("Cannot determine relative path of NAR from Ninfo", zap.Error(err))
-			return errors.New("No sane nar URL can be determined")
+	// We need two hashes here: the filehash, and the NAR hash so we need several tees
+	// NAR -> -> compressor -> file
+	//        \-> narhasher \
+	//						 \-> filehasher
+	fileHasher := sha256.New()
+	narHasher := sha256.New()
+
+	fileWr := countwriter.NewWriter(io.MultiWriter(outputFile, fileHasher))
+	compWr, err := compressor.OpenWriter(fileWr)
+	if err != nil {
+		l.Error("Could not create compression writer")
+		return err
+	}
+
+	narWr := countwriter.NewWriter(ctxWriter{ctx, io.MultiWriter(compWr, narHasher)})
+
+	// Wire the nar stream to the start of the pipe
+	if err := nar.DumpPath(narWr, nixRow.Path); err != nil {
+		compWr.Close()
+		l.Error("Failed to dump path to NAR file", zap.Error(err))
+		return err
+	}
+
+	// The compressor must be flushed before the file size and hash are final
+	if err := compWr.Close(); err != nil {
+		l.Error("Failed to finish compressing NAR file", zap.Error(err))
+		return err
+	}
+	outputClosed = true
+	if err := outputFile.Close(); err != nil {
+		l.Error("Failed to finish writing NAR file", zap.Error(err))
+		return err
+	}
+
+	narFileSize := narWr.Count()
+	narHash := narHasher.Sum(nil)
+	fileSize := fileWr.Count()
+	fileHash := fileHasher.Sum(nil)
+
+	l.Debug("Successfully wrote NAR file",
+		zap.String("file", outputFile.Name()),
+		zap.Uint64("file_size", fileSize),
+		zap.String("file_hash", hex.EncodeToString(narHash)),
+		zap.Uint64("nar_file_size", narFileSize),
+		zap.String("nar_file_hash", hex.EncodeToString(fileHash)),
+	)
+
+	// Cross-check the narSize against the DB size
+	if nixRow.NarSize != nil {
+		if *nixRow.NarSize != narFileSize {
+			l.Warn("Obtained NAR filesize does not match database",
+				zap.Uint64("obtained_size", narFileSize), zap.Uint64("written_size", *nixRow.NarSize))
 		}
+	}
+
+	// Decode the hash out of the database
+	hashType, hashHex, found := strings.Cut(nixRow.Hash, ":")
+	if !found {
+		l.Error("Hash field does not look like a hash", zap.String("hash", nixRow.Hash))
+		return errors.New("hash field can't be identified")
+	}
 
-		// Populate the ninfo file
-		ninfo := nixtypes.NarInfo{
-			StorePath:   nixRow.Path,
-			URL:         relNarPath.String(),
-			Compression: CLI.Bundle.Compression,
-			FileHash:    nixtypes.TypedNixHash{"sha256", fileHasher.Sum(nil)},
-			FileSize:    fileSize,
-			NarHash:     nixtypes.TypedNixHash{hashType, hashBytes},
-			NarSize:     narFileSize,
-			References:  references,
-			Deriver:     filepath.Base(deriver),
-			Sig:         sig,
-			Extra:       extra,
+	var hashBytes []byte
+	switch hashType {
+	case "sha256":
+		hashBytes, err = hex.DecodeString(hashHex)
+		if err != nil {
+			l.Error("NAR hash could not be decoded", zap.String("hash", nixRow.Hash))
+			return errors.New("hash was not a valid hex string")
 		}
+	default:
+		l.Error("unknown hash type", zap.String("hashtype", hashType))
+		return errors.New("unknown hash type")
+	}
 
-		if err := writeNInfo(l, ninfoPath, ninfo); err != nil {
-			return err
+	sig := make([]nixtypes.NixSignature, 0)
+	if nixRow.Sigs != nil {
+		for _, sigString := range strings.Split(*nixRow.Sigs, " ") {
+			s := nixtypes.NixSignature{}
+			if err := s.UnmarshalText([]byte(sigString)); err != nil {
+				l.Error("Could not unmarshal a signature on the row", zap.String("sig_string", sigString))
+				return errors.New("unparseable signature")
+			}
+			sig = append(sig, s)
 		}
+	}
 
-		return nil
-	})
+	deriver := ""
+	if nixRow.Deriver != nil {
+		deriver = *nixRow.Deriver
+	}
 
+	// Get references
+	referenceRows, err := nixPathReferences(db, nixRow.ID)
 	if err != nil {
-		l.Error("Error during path processing")
-		return errors.Join(&ErrCommand{}, err)
+		l.Warn("Failed to query references", zap.String("path", nixRow.Path))
+		return err
 	}
 
-	l.Debug("Writing the nix cache info file")
-	metadata := fmt.Sprintf(
-		`StoreDir: %s
-WantMassQuery: 1
-Priority: 10
-`, *nixStore,
-	)
+	references := []string{}
+	for _, row := range referenceRows {
+		references = append(references, filepath.Base(row.Path))
+	}
 
-	err = outputDir.Join(NixCacheInfoName).WriteFileMode([]byte(metadata), os.FileMode(0644))
+	ca := ""
+	if nixRow.Ca != nil {
+		ca = *nixRow.Ca
+	}
+
+	ninfoPath := outputDir.Join(fmt.Sprintf("%s.narinfo", narId))
+	// Try and figure out the URL of the nar file relative to us
+	relNarPath, err := narPath.RelativeTo(ninfoPath.Parent())
 	if err != nil {
-		l.Error("Failed to write the nix-cache-info file", zap.Error(err))
-		return errors.Join(&ErrCommand{}, err)
+		l.Error("Cannot determine relative path of NAR from Ninfo", zap.Error(err))
+		return errors.New("No sane nar URL can be determined")
 	}
 
-	return err
+	// Populate the ninfo file
+	ninfo := nixtypes.NarInfo{
+		StorePath:   nixRow.Path,
+		URL:         relNarPath.String(),
+		Compression: CLI.Bundle.Compression,
+		FileHash:    nixtypes.TypedNixHash{"sha256", fileHasher.Sum(nil)},
+		FileSize:    fileSize,
+		NarHash:     nixtypes.TypedNixHash{hashType, hashBytes},
+		NarSize:     narFileSize,
+		References:  references,
+		Deriver:     filepath.Base(deriver),
+		Sig:         sig,
+		CA:          ca,
+		Extra:       map[string]string{},
+	}
+
+	if _, err := signers.Resign(ctx, &ninfo); err != nil {
+		l.Error("Failed to sign narinfo", zap.Error(err))
+		return err
+	}
+
+	// The NAR is finished at this point - even if the narinfo fails to write, leave it
+	// in place for a subsequent run.
+	narComplete = true
+
+	if err := writeNInfo(l, ninfoPath, ninfo); err != nil {
+		return err
+	}
+
+	return nil
 }
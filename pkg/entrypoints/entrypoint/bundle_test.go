@@ -0,0 +1,185 @@
+package entrypoint
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/chigopher/pathlib"
+	"github.com/jmoiron/sqlx"
+	"github.com/spf13/afero"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+	"zombiezen.com/go/nix/nar"
+)
+
+// BundleSuite bundles paths from a fake nix store and database into an OS backend
+type BundleSuite struct {
+	storeDir  string
+	outputDir *pathlib.Path
+	db        *sqlx.DB
+	key       nixtypes.NamedPrivateKey
+	stdOut    *bytes.Buffer
+	// storePaths maps hash parts to the full store path of each path added to the store
+	storePaths map[string]string
+}
+
+var _ = Suite(&BundleSuite{})
+
+const nixDBSchema = `
+CREATE TABLE ValidPaths (
+	id               integer primary key autoincrement not null,
+	path             text unique not null,
+	hash             text not null,
+	registrationTime integer not null,
+	deriver          text,
+	narSize          integer,
+	ultimate         integer,
+	sigs             text,
+	ca               text
+);
+CREATE TABLE Refs (
+	referrer  integer not null,
+	reference integer not null,
+	primary key (referrer, reference)
+);
+`
+
+func (s *BundleSuite) SetUpTest(c *C) {
+	s.storeDir = c.MkDir()
+	s.outputDir = pathlib.NewPath(c.MkDir(), pathlib.PathWithAfero(afero.NewOsFs()))
+	s.stdOut = &bytes.Buffer{}
+	s.storePaths = map[string]string{}
+
+	dbPath := filepath.Join(c.MkDir(), "db.sqlite")
+	var err error
+	s.db, err = sqlx.Open("sqlite", dbPath)
+	c.Assert(err, IsNil)
+	_, err = s.db.Exec(nixDBSchema)
+	c.Assert(err, IsNil)
+
+	s.key, err = nixtypes.GeneratePrivateKey("bundle-test-1")
+	c.Assert(err, IsNil)
+	CLI.PrivateKeys = []string{s.key.String()}
+	CLI.Bundle = BundleConfig{
+		NixDB:        dbPath,
+		Compression:  "zstd",
+		Jobs:         2,
+		OutputDir:    s.outputDir.String(),
+		NarOutputDir: "nar",
+		SigningKeys:  []string{"*"},
+	}
+}
+
+func (s *BundleSuite) TearDownTest(c *C) {
+	s.db.Close()
+	CLI.Bundle = BundleConfig{}
+	CLI.PrivateKeys = nil
+}
+
+func (s *BundleSuite) cmdCtx() *CmdContext {
+	return &CmdContext{logger: zap.NewNop(), ctx: context.Background(), stdOut: s.stdOut, fs: afero.NewOsFs()}
+}
+
+// addStorePath writes a store path to the fake store and registers it in the database with the
+// given references (which must already be registered).
+func (s *BundleSuite) addStorePath(c *C, hashPart string, name string, ca string, references ...string) string {
+	storePath := filepath.Join(s.storeDir, fmt.Sprintf("%s-%s", hashPart, name))
+	c.Assert(os.WriteFile(storePath, []byte(fmt.Sprintf("contents of %s\n", name)), 0o644), IsNil)
+	narBuf := &bytes.Buffer{}
+	c.Assert(nar.DumpPath(narBuf, storePath), IsNil)
+	narHash := sha256.Sum256(narBuf.Bytes())
+
+	var caValue *string
+	if ca != "" {
+		caValue = &ca
+	}
+	_, err := s.db.Exec("INSERT INTO ValidPaths (path, hash, registrationTime, narSize, ca) VALUES (?, ?, ?, ?, ?)",
+		storePath, "sha256:"+hex.EncodeToString(narHash[:]), 1700000000, narBuf.Len(), caValue)
+	c.Assert(err, IsNil)
+	for _, reference := range references {
+		_, err := s.db.Exec(`INSERT INTO Refs (referrer, reference)
+			SELECT referrer.id, reference.id FROM ValidPaths referrer, ValidPaths reference
+			WHERE referrer.path = ? AND reference.path = ?`, storePath, s.storePaths[reference])
+		c.Assert(err, IsNil)
+	}
+	s.storePaths[hashPart] = storePath
+	return storePath
+}
+
+func (s *BundleSuite) loadNarInfo(c *C, hashPart string) nixtypes.NarInfo {
+	ninfo, err := loadNarInfo(zap.NewNop(), s.outputDir.Join(fmt.Sprintf("%s.narinfo", hashPart)))
+	c.Assert(err, IsNil)
+	return ninfo
+}
+
+func (s *BundleSuite) TestClosureSkipsPresentPaths(c *C) {
+	const libHashPart = "1b8m1dp0ln4rlvkbi7zyb5yvvfzwhbsm"
+	const depHashPart = "0c3g8ysjqz1mhn5q2ya6v4kfrwxdb9p7"
+	s.addStorePath(c, depHashPart, "dep", "")
+	s.addStorePath(c, libHashPart, "lib", "", depHashPart)
+	appPath := s.addStorePath(c, testHashPart, "app", "", libHashPart)
+
+	// The dependency is already in the cache, and must be left alone
+	existing := []byte("already here\n")
+	c.Assert(s.outputDir.Join(fmt.Sprintf("%s.narinfo", depHashPart)).WriteFile(existing), IsNil)
+
+	CLI.Bundle.Closure = true
+	CLI.Bundle.Paths = []string{appPath}
+	c.Assert(Bundle(s.cmdCtx()), IsNil)
+	c.Check(s.stdOut.String(), Equals, "added:2 present:1 failed:0\n")
+
+	for _, hashPart := range []string{testHashPart, libHashPart} {
+		comment := Commentf("path %s", hashPart)
+		ninfoPath := s.outputDir.Join(fmt.Sprintf("%s.narinfo", hashPart))
+		ninfo := s.loadNarInfo(c, hashPart)
+		c.Check(ninfo.StorePath, Equals, s.storePaths[hashPart], comment)
+		verified, _ := ninfo.Verify(s.key.PublicKey())
+		c.Check(verified, Equals, true, comment)
+		valid, _, err := narHashCheck(zap.NewNop(), ninfoPath, ninfo)
+		c.Check(err, IsNil, comment)
+		c.Check(valid, Equals, true, comment)
+	}
+	c.Check(s.loadNarInfo(c, testHashPart).References, DeepEquals, []string{filepath.Base(s.storePaths[libHashPart])})
+
+	storedNinfo, err := s.outputDir.Join(fmt.Sprintf("%s.narinfo", depHashPart)).ReadFile()
+	c.Assert(err, IsNil)
+	c.Check(storedNinfo, DeepEquals, existing)
+	exists, err := s.outputDir.Join(NixCacheInfoName).Exists()
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, true)
+}
+
+func (s *BundleSuite) TestContentAddressedRule(c *C) {
+	const caHashPart = "1b8m1dp0ln4rlvkbi7zyb5yvvfzwhbsm"
+	const ca = "fixed:r:sha256:1b8m1dp0ln4rlvkbi7zyb5yvvfzwhbsm1b8m1dp0ln4rlvkbi7zy"
+	caPath := s.addStorePath(c, caHashPart, "source", ca)
+	appPath := s.addStorePath(c, testHashPart, "app", "")
+
+	// Only content addressed paths are signed
+	rulesFile := filepath.Join(c.MkDir(), "rules.yaml")
+	c.Assert(os.WriteFile(rulesFile, []byte(fmt.Sprintf(`rules:
+  - name: content-addressed
+    content-addressed: true
+    sign-with: [%s]
+`, s.key.KeyName)), 0o644), IsNil)
+	CLI.Bundle.SigningKeys = nil
+	CLI.Bundle.SigningRulesFile = rulesFile
+	CLI.Bundle.Paths = []string{caPath, appPath}
+	c.Assert(Bundle(s.cmdCtx()), IsNil)
+
+	caNinfo := s.loadNarInfo(c, caHashPart)
+	c.Check(caNinfo.CA, Equals, ca)
+	c.Check(caNinfo.Extra, HasLen, 0)
+	verified, _ := caNinfo.Verify(s.key.PublicKey())
+	c.Check(verified, Equals, true)
+
+	appNinfo := s.loadNarInfo(c, testHashPart)
+	c.Check(appNinfo.CA, Equals, "")
+	c.Check(appNinfo.Sig, HasLen, 0)
+}
@@ -0,0 +1,113 @@
+package entrypoint
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/chigopher/pathlib"
+	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/fatih/color"
+	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
+)
+
+//nolint:gochecknoglobals
+type CheckClosureConfig struct {
+	Root string `arg:"" help:"Root path of the binary cache"`
+}
+
+type ErrIncompleteClosure struct {
+	Missing int
+}
+
+func (e ErrIncompleteClosure) Error() string {
+	return fmt.Sprintf("cache is missing %d referenced paths", e.Missing)
+}
+
+// CheckClosure confirms every reference of every narinfo in a binary cache is also in the cache,
+// and lists the missing paths along with the store paths which depend on them.
+func CheckClosure(cmdCtx *CmdContext) error {
+	l := cmdCtx.logger
+
+	rootDir := pathlib.NewPath(NormalizeOutputDir(CLI.CheckClosure.Root), pathlib.PathWithAfero(cmdCtx.fs)).Clean()
+	l.Info("Reading narinfo files (this may take a while)", zap.String("root", rootDir.String()))
+	ninfoPaths, err := listNarInfos(rootDir)
+	if err != nil {
+		return errors.Join(&ErrCommand{}, err)
+	}
+
+	// Presence is by narinfo name since that is what nix will request
+	present := mapset.NewSet[string]()
+	for _, ninfoPath := range ninfoPaths {
+		present.Add(strings.TrimSuffix(ninfoPath.Name(), ".narinfo"))
+	}
+
+	sem := semaphore.NewWeighted(int64(runtime.NumCPU()))
+	wg := new(sync.WaitGroup)
+	resultsMtx := new(sync.Mutex)
+	var loadErr error
+	// dependents maps referenced store path names to the store paths which reference them
+	dependents := map[string]mapset.Set[string]{}
+	for _, ninfoPath := range ninfoPaths {
+		if err := sem.Acquire(cmdCtx.ctx, 1); err != nil {
+			l.Warn("Context closed during iteration", zap.String("msg", err.Error()))
+			resultsMtx.Lock()
+			loadErr = errors.Join(loadErr, err)
+			resultsMtx.Unlock()
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer sem.Release(1)
+			l := l.With(zap.String("path", ninfoPath.String()))
+
+			ninfo, err := loadNarInfo(l, ninfoPath)
+			resultsMtx.Lock()
+			defer resultsMtx.Unlock()
+			if err != nil {
+				l.Warn("Could not load narinfo file", zap.Error(err))
+				loadErr = errors.Join(loadErr, &ErrNinfo{ninfoPath}, err)
+				return
+			}
+			for _, reference := range ninfo.References {
+				if _, found := dependents[reference]; !found {
+					dependents[reference] = mapset.NewThreadUnsafeSet[string]()
+				}
+				dependents[reference].Add(ninfo.StorePath)
+			}
+		}()
+	}
+	wg.Wait()
+
+	missing := []string{}
+	for reference := range dependents {
+		hashPart, _, _ := strings.Cut(reference, "-")
+		if !present.Contains(hashPart) {
+			missing = append(missing, reference)
+		}
+	}
+	sort.Strings(missing)
+
+	for _, reference := range missing {
+		dependentPaths := dependents[reference].ToSlice()
+		sort.Strings(dependentPaths)
+		fmt.Fprintf(cmdCtx.stdOut, "%s:%s:%s\n", color.CyanString(reference), color.RedString("MISSING"),
+			strings.Join(dependentPaths, " "))
+	}
+
+	l.Info("Checked cache closure", zap.Int("narinfos", len(ninfoPaths)),
+		zap.Int("references", len(dependents)), zap.Int("missing", len(missing)))
+
+	if len(missing) > 0 {
+		loadErr = errors.Join(loadErr, &ErrIncompleteClosure{Missing: len(missing)})
+	}
+	if loadErr != nil {
+		return errors.Join(&ErrCommand{}, loadErr)
+	}
+	return nil
+}
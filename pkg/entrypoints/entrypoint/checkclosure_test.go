@@ -0,0 +1,66 @@
+package entrypoint
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/chigopher/pathlib"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+)
+
+// CheckClosureSuite checks references missing from a cache are reported with their dependents
+type CheckClosureSuite struct {
+	fs     afero.Fs
+	root   *pathlib.Path
+	stdOut *bytes.Buffer
+}
+
+var _ = Suite(&CheckClosureSuite{})
+
+func (s *CheckClosureSuite) SetUpTest(c *C) {
+	s.fs = afero.NewMemMapFs()
+	s.root = pathlib.NewPath("/cache", pathlib.PathWithAfero(s.fs))
+	s.stdOut = &bytes.Buffer{}
+	CLI.CheckClosure = CheckClosureConfig{Root: "/cache"}
+}
+
+func (s *CheckClosureSuite) TearDownTest(c *C) {
+	CLI.CheckClosure = CheckClosureConfig{}
+}
+
+func (s *CheckClosureSuite) cmdCtx() *CmdContext {
+	return &CmdContext{logger: zap.NewNop(), ctx: context.Background(), stdOut: s.stdOut, fs: s.fs}
+}
+
+// writeReferencingPath writes a cache path whose narinfo references the given store path names
+func (s *CheckClosureSuite) writeReferencingPath(c *C, hashPart string, references ...string) string {
+	ninfo := writeCachePath(c, s.root, hashPart, fmt.Sprintf("nar/%s.nar", hashPart), randomNar(c))
+	ninfo.References = references
+	c.Assert(writeNInfo(zap.NewNop(), s.root.Join(fmt.Sprintf("%s.narinfo", hashPart)), ninfo), IsNil)
+	return ninfo.StorePath
+}
+
+func (s *CheckClosureSuite) TestCompleteClosure(c *C) {
+	const libHashPart = "1b8m1dp0ln4rlvkbi7zyb5yvvfzwhbsm"
+	s.writeReferencingPath(c, libHashPart)
+	s.writeReferencingPath(c, testHashPart, libHashPart+"-test")
+
+	c.Assert(CheckClosure(s.cmdCtx()), IsNil)
+	c.Check(s.stdOut.String(), Equals, "")
+}
+
+func (s *CheckClosureSuite) TestMissingReference(c *C) {
+	const libHashPart = "1b8m1dp0ln4rlvkbi7zyb5yvvfzwhbsm"
+	const missing = "0c3g8ysjqz1mhn5q2ya6v4kfrwxdb9p7-missing"
+	libPath := s.writeReferencingPath(c, libHashPart, missing)
+	appPath := s.writeReferencingPath(c, testHashPart, libHashPart+"-test", missing)
+
+	err := CheckClosure(s.cmdCtx())
+	c.Assert(err, NotNil)
+	c.Check(err, ErrorMatches, "(?s).*cache is missing 1 referenced paths.*")
+	// Only the missing path is reported, followed by both of its dependents
+	c.Check(s.stdOut.String(), Matches, fmt.Sprintf("[^\n]*%s[^\n]*:[^\n]*MISSING[^\n]*:%s %s\n", missing, libPath, appPath))
+}
@@ -51,6 +51,9 @@ func dispatchCommands(ctx *kong.Context, cmdCtx *CmdContext) error {
 	case "sign <nar-info-files>":
 		err = Sign(cmdCtx)
 
+	case "resign explain <nar-info-files>":
+		err = ResignExplain(cmdCtx)
+
 	case "verify <nar-info-files>":
 		err = Verify(cmdCtx)
 
@@ -60,6 +63,18 @@ func dispatchCommands(ctx *kong.Context, cmdCtx *CmdContext) error {
 	case "bundle <paths>":
 		err = Bundle(cmdCtx)
 
+	case "reshard <root>":
+		err = Reshard(cmdCtx)
+
+	case "gc <root>":
+		err = Gc(cmdCtx)
+
+	case "check-closure <root>":
+		err = CheckClosure(cmdCtx)
+
+	case "copy <paths>":
+		err = Copy(cmdCtx)
+
 	case "new-key":
 		err = NewKey(cmdCtx)
 
@@ -0,0 +1,96 @@
+package entrypoint
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mholt/archives"
+	"github.com/wrouesnel/nix-sigman/pkg/narcheck"
+)
+
+// brotliDefaultQuality is the quality used by brotli when none is specified
+const brotliDefaultQuality = 6
+
+type ErrUnsupportedCompressionLevel struct {
+	Compression string
+}
+
+func (e ErrUnsupportedCompressionLevel) Error() string {
+	return fmt.Sprintf("a compression level can't be set for %s compression", e.Compression)
+}
+
+// narCompressionExtensions maps the narinfo Compression field to the file extension nix uses
+// for NAR files compressed with it. Like nix, gzip compressed NARs get no extension.
+//
+//nolint:gochecknoglobals
+var narCompressionExtensions = map[string]string{
+	"none":  "",
+	"xz":    ".xz",
+	"zstd":  ".zst",
+	"gzip":  "",
+	"bzip2": ".bz2",
+	"br":    ".br",
+}
+
+// narExtension returns the file extension for a NAR file with the given compression
+func narExtension(compression string) (string, error) {
+	ext, found := narCompressionExtensions[compression]
+	if !found {
+		return "", &narcheck.ErrUnknownCompression{Compression: compression}
+	}
+	return fmt.Sprintf(".nar%s", ext), nil
+}
+
+// nopWriteCloser adapts a writer for uncompressed output
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type noneCompressor struct{}
+
+func (noneCompressor) OpenWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+// validateCompressionLevel checks a compression level can be applied to the compression. The
+// xz compressor has no levels, so rather than silently using the default, setting one is an error.
+func validateCompressionLevel(compression string, level int) error {
+	if level != 0 && (compression == "xz" || compression == "none") {
+		return &ErrUnsupportedCompressionLevel{Compression: compression}
+	}
+	return nil
+}
+
+// narCompressor returns a compressor for the given narinfo compression name. A level of 0 selects
+// the default level for the algorithm.
+func narCompressor(compression string, level int) (archives.Compressor, error) {
+	switch compression {
+	case "none":
+		return noneCompressor{}, nil
+	case "xz":
+		return archives.Xz{}, nil
+	case "zstd":
+		compressor := archives.Zstd{}
+		if level != 0 {
+			compressor.EncoderOptions = append(compressor.EncoderOptions,
+				zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return compressor, nil
+	case "gzip":
+		return archives.Gz{CompressionLevel: level, Multithreaded: true}, nil
+	case "bzip2":
+		return archives.Bz2{CompressionLevel: level}, nil
+	case "br":
+		if level == 0 {
+			level = brotliDefaultQuality
+		}
+		return archives.Brotli{Quality: level}, nil
+	default:
+		return nil, &narcheck.ErrUnknownCompression{Compression: compression}
+	}
+}
@@ -0,0 +1,70 @@
+package entrypoint
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+
+	"github.com/wrouesnel/nix-sigman/pkg/narcheck"
+	. "gopkg.in/check.v1"
+)
+
+// CompressionSuite checks NAR compression formats round-trip and are named the way nix names them
+type CompressionSuite struct{}
+
+var _ = Suite(&CompressionSuite{})
+
+func (s *CompressionSuite) TestRoundTrip(c *C) {
+	content := make([]byte, 256*1024)
+	_, err := rand.Read(content[:1024])
+	c.Assert(err, IsNil)
+
+	for compression, expectedExt := range map[string]string{
+		"none":  ".nar",
+		"xz":    ".nar.xz",
+		"zstd":  ".nar.zst",
+		"gzip":  ".nar",
+		"bzip2": ".nar.bz2",
+		"br":    ".nar.br",
+	} {
+		comment := Commentf("compression %s", compression)
+		ext, err := narExtension(compression)
+		c.Assert(err, IsNil, comment)
+		c.Check(ext, Equals, expectedExt, comment)
+
+		compressor, err := narCompressor(compression, 0)
+		c.Assert(err, IsNil, comment)
+		compressed := &bytes.Buffer{}
+		wr, err := compressor.OpenWriter(compressed)
+		c.Assert(err, IsNil, comment)
+		_, err = wr.Write(content)
+		c.Assert(err, IsNil, comment)
+		c.Assert(wr.Close(), IsNil, comment)
+		if compression != "none" {
+			c.Check(compressed.Len() < len(content), Equals, true, comment)
+		}
+
+		decompressor, err := narcheck.Decompressor(compression)
+		c.Assert(err, IsNil, comment)
+		rd, err := decompressor.OpenReader(compressed)
+		c.Assert(err, IsNil, comment)
+		decompressed, err := io.ReadAll(rd)
+		c.Assert(err, IsNil, comment)
+		c.Assert(rd.Close(), IsNil, comment)
+		c.Check(bytes.Equal(decompressed, content), Equals, true, comment)
+	}
+
+	_, err = narExtension("lz4")
+	c.Check(err, FitsTypeOf, &narcheck.ErrUnknownCompression{})
+	_, err = narCompressor("lz4", 0)
+	c.Check(err, FitsTypeOf, &narcheck.ErrUnknownCompression{})
+	_, err = narcheck.Decompressor("lz4")
+	c.Check(err, FitsTypeOf, &narcheck.ErrUnknownCompression{})
+}
+
+func (s *CompressionSuite) TestCompressionLevel(c *C) {
+	c.Check(validateCompressionLevel("zstd", 19), IsNil)
+	c.Check(validateCompressionLevel("xz", 0), IsNil)
+	c.Check(validateCompressionLevel("xz", 9), FitsTypeOf, &ErrUnsupportedCompressionLevel{})
+	c.Check(validateCompressionLevel("none", 1), FitsTypeOf, &ErrUnsupportedCompressionLevel{})
+}
@@ -0,0 +1,97 @@
+package entrypoint
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"go.withmatt.com/httpheaders"
+)
+
+// contentEtag returns a strong ETag for generated content such as a resigned narinfo. Since it
+// hashes what is actually served, it changes whenever resigning changes the signatures.
+func contentEtag(content []byte) string {
+	contentHash := sha256.Sum256(content)
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(contentHash[:16]))
+}
+
+// fileEtag returns an ETag for a stored file. Stored files are never modified in place, so the
+// modification time and size identify the content.
+func fileEtag(st os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", st.ModTime().UnixNano(), st.Size())
+}
+
+// serveContent writes a response body with conditional request (If-None-Match,
+// If-Modified-Since) and Range handling. HEAD requests get the headers only.
+func serveContent(w http.ResponseWriter, r *http.Request, contentType string, modTime time.Time, etag string,
+	content io.ReadSeeker) {
+	w.Header().Set(httpheaders.ContentType, contentType)
+	if etag != "" {
+		w.Header().Set(httpheaders.Etag, etag)
+	}
+	http.ServeContent(w, r, "", modTime, content)
+}
+
+var errStreamSeek = errors.New("stream can only seek forwards from the current position")
+
+// streamSeeker adapts a stream of known size to io.ReadSeeker so it can be used with
+// serveContent. Seeking is only possible before reading or forwards, which is done by discarding
+// data - this is enough for a single Range request to resume an interrupted download.
+type streamSeeker struct {
+	r    io.Reader
+	size int64
+	// offset is the logical position, pos is how far the stream has actually been read
+	offset int64
+	pos    int64
+}
+
+func newStreamSeeker(r io.Reader, size int64) *streamSeeker {
+	return &streamSeeker{r: r, size: size}
+}
+
+func (s *streamSeeker) Read(p []byte) (int, error) {
+	if s.offset < s.pos {
+		return 0, errStreamSeek
+	}
+	if s.offset > s.pos {
+		skipped, err := io.CopyN(io.Discard, s.r, s.offset-s.pos)
+		s.pos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.r.Read(p)
+	s.pos += int64(n)
+	s.offset = s.pos
+	return n, err
+}
+
+func (s *streamSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return s.offset, errStreamSeek
+	}
+	if offset < 0 {
+		return s.offset, errStreamSeek
+	}
+	s.offset = offset
+	return s.offset, nil
+}
+
+// seekableContent returns f directly if it can seek, and otherwise wraps it in a streamSeeker
+func seekableContent(f io.ReadSeeker, size int64) io.ReadSeeker {
+	if _, err := f.Seek(0, io.SeekCurrent); err != nil {
+		return newStreamSeeker(f, size)
+	}
+	return f
+}
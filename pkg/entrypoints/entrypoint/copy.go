@@ -0,0 +1,319 @@
+package entrypoint
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/chigopher/pathlib"
+	"github.com/wrouesnel/nix-sigman/pkg/narcheck"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"github.com/wrouesnel/nix-sigman/pkg/resigning"
+	"github.com/wrouesnel/nix-sigman/pkg/upstream"
+	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
+)
+
+//nolint:gochecknoglobals
+type CopyConfig struct {
+	resigning.ResigningConfig `embed:""`
+	From                      CacheConfig `embed:"" prefix:"from-"`
+	To                        CacheConfig `embed:"" prefix:"to-"`
+	Closure                   bool        `help:"Copy the full reference closure of the given paths"`
+	Jobs                      int         `help:"Number of paths to copy concurrently (0 for the number of CPUs)" short:"j" default:"0"`
+	Paths                     []string    `arg:"" help:"Store paths or hashes to copy - specify - to read list from stdin"`
+}
+
+type ErrCopyPath struct {
+	HashPart string
+}
+
+func (e ErrCopyPath) Error() string {
+	return fmt.Sprintf("error while copying path: %v", e.HashPart)
+}
+
+// Copy copies narinfo files and their NARs from one binary cache to another, resigning them on the
+// way through. Paths already in the destination are skipped, and each narinfo is only written
+// after its NAR.
+func Copy(cmdCtx *CmdContext) error {
+	l := cmdCtx.logger
+
+	privateKeys, err := loadPrivateKeys(l)
+	if err != nil {
+		l.Error("Error loading private keys", zap.Error(err))
+		return errors.Join(&ErrCommand{}, err)
+	}
+
+	publicKeys, err := loadPublicKeys(l)
+	if err != nil {
+		l.Error("Error loading public keys", zap.Error(err))
+		return errors.Join(&ErrCommand{}, err)
+	}
+
+	revoked, err := loadRevocations(l)
+	if err != nil {
+		l.Error("Error loading revoked keys", zap.Error(err))
+		return errors.Join(&ErrCommand{}, err)
+	}
+
+	l.Debug("Load signing map")
+	signers, err := resigning.LoadManager(l, &CLI.Copy.ResigningConfig, privateKeys, publicKeys, revoked)
+	if err != nil {
+		return errors.Join(&ErrCommand{}, err)
+	}
+
+	srcRoot, err := CLI.Copy.From.RootPath(l)
+	if err != nil {
+		l.Error("Error configuring source cache", zap.Error(err))
+		return errors.Join(&ErrCommand{}, err)
+	}
+	dstRoot, err := CLI.Copy.To.RootPath(l)
+	if err != nil {
+		l.Error("Error configuring destination cache", zap.Error(err))
+		return errors.Join(&ErrCommand{}, err)
+	}
+	l.Info("Copying between caches", zap.String("from", srcRoot.String()), zap.String("to", dstRoot.String()))
+
+	hashParts := []string{}
+	err = readPaths(cmdCtx, CLI.Copy.Paths, func(path *pathlib.Path) error {
+		hashPart, _, _ := strings.Cut(strings.TrimSuffix(path.Name(), ".narinfo"), "-")
+		hashParts = append(hashParts, hashPart)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	jobs := CLI.Copy.Jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	ninfos, copyErr := copyResolvePaths(cmdCtx, srcRoot, hashParts, CLI.Copy.Closure, jobs)
+	l.Info("Resolved paths to copy", zap.Int("num_paths", len(ninfos)))
+
+	sortedHashParts := make([]string, 0, len(ninfos))
+	for hashPart := range ninfos {
+		sortedHashParts = append(sortedHashParts, hashPart)
+	}
+	sort.Strings(sortedHashParts)
+
+	sem := semaphore.NewWeighted(int64(jobs))
+	wg := new(sync.WaitGroup)
+	resultsMtx := new(sync.Mutex)
+	copied := 0
+	present := 0
+	failed := 0
+	for _, hashPart := range sortedHashParts {
+		if err := sem.Acquire(cmdCtx.ctx, 1); err != nil {
+			l.Warn("Context closed during iteration", zap.String("msg", err.Error()))
+			resultsMtx.Lock()
+			copyErr = errors.Join(copyErr, err)
+			resultsMtx.Unlock()
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer sem.Release(1)
+			l := l.With(zap.String("hash", hashPart))
+
+			didCopy, err := copyPath(cmdCtx.ctx, l, srcRoot, dstRoot, hashPart, ninfos[hashPart], signers)
+			resultsMtx.Lock()
+			defer resultsMtx.Unlock()
+			switch {
+			case err != nil:
+				l.Error("Error while copying path", zap.Error(err))
+				copyErr = errors.Join(copyErr, &ErrCopyPath{HashPart: hashPart}, err)
+				failed++
+			case didCopy:
+				copied++
+			default:
+				present++
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Make sure the destination is usable as a cache
+	dstCacheInfo := dstRoot.Join(NixCacheInfoName)
+	if exists, _ := dstCacheInfo.Exists(); !exists {
+		if exists, _ := srcRoot.Join(NixCacheInfoName).Exists(); exists {
+			l.Debug("Copying the nix cache info file")
+			if err := copyFile(l, srcRoot.Join(NixCacheInfoName), dstCacheInfo); err != nil {
+				l.Warn("Could not copy the nix cache info file", zap.Error(err))
+			}
+		}
+	}
+
+	l.Info("Copied paths", zap.Int("copied", copied), zap.Int("present", present), zap.Int("failed", failed))
+	fmt.Fprintf(cmdCtx.stdOut, "copied:%d present:%d failed:%d\n", copied, present, failed)
+
+	if copyErr != nil {
+		return errors.Join(&ErrCommand{}, copyErr)
+	}
+	return nil
+}
+
+// copyResolvePaths loads the source narinfo files for the given hashes, following references if
+// closure is set. Paths which can't be loaded are returned as errors but don't stop the others.
+func copyResolvePaths(cmdCtx *CmdContext, srcRoot *pathlib.Path, hashParts []string, closure bool, jobs int) (map[string]nixtypes.NarInfo, error) {
+	l := cmdCtx.logger
+	ninfos := map[string]nixtypes.NarInfo{}
+	seen := map[string]struct{}{}
+	resultsMtx := new(sync.Mutex)
+	sem := semaphore.NewWeighted(int64(jobs))
+	var resolveErr error
+
+	nextHashParts := hashParts[:]
+	for len(nextHashParts) > 0 {
+		currentHashParts := nextHashParts
+		nextHashParts = []string{}
+		wg := new(sync.WaitGroup)
+		for _, hashPart := range currentHashParts {
+			if _, found := seen[hashPart]; found {
+				continue
+			}
+			seen[hashPart] = struct{}{}
+
+			if err := sem.Acquire(cmdCtx.ctx, 1); err != nil {
+				wg.Wait()
+				return ninfos, errors.Join(resolveErr, err)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer sem.Release(1)
+				ninfoPath := srcRoot.Join(fmt.Sprintf("%s.narinfo", hashPart))
+				l := l.With(zap.String("path", ninfoPath.String()))
+
+				ninfo, err := loadNarInfo(l, ninfoPath)
+				resultsMtx.Lock()
+				defer resultsMtx.Unlock()
+				if err != nil {
+					l.Error("Could not load narinfo file from source", zap.Error(err))
+					resolveErr = errors.Join(resolveErr, &ErrNinfo{ninfoPath}, err)
+					return
+				}
+				ninfos[hashPart] = ninfo
+
+				if closure {
+					for _, reference := range ninfo.References {
+						referenceHashPart, _, _ := strings.Cut(reference, "-")
+						nextHashParts = append(nextHashParts, referenceHashPart)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	return ninfos, resolveErr
+}
+
+// copyPath copies a single narinfo and its NAR. false is returned if the path was already present
+// in the destination.
+func copyPath(ctx context.Context, l *zap.Logger, srcRoot *pathlib.Path, dstRoot *pathlib.Path, hashPart string,
+	ninfo nixtypes.NarInfo, signers *resigning.Manager) (bool, error) {
+	dstNinfoPath := dstRoot.Join(fmt.Sprintf("%s.narinfo", hashPart))
+	if exists, err := dstNinfoPath.Exists(); err != nil {
+		return false, err
+	} else if exists {
+		l.Debug("Path already present in destination")
+		return false, nil
+	}
+
+	narURL, err := upstream.NarRelPath(ninfo.URL)
+	if err != nil {
+		return false, err
+	}
+	srcNarPath := srcRoot.Join(narURL)
+	dstNarPath := dstRoot.Join(narURL)
+
+	// The NAR is checked against the narinfo both ways, so a corrupt NAR is never signed
+	expectedHash, expectedSize := ninfo.FileHash, ninfo.FileSize
+	if expectedHash.HashName == "" && ninfo.Compression == "none" {
+		expectedHash, expectedSize = ninfo.NarHash, ninfo.NarSize
+	}
+	if expectedHash.HashName != "sha256" {
+		l.Warn("Unsupported hash", zap.String("hash_name", expectedHash.HashName))
+		return false, errors.New("unsupported hash")
+	}
+
+	if err := checkNarFile(dstNarPath, expectedHash, expectedSize); err == nil {
+		l.Debug("NAR file already present in destination", zap.String("nar_path", dstNarPath.String()))
+	} else {
+		if !errors.Is(err, fs.ErrNotExist) {
+			l.Warn("Replacing NAR file in destination which does not match the narinfo", zap.Error(err))
+		}
+		l.Debug("Copying NAR file", zap.String("nar_path", dstNarPath.String()))
+		srcFh, err := srcNarPath.Open()
+		if err != nil {
+			return false, err
+		}
+		defer srcFh.Close()
+		if err := writeFileFrom(l, dstNarPath, newHashVerifyingReader(srcFh, expectedHash, expectedSize)); err != nil {
+			return false, err
+		}
+	}
+
+	if _, err := signers.Resign(ctx, &ninfo); err != nil {
+		return false, err
+	}
+
+	if err := writeNInfo(l, dstNinfoPath, ninfo); err != nil {
+		return false, err
+	}
+	l.Info("Copied path", zap.String("store_path", ninfo.StorePath))
+	return true, nil
+}
+
+// checkNarFile checks a NAR file has the expected sha256 hash, and size if it is non-zero
+func checkNarFile(narPath *pathlib.Path, expectedHash nixtypes.TypedNixHash, expectedSize uint64) error {
+	fh, err := narPath.Open()
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	_, err = io.Copy(io.Discard, newHashVerifyingReader(fh, expectedHash, expectedSize))
+	return err
+}
+
+// hashVerifyingReader returns a narcheck.ErrHashMismatch instead of io.EOF unless everything read
+// had the expected sha256 hash, and size if it is non-zero.
+type hashVerifyingReader struct {
+	rd           io.Reader
+	hasher       hash.Hash
+	nbytes       uint64
+	expectedHash nixtypes.TypedNixHash
+	expectedSize uint64
+}
+
+func newHashVerifyingReader(rd io.Reader, expectedHash nixtypes.TypedNixHash, expectedSize uint64) *hashVerifyingReader {
+	return &hashVerifyingReader{rd: rd, hasher: sha256.New(), expectedHash: expectedHash, expectedSize: expectedSize}
+}
+
+func (h *hashVerifyingReader) Read(p []byte) (int, error) {
+	n, err := h.rd.Read(p)
+	h.hasher.Write(p[:n])
+	h.nbytes += uint64(n)
+	if err != io.EOF {
+		return n, err
+	}
+	obtainedHash := nixtypes.TypedNixHash{HashName: "sha256", Hash: h.hasher.Sum(nil)}
+	switch {
+	case !bytes.Equal(obtainedHash.Hash, h.expectedHash.Hash):
+		return n, &narcheck.ErrHashMismatch{Field: "FileHash", Expected: h.expectedHash.String(), Obtained: obtainedHash.String()}
+	case h.expectedSize != 0 && h.nbytes != h.expectedSize:
+		return n, &narcheck.ErrHashMismatch{Field: "FileSize", Expected: fmt.Sprintf("%d", h.expectedSize), Obtained: fmt.Sprintf("%d", h.nbytes)}
+	}
+	return n, io.EOF
+}
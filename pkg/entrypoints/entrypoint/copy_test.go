@@ -0,0 +1,54 @@
+package entrypoint
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chigopher/pathlib"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+)
+
+// CopySuite checks NARs are verified against their narinfo when copying between caches
+type CopySuite struct {
+	srcRoot *pathlib.Path
+	dstRoot *pathlib.Path
+}
+
+var _ = Suite(&CopySuite{})
+
+func (s *CopySuite) SetUpTest(c *C) {
+	s.srcRoot = pathlib.NewPath("/src", pathlib.PathWithAfero(afero.NewMemMapFs()))
+	s.dstRoot = pathlib.NewPath("/dst", pathlib.PathWithAfero(afero.NewMemMapFs()))
+}
+
+func (s *CopySuite) TestReplacesCorruptDestinationNar(c *C) {
+	narBytes := randomNar(c)
+	ninfo := writeCachePath(c, s.srcRoot, testHashPart, "nar/test.nar", narBytes)
+	// An earlier interrupted copy of the right size
+	c.Assert(s.dstRoot.Join("nar").MkdirAll(), IsNil)
+	c.Assert(s.dstRoot.Join("nar/test.nar").WriteFile(make([]byte, len(narBytes))), IsNil)
+
+	copied, err := copyPath(context.Background(), zap.NewNop(), s.srcRoot, s.dstRoot, testHashPart, ninfo, nil)
+	c.Assert(err, IsNil)
+	c.Check(copied, Equals, true)
+	storedNar, err := s.dstRoot.Join("nar/test.nar").ReadFile()
+	c.Assert(err, IsNil)
+	c.Check(storedNar, DeepEquals, narBytes)
+}
+
+func (s *CopySuite) TestCorruptSourceNar(c *C) {
+	narBytes := randomNar(c)
+	ninfo := writeCachePath(c, s.srcRoot, testHashPart, "nar/test.nar", narBytes)
+	narBytes[0] ^= 0xff
+	c.Assert(s.srcRoot.Join("nar/test.nar").WriteFile(narBytes), IsNil)
+
+	_, err := copyPath(context.Background(), zap.NewNop(), s.srcRoot, s.dstRoot, testHashPart, ninfo, nil)
+	c.Assert(err, ErrorMatches, "FileHash mismatch.*")
+	for _, name := range []string{"nar/test.nar", fmt.Sprintf("%s.narinfo", testHashPart)} {
+		exists, err := s.dstRoot.Join(name).Exists()
+		c.Assert(err, IsNil)
+		c.Check(exists, Equals, false, Commentf("%s should not be written", name))
+	}
+}
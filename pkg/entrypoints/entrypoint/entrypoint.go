@@ -2,21 +2,14 @@ package entrypoint
 
 import (
 	"context"
-	"encoding/csv"
 	"fmt"
-	"net/url"
 	"os/signal"
 	"syscall"
 
 	"github.com/alecthomas/kong"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/chigopher/pathlib"
-	s3 "github.com/fclairamb/afero-s3"
 	"github.com/labstack/gommon/log"
 	"github.com/spf13/afero"
 	"github.com/wrouesnel/kongutil"
-	nix_http_cachefs "github.com/wrouesnel/nix-http-cachefs"
 	"go.uber.org/zap/zapcore"
 
 	"io"
@@ -38,7 +31,8 @@ var CLI struct {
 		Format string `help:"logging format (${enum})" enum:"console,json" default:"console"`
 	} `embed:"" prefix:"log-"`
 
-	FsBackend string `help:"Filesystem backend for the binary cache" enum:"os,s3,nix-http-cache" default:"os"`
+	Store     string `help:"Nix store URI for the binary cache e.g. file:///srv/cache, s3://bucket?region=us-east-1 or https://cache.example.org (overrides --fs-backend and --fs-opts)"`
+	FsBackend string `help:"Filesystem backend for the binary cache (layered only writes and deletes in its write layer, and deleting an object in another layer fails)" enum:"os,s3,nix-http-cache,layered" default:"os"`
 	FsOpts    string `help:"Additional options for the filesystem handler" default:""`
 
 	PrivateKeyFiles []string `help:"Private Key Files" type:"existingfile"`
@@ -47,6 +41,9 @@ var CLI struct {
 	PrivateKeys []string `help:"Private Keys"`
 	PublicKeys  []string `help:"Public Keys"`
 
+	RevokedKeys     []string `help:"Revoked key names, or revoked public keys (<name>:<base64>) - signatures by revoked keys are removed and never trusted"`
+	RevokedKeyFiles []string `help:"Files of revoked key names and public keys, one per line" type:"existingfile"`
+
 	Debug struct {
 		FromBytes struct {
 			Format string `arg:"" help:"Format to output as" enum:"nix32,base64,hex"`
@@ -81,12 +78,17 @@ var CLI struct {
 
 	Bundle       BundleConfig       `cmd:"" help:"Copy a NAR/NARInfo from the nix store"`
 	Sign         SignConfig         `cmd:"" help:"Sign a Nix archive"`
+	Resign       ResignConfig       `cmd:"" help:"Inspect resigning decisions"`
 	Verify       VerifyConfig       `cmd:"" help:"Verify a Nix archive signature"`
 	Validate     ValidateConfig     `cmd:"" help:"Validate a NarInfo file format"`
 	Derivations  DerivationsConfig  `cmd:"" help:"Manipulate derivations"`
 	Realizations RealizationsConfig `cmd:"" help:"Manipulate binary packages"`
 	Proxy        ProxyConfig        `cmd:"" help:"Serve a binary cache with resigning"`
 	Serve ServeConfig `cmd:"" help:"Serve a local nix store"`
+	Reshard      ReshardConfig      `cmd:"" help:"Migrate the NAR files of a binary cache into a sharded layout"`
+	Gc           GcConfig           `cmd:"" help:"Delete orphaned NAR files and dangling narinfo files from a binary cache"`
+	CheckClosure CheckClosureConfig `cmd:"" help:"Check every reference of every narinfo in a binary cache is present"`
+	Copy         CopyConfig         `cmd:"" help:"Copy paths between binary caches with resigning"`
 	NewKey       NewKeyConfig       `cmd:"" help:"Generate a new signing keypair for the current user"`
 }
 
@@ -161,119 +163,18 @@ func Entrypoint(stdIn io.ReadCloser, stdOut io.Writer, stdErr io.Writer) int {
 		stdOut: stdOut,
 	}
 
-	switch CLI.FsBackend {
-	case "os":
-		cmdCtx.fs = afero.NewOsFs()
-		if CLI.FsOpts != "" {
-			logger.Error("--fs-opts has no effect for the OS backend and must be blank")
-			return 1
-		}
-	case "s3":
-		// At debug level, print some logging about what which AWS environment variables are set
-		// since this is *very* annoying to debug.
-		for _, env := range os.Environ() {
-			envname, envvalue, _ := strings.Cut(env, "=")
-			if strings.HasPrefix(envname, "AWS_") {
-				fields := []zap.Field{zap.String("name", envname)}
-				if envname != "AWS_SECRET_ACCESS_KEY" {
-					fields = append(fields, zap.String("value", envvalue))
-				} else {
-					fields = append(fields, zap.String("value", "**OMITTED**"),
-						zap.Bool("ellided_value", true))
-				}
-				if envvalue != "" {
-					logger.Debug("AWS Environment variable is set", fields...)
-				} else {
-					logger.Debug("AWS Environment variable is NOT set", fields...)
-				}
-			}
-		}
-		// In truly frustrating style, endpoint overrides aren't supported till V2,
-		// which this library isn't based on. Hack them in here.
-		endpointUrl := new(string)
-		if os.Getenv("AWS_ENDPOINT_URL") != "" {
-			*endpointUrl = os.Getenv("AWS_ENDPOINT_URL")
-		}
-		if os.Getenv("AWS_ENDPOINT_URL_S3") != "" {
-			*endpointUrl = os.Getenv("AWS_ENDPOINT_URL_S3")
-		}
-		forcePathStyle := new(bool)
-		if endpointUrl != nil {
-			*forcePathStyle = true
-		}
-		sess, err := session.NewSessionWithOptions(session.Options{
-			Config:            aws.Config{Endpoint: endpointUrl, S3ForcePathStyle: forcePathStyle},
-			SharedConfigState: session.SharedConfigEnable,
-		})
-		if err != nil {
-			logger.Error("Error creating S3 session", zap.Error(err))
-			return 1
-		}
-		s3fs := s3.NewFs(CLI.FsOpts, sess)
-		if s3fs == nil {
-			logger.Error("Error initializing the S3 FS")
-			return 1
-		}
-		cmdCtx.fs = s3fs
-	case "nix-http-cache":
-		rdr := csv.NewReader(strings.NewReader(CLI.FsOpts))
-		rdr.LazyQuotes = true
-		rdr.TrimLeadingSpace = true
-		record, err := rdr.Read()
-		if err != nil {
-			logger.Error("Error parsing FS opts", zap.Error(err))
-			return 1
-		}
-		if len(record) == 0 {
-			logger.Error("Must specify at least an URL to an HTTP nix cache server")
-			return 1
-		}
-		cacheUrls := []*url.URL{}
-		urlsFinished := false
-		opts := []nix_http_cachefs.Opt{}
-		for _, field := range record {
-			key, value, ok := strings.Cut(field, "=")
-			if !urlsFinished && !ok {
-				cacheUrl, err := url.Parse(field)
-				if err != nil {
-					logger.Error("Error parsing supplied URL for nix-http-cache type", zap.Error(err))
-					return 1
-				}
-				cacheUrls = append(cacheUrls, cacheUrl)
-				continue
-			} else if !urlsFinished {
-				urlsFinished = true
-			}
-			if !ok {
-				logger.Error("Unparseable field option found", zap.String("field", field))
-				return 1
-			}
-			switch key {
-			case "netrc-file":
-				opts = append(opts, nix_http_cachefs.NetrcFile(value))
-			case "persistent-cache":
-				localCachePath := pathlib.NewPath(value, pathlib.PathWithAfero(afero.NewOsFs()))
-				opts = append(opts, nix_http_cachefs.PersistentCache(localCachePath))
-			default:
-				logger.Error("Unknown field key found", zap.String("field", field))
-				return 1
-			}
-		}
-		opts = append(opts, nix_http_cachefs.ErrorLogger(func(msg string) {
-			logger.Error(msg, zap.String("fs-backend", "nix-http-cache"))
-		}), nix_http_cachefs.DebugLogger(func(msg string) {
-			logger.Debug(msg, zap.String("fs-backend", "nix-http-cache"))
-		}))
-		fs, err := nix_http_cachefs.NewNixHttpCacheFs(cacheUrls, opts...)
-		if err != nil {
-			logger.Error("Bad configuration for nix-cache-httpfs backend", zap.String("filesystem", CLI.FsBackend), zap.Error(err))
-			return 1
-		}
-		cmdCtx.fs = fs
-	default:
-		logger.Error("Invalid filesystem backend", zap.String("filesystem", CLI.FsBackend))
+	var fs afero.Fs
+	if CLI.Store != "" {
+		// Backend specific behaviour (e.g. NormalizeOutputDir) follows the backend the store maps onto
+		fs, CLI.FsBackend, err = newFsFromStore(logger, CLI.Store)
+	} else {
+		fs, err = newFs(logger, CLI.FsBackend, CLI.FsOpts)
+	}
+	if err != nil {
+		logger.Error("Error configuring filesystem backend", zap.String("filesystem", CLI.FsBackend), zap.Error(err))
 		return 1
 	}
+	cmdCtx.fs = fs
 
 	if err := dispatchCommands(ctx, cmdCtx); err != nil {
 		logger.Error("Error from command", zap.Error(err))
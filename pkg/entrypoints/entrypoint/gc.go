@@ -0,0 +1,158 @@
+package entrypoint
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chigopher/pathlib"
+	"github.com/fatih/color"
+	"github.com/spf13/afero"
+	"github.com/wrouesnel/nix-sigman/pkg/upstream"
+	"go.uber.org/zap"
+)
+
+//nolint:gochecknoglobals
+type GcConfig struct {
+	DryRun bool          `help:"Only report what would be deleted"`
+	MinAge time.Duration `help:"Only delete objects older than this so in-flight uploads are left alone" default:"24h"`
+	NarDir string        `help:"Directory under the root NAR files are stored in" default:"nar"`
+	Root   string        `arg:"" help:"Root path of the binary cache"`
+}
+
+// Gc finds NAR files which no narinfo references (orphans, usually from interrupted pushes) and
+// narinfo files whose NAR is missing (dangling), and deletes them once they are older than the
+// minimum age.
+func Gc(cmdCtx *CmdContext) error {
+	l := cmdCtx.logger
+
+	rootDir := pathlib.NewPath(NormalizeOutputDir(CLI.Gc.Root), pathlib.PathWithAfero(cmdCtx.fs)).Clean()
+	narDir := rootDir.Join(CLI.Gc.NarDir).Clean()
+	cutoff := time.Now().Add(-CLI.Gc.MinAge)
+
+	l.Info("Reading narinfo files (this may take a while)", zap.String("root", rootDir.String()))
+	ninfoPaths, err := listNarInfos(rootDir)
+	if err != nil {
+		return errors.Join(&ErrCommand{}, err)
+	}
+
+	var gcErr error
+	deleted := 0
+	kept := 0
+	// If any narinfo can't be read, the NARs it references aren't known so no NAR can safely be
+	// deleted as an orphan.
+	referencesKnown := true
+
+	// collect reports an unreferenced object and deletes it if it is old enough
+	collect := func(objPath *pathlib.Path, kind string, modTime time.Time) {
+		l := l.With(zap.String("path", objPath.String()), zap.String("kind", kind))
+		status := color.RedString("DELETED")
+		switch {
+		case kind == "ORPHAN" && !referencesKnown:
+			status = color.WhiteString("UNSAFE")
+			kept++
+		case modTime.After(cutoff):
+			l.Debug("Object is newer than the minimum age - not deleting", zap.Time("mod_time", modTime))
+			status = color.WhiteString("TOOYOUNG")
+			kept++
+		case CLI.Gc.DryRun:
+			status = color.YellowString("DRYRUN")
+			deleted++
+		default:
+			if err := objPath.Remove(); err != nil {
+				l.Error("Could not delete object", zap.Error(err))
+				gcErr = errors.Join(gcErr, err)
+				status = color.RedString("FAILDEL")
+				kept++
+			} else {
+				l.Info("Deleted object")
+				deleted++
+			}
+		}
+		fmt.Fprintf(cmdCtx.stdOut, "%s:%s:%s\n", color.CyanString(objPath.String()), kind, status)
+	}
+
+	referencedNars := map[string]struct{}{}
+	for _, ninfoPath := range ninfoPaths {
+		if err := cmdCtx.ctx.Err(); err != nil {
+			return errors.Join(&ErrCommand{}, err)
+		}
+		l := l.With(zap.String("path", ninfoPath.String()))
+
+		ninfo, err := loadNarInfo(l, ninfoPath)
+		if err != nil {
+			// Unparseable narinfos are left alone - validate is the tool for those.
+			l.Warn("Could not load narinfo file", zap.Error(err))
+			gcErr = errors.Join(gcErr, &ErrNinfo{Path: ninfoPath}, err)
+			referencesKnown = false
+			continue
+		}
+
+		narRel, err := upstream.NarRelPath(ninfo.URL)
+		if err != nil {
+			l.Warn("Skipping narinfo with a non-relative NAR URL", zap.String("url", ninfo.URL))
+			gcErr = errors.Join(gcErr, &ErrNinfo{Path: ninfoPath}, err)
+			referencesKnown = false
+			continue
+		}
+		narPath := ninfoPath.Parent().Join(narRel).Clean()
+		if !strings.HasPrefix(narPath.String(), narDir.String()+"/") {
+			// Nothing outside the NAR directory is ever collected, so this can't hide a reference
+			// to an orphan - but the narinfo mustn't be acted on either.
+			l.Warn("Skipping narinfo with a NAR URL outside the NAR directory", zap.String("url", ninfo.URL))
+			gcErr = errors.Join(gcErr, &ErrNinfo{Path: ninfoPath}, &upstream.ErrInvalidName{Name: ninfo.URL})
+			continue
+		}
+		referencedNars[narPath.String()] = struct{}{}
+
+		if _, err := narPath.Stat(); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			l.Warn("Could not stat NAR file", zap.Error(err))
+			gcErr = errors.Join(gcErr, err)
+			continue
+		}
+
+		st, err := ninfoPath.Stat()
+		if err != nil {
+			l.Warn("Could not stat narinfo file", zap.Error(err))
+			gcErr = errors.Join(gcErr, err)
+			continue
+		}
+		collect(ninfoPath, "DANGLING", st.ModTime())
+	}
+
+	if !referencesKnown {
+		l.Error("Not every narinfo file could be read - orphaned NAR files will not be deleted")
+	}
+	l.Info("Scanning NAR files (this may take a while)", zap.String("nar_dir", narDir.String()))
+	err = afero.Walk(cmdCtx.fs, narDir.String(), func(walkPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := cmdCtx.ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		narPath := pathlib.NewPath(walkPath, pathlib.PathWithAfero(cmdCtx.fs)).Clean()
+		if _, found := referencedNars[narPath.String()]; found {
+			return nil
+		}
+		collect(narPath, "ORPHAN", info.ModTime())
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		l.Error("Error while scanning NAR files", zap.Error(err))
+		gcErr = errors.Join(gcErr, err)
+	}
+
+	l.Info("Garbage collection finished", zap.Int("deleted", deleted), zap.Int("kept", kept), zap.Bool("dry_run", CLI.Gc.DryRun))
+	if gcErr != nil {
+		return errors.Join(&ErrCommand{}, gcErr)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package entrypoint
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/chigopher/pathlib"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+)
+
+// GcSuite checks only unreferenced objects are deleted
+type GcSuite struct {
+	fs     afero.Fs
+	root   *pathlib.Path
+	stdOut *bytes.Buffer
+}
+
+var _ = Suite(&GcSuite{})
+
+func (s *GcSuite) SetUpTest(c *C) {
+	s.fs = afero.NewMemMapFs()
+	s.root = pathlib.NewPath("/cache", pathlib.PathWithAfero(s.fs))
+	s.stdOut = &bytes.Buffer{}
+	CLI.Gc = GcConfig{NarDir: "nar", Root: "/cache"}
+}
+
+func (s *GcSuite) TearDownTest(c *C) {
+	CLI.Gc = GcConfig{}
+}
+
+func (s *GcSuite) cmdCtx() *CmdContext {
+	return &CmdContext{logger: zap.NewNop(), ctx: context.Background(), stdOut: s.stdOut, fs: s.fs}
+}
+
+func (s *GcSuite) exists(c *C, name string) bool {
+	exists, err := s.root.Join(name).Exists()
+	c.Assert(err, IsNil)
+	return exists
+}
+
+func (s *GcSuite) TestDeletesOrphans(c *C) {
+	writeCachePath(c, s.root, testHashPart, "nar/live.nar", randomNar(c))
+	c.Assert(s.root.Join("nar/orphan.nar").WriteFile(randomNar(c)), IsNil)
+
+	c.Assert(Gc(s.cmdCtx()), IsNil)
+	c.Check(s.exists(c, "nar/live.nar"), Equals, true)
+	c.Check(s.exists(c, "nar/orphan.nar"), Equals, false)
+}
+
+func (s *GcSuite) TestUnreadableNarInfoKeepsNars(c *C) {
+	writeCachePath(c, s.root, testHashPart, "nar/live.nar", randomNar(c))
+	// The NAR of a narinfo which can't be read looks just like an orphan
+	c.Assert(s.root.Join("nar/unknown.nar").WriteFile(randomNar(c)), IsNil)
+	c.Assert(s.root.Join("1b8m1dp0ln4rlvkbi7zyb5yvvfzwhbsm.narinfo").WriteFile([]byte("not a narinfo")), IsNil)
+
+	c.Check(Gc(s.cmdCtx()), NotNil)
+	c.Check(s.exists(c, "nar/live.nar"), Equals, true)
+	c.Check(s.exists(c, "nar/unknown.nar"), Equals, true)
+	c.Check(s.stdOut.String(), Matches, "(?s).*nar/unknown.nar:ORPHAN:.*UNSAFE.*")
+}
+
+func (s *GcSuite) TestNarURLOutsideNarDir(c *C) {
+	c.Assert(s.root.Join("secret").WriteFile([]byte("not a NAR")), IsNil)
+	writeCachePath(c, s.root, testHashPart, "../outside.nar", nil)
+	writeCachePath(c, s.root, "1b8m1dp0ln4rlvkbi7zyb5yvvfzwhbsm", "nar/../secret", nil)
+
+	c.Check(Gc(s.cmdCtx()), NotNil)
+	// Neither narinfo is treated as dangling, and nothing outside nar/ is touched
+	c.Check(s.exists(c, testHashPart+".narinfo"), Equals, true)
+	c.Check(s.exists(c, "1b8m1dp0ln4rlvkbi7zyb5yvvfzwhbsm.narinfo"), Equals, true)
+	c.Check(s.exists(c, "secret"), Equals, true)
+}
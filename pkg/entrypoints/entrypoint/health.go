@@ -0,0 +1,186 @@
+package entrypoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/chigopher/pathlib"
+	"github.com/wrouesnel/nix-sigman/pkg/resigning"
+	"go.withmatt.com/httpheaders"
+)
+
+// HealthConfig configures the readiness checks of the HTTP server commands
+type HealthConfig struct {
+	ReadinessCacheTime time.Duration `help:"How long readiness results are cached, so frequent probes don't load the backend" default:"10s"`
+	ReadinessTimeout   time.Duration `help:"Timeout for each readiness check" default:"5s"`
+}
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+const (
+	checkStatusOk     = "ok"
+	checkStatusFailed = "failed"
+)
+
+type ErrNotReady struct {
+	Reason string
+}
+
+func (e ErrNotReady) Error() string {
+	return fmt.Sprintf("not ready: %s", e.Reason)
+}
+
+// readinessCheck is a named check which must pass for a server to be ready
+type readinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// checkResult is the outcome of one readiness check
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// readinessReport is the JSON response of the readiness endpoint
+type readinessReport struct {
+	Status    string                 `json:"status"`
+	CheckedAt time.Time              `json:"checked_at"`
+	Checks    map[string]checkResult `json:"checks"`
+}
+
+// readiness runs readiness checks and caches the result
+type readiness struct {
+	checks    []readinessCheck
+	config    HealthConfig
+	mtx       sync.Mutex
+	report    *readinessReport
+	checkedAt time.Time
+}
+
+func newReadiness(config HealthConfig, checks ...readinessCheck) *readiness {
+	return &readiness{checks: checks, config: config}
+}
+
+// Report returns the cached readiness report, running the checks again if it has expired.
+// Concurrent callers wait for a single run of the checks.
+func (r *readiness) Report(ctx context.Context) readinessReport {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.report != nil && time.Since(r.checkedAt) < r.config.ReadinessCacheTime {
+		return *r.report
+	}
+
+	report := readinessReport{Status: checkStatusOk, CheckedAt: time.Now(), Checks: map[string]checkResult{}}
+	for _, check := range r.checks {
+		checkCtx, cancel := ctx, context.CancelFunc(func() {})
+		if r.config.ReadinessTimeout > 0 {
+			checkCtx, cancel = context.WithTimeout(ctx, r.config.ReadinessTimeout)
+		}
+		err := check.Check(checkCtx)
+		cancel()
+		if err != nil {
+			report.Status = checkStatusFailed
+			report.Checks[check.Name] = checkResult{Status: checkStatusFailed, Error: err.Error()}
+		} else {
+			report.Checks[check.Name] = checkResult{Status: checkStatusOk}
+		}
+	}
+	r.report = &report
+	r.checkedAt = report.CheckedAt
+	return report
+}
+
+// writeJSON writes a JSON response body
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, body interface{}) {
+	content, err := json.Marshal(body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(httpheaders.ContentType, "application/json")
+	w.Header().Set(httpheaders.CacheControl, "no-store")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(content)
+	}
+}
+
+// withHealthEndpoints serves /healthz and /readyz ahead of a handler which would otherwise take
+// every path. /healthz only reports that the server is running, and never touches the backend.
+func withHealthEndpoints(ready *readiness, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case healthzPath:
+			writeJSON(w, r, http.StatusOK, map[string]string{"status": checkStatusOk})
+		case readyzPath:
+			report := ready.Report(r.Context())
+			status := http.StatusOK
+			if report.Status != checkStatusOk {
+				status = http.StatusServiceUnavailable
+			}
+			writeJSON(w, r, status, report)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// keysCheck fails if keys are configured but none are loaded
+func keysCheck(keys *signingReloader) readinessCheck {
+	return readinessCheck{Name: "keys", Check: func(ctx context.Context) error {
+		privateKeys, publicKeys := keys.Keys()
+		if len(CLI.PrivateKeyFiles)+len(CLI.PrivateKeys) > 0 && len(privateKeys) == 0 {
+			return &ErrNotReady{Reason: "private keys are configured but none are loaded"}
+		}
+		if len(CLI.PublicKeyFiles)+len(CLI.PublicKeys) > 0 && len(publicKeys) == 0 {
+			return &ErrNotReady{Reason: "public keys are configured but none are loaded"}
+		}
+		return nil
+	}}
+}
+
+// signingMapCheck fails if a signing map is configured but no resigners were built from it
+func signingMapCheck(name string, config *resigning.ResigningConfig, signers *resigning.Manager) readinessCheck {
+	return readinessCheck{Name: name, Check: func(ctx context.Context) error {
+		if config.HasSigningRules() && len(signers.Rules()) == 0 {
+			return &ErrNotReady{Reason: "a signing map is configured but is empty"}
+		}
+		return nil
+	}}
+}
+
+// backendCheck stats a path on the storage backend. A missing file is fine - it only has to
+// respond.
+func backendCheck(probePath *pathlib.Path) readinessCheck {
+	return readinessCheck{Name: "backend", Check: func(ctx context.Context) error {
+		// Backends don't take a context, so the stat is abandoned if it runs past the deadline
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := probePath.Stat()
+			errCh <- err
+		}()
+		select {
+		case err := <-errCh:
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}}
+}
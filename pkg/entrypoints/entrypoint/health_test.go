@@ -0,0 +1,111 @@
+package entrypoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+)
+
+// HealthSuite checks the liveness and readiness endpoints
+type HealthSuite struct{}
+
+var _ = Suite(&HealthSuite{})
+
+// brokenStatFs fails every Stat, like an unreachable remote backend
+type brokenStatFs struct {
+	afero.Fs
+}
+
+func (b brokenStatFs) Stat(name string) (os.FileInfo, error) {
+	return nil, errors.New("backend unreachable")
+}
+
+func (s *HealthSuite) serve(c *C, handler http.Handler, path string) (int, readinessReport) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	c.Check(rec.Header().Get("Content-Type"), Equals, "application/json")
+	report := readinessReport{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &report), IsNil)
+	return rec.Code, report
+}
+
+func (s *HealthSuite) proxyHandler(c *C, proxyFs afero.Fs) http.Handler {
+	CLI.Proxy = ProxyConfig{NarDir: "nar", Root: "/cache"}
+	handler, _, err := newProxyHandler(&CmdContext{
+		logger: zap.NewNop(),
+		ctx:    context.Background(),
+		fs:     proxyFs,
+	})
+	c.Assert(err, IsNil)
+	return handler
+}
+
+func (s *HealthSuite) TearDownTest(c *C) {
+	CLI.Proxy = ProxyConfig{}
+}
+
+func (s *HealthSuite) TestProxyReady(c *C) {
+	handler := s.proxyHandler(c, afero.NewMemMapFs())
+
+	status, report := s.serve(c, handler, healthzPath)
+	c.Check(status, Equals, http.StatusOK)
+	c.Check(report.Status, Equals, checkStatusOk)
+
+	status, report = s.serve(c, handler, readyzPath)
+	c.Check(status, Equals, http.StatusOK)
+	c.Check(report.Status, Equals, checkStatusOk)
+	c.Check(report.Checks["backend"], Equals, checkResult{Status: checkStatusOk})
+	c.Check(report.Checks["keys"], Equals, checkResult{Status: checkStatusOk})
+}
+
+func (s *HealthSuite) TestProxyBackendFailure(c *C) {
+	handler := s.proxyHandler(c, brokenStatFs{afero.NewMemMapFs()})
+
+	status, _ := s.serve(c, handler, healthzPath)
+	c.Check(status, Equals, http.StatusOK)
+
+	status, report := s.serve(c, handler, readyzPath)
+	c.Check(status, Equals, http.StatusServiceUnavailable)
+	c.Check(report.Status, Equals, checkStatusFailed)
+	c.Check(report.Checks["backend"], Equals, checkResult{Status: checkStatusFailed, Error: "backend unreachable"})
+	c.Check(report.Checks["signing_map"].Status, Equals, checkStatusOk)
+}
+
+func (s *HealthSuite) TestReadinessCached(c *C) {
+	runs := 0
+	ready := newReadiness(HealthConfig{ReadinessCacheTime: time.Hour, ReadinessTimeout: time.Second},
+		readinessCheck{Name: "counter", Check: func(ctx context.Context) error {
+			runs++
+			_, hasDeadline := ctx.Deadline()
+			c.Check(hasDeadline, Equals, true)
+			return nil
+		}})
+
+	first := ready.Report(context.Background())
+	second := ready.Report(context.Background())
+	c.Check(runs, Equals, 1)
+	c.Check(second.CheckedAt, Equals, first.CheckedAt)
+
+	ready.config.ReadinessCacheTime = 0
+	ready.Report(context.Background())
+	c.Check(runs, Equals, 2)
+}
+
+func (s *HealthSuite) TestCheckTimeout(c *C) {
+	ready := newReadiness(HealthConfig{ReadinessTimeout: 10 * time.Millisecond},
+		readinessCheck{Name: "slow", Check: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}})
+	report := ready.Report(context.Background())
+	c.Check(report.Status, Equals, checkStatusFailed)
+	c.Check(report.Checks["slow"].Error, Equals, context.DeadlineExceeded.Error())
+}
@@ -0,0 +1,138 @@
+package entrypoint
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"testing/iotest"
+
+	"github.com/chigopher/pathlib"
+	"github.com/spf13/afero"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+// HttpCacheSuite writes to an in-process proxy through the nix-http-cache backend
+type HttpCacheSuite struct {
+	proxyFs afero.Fs
+	server  *httptest.Server
+}
+
+var _ = Suite(&HttpCacheSuite{})
+
+const testHashPart = "58br4vk3q5akf4g8lx0pqzfhn47k3j8d"
+
+func (s *HttpCacheSuite) SetUpTest(c *C) {
+	s.proxyFs = afero.NewMemMapFs()
+	c.Assert(s.proxyFs.MkdirAll("/cache", 0o755), IsNil)
+
+	CLI.Proxy = ProxyConfig{AllowPush: true, NarDir: "nar", Root: "/cache"}
+	handler, _, err := newProxyHandler(&CmdContext{
+		logger: zap.NewNop(),
+		ctx:    context.Background(),
+		fs:     s.proxyFs,
+	})
+	c.Assert(err, IsNil)
+	s.server = httptest.NewServer(handler)
+}
+
+func (s *HttpCacheSuite) TearDownTest(c *C) {
+	s.server.Close()
+	CLI.Proxy = ProxyConfig{}
+}
+
+// backendRoot returns the root of the proxied cache as seen through the nix-http-cache backend
+func (s *HttpCacheSuite) backendRoot(c *C) *pathlib.Path {
+	fs, err := newFs(zap.NewNop(), "nix-http-cache", s.server.URL)
+	c.Assert(err, IsNil)
+	return pathlib.NewPath("/", pathlib.PathWithAfero(fs))
+}
+
+// writePath writes a random NAR and its narinfo through the nix-http-cache backend
+func (s *HttpCacheSuite) writePath(c *C, storeName string) ([]byte, nixtypes.NarInfo, error) {
+	root := s.backendRoot(c)
+
+	narBytes := make([]byte, 4096)
+	_, err := rand.Read(narBytes)
+	c.Assert(err, IsNil)
+	narHash := sha256.Sum256(narBytes)
+	typedHash := nixtypes.TypedNixHash{HashName: "sha256", Hash: narHash[:]}
+	ninfo := nixtypes.NarInfo{
+		StorePath:   fmt.Sprintf("/nix/store/%s-%s", testHashPart, storeName),
+		URL:         fmt.Sprintf("nar/%s.nar", typedHash.Hash.String()),
+		Compression: "none",
+		FileHash:    typedHash,
+		FileSize:    uint64(len(narBytes)),
+		NarHash:     typedHash,
+		NarSize:     uint64(len(narBytes)),
+		References:  []string{},
+		Extra:       map[string]string{},
+	}
+
+	narPath := root.Join(ninfo.URL)
+	c.Assert(narPath.Parent().MkdirAll(), IsNil)
+	if err := narPath.WriteFile(narBytes); err != nil {
+		return narBytes, ninfo, err
+	}
+	return narBytes, ninfo, writeNInfo(zap.NewNop(), root.Join(fmt.Sprintf("%s.narinfo", testHashPart)), ninfo)
+}
+
+func (s *HttpCacheSuite) TestWriteThroughProxy(c *C) {
+	narBytes, ninfo, err := s.writePath(c, "test")
+	c.Assert(err, IsNil)
+
+	storedNar, err := afero.ReadFile(s.proxyFs, "/cache/"+ninfo.URL)
+	c.Assert(err, IsNil)
+	c.Check(storedNar, DeepEquals, narBytes)
+
+	cacheRoot := pathlib.NewPath("/cache", pathlib.PathWithAfero(s.proxyFs))
+	storedNinfo, err := loadNarInfo(zap.NewNop(), cacheRoot.Join(fmt.Sprintf("%s.narinfo", testHashPart)))
+	c.Assert(err, IsNil)
+	c.Check(storedNinfo.StorePath, Equals, ninfo.StorePath)
+	c.Check(storedNinfo.URL, Equals, ninfo.URL)
+	c.Check(storedNinfo.NarHash.String(), Equals, ninfo.NarHash.String())
+}
+
+func (s *HttpCacheSuite) TestRejectedWriteFails(c *C) {
+	root := s.backendRoot(c)
+	narPath := root.Join("nar", "existing.nar")
+	c.Assert(narPath.WriteFile([]byte("first")), IsNil)
+	// The proxy won't overwrite an existing file
+	c.Assert(narPath.WriteFile([]byte("second")), NotNil)
+
+	storedNar, err := afero.ReadFile(s.proxyFs, "/cache/nar/existing.nar")
+	c.Assert(err, IsNil)
+	c.Check(string(storedNar), Equals, "first")
+}
+
+func (s *HttpCacheSuite) TestConflictingNarInfoFails(c *C) {
+	_, _, err := s.writePath(c, "first")
+	c.Assert(err, IsNil)
+	_, _, err = s.writePath(c, "second")
+	c.Assert(err, NotNil)
+
+	cacheRoot := pathlib.NewPath("/cache", pathlib.PathWithAfero(s.proxyFs))
+	storedNinfo, err := loadNarInfo(zap.NewNop(), cacheRoot.Join(fmt.Sprintf("%s.narinfo", testHashPart)))
+	c.Assert(err, IsNil)
+	c.Check(storedNinfo.StorePath, Equals, fmt.Sprintf("/nix/store/%s-first", testHashPart))
+}
+
+func (s *HttpCacheSuite) TestInterruptedWriteIsNotPublished(c *C) {
+	root := s.backendRoot(c)
+	rd := io.MultiReader(bytes.NewReader(make([]byte, 4096)), iotest.ErrReader(errors.New("source went away")))
+	c.Assert(writeFileFrom(zap.NewNop(), root.Join("nar", "partial.nar"), rd), NotNil)
+
+	exists, err := afero.Exists(s.proxyFs, "/cache/nar/partial.nar")
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, false)
+}
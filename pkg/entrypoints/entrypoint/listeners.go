@@ -0,0 +1,331 @@
+package entrypoint
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/wrouesnel/multihttp"
+	"go.uber.org/zap"
+)
+
+// TLSConfig configures TLS for the listeners of the HTTP server commands
+type TLSConfig struct {
+	TLSCert     string `help:"TLS certificate file (enables TLS on all listeners, reloaded on SIGHUP)"`
+	TLSKey      string `help:"TLS private key file"`
+	TLSClientCA string `help:"CA certificate file client certificates must be signed by (enables mutual TLS)"`
+}
+
+type ErrInvalidListenAddress struct {
+	Address string
+}
+
+func (e ErrInvalidListenAddress) Error() string {
+	return fmt.Sprintf("invalid listen address: %s", e.Address)
+}
+
+type ErrInvalidTLSConfig struct {
+	Reason string
+}
+
+func (e ErrInvalidTLSConfig) Error() string {
+	return fmt.Sprintf("invalid TLS configuration: %s", e.Reason)
+}
+
+// listen opens a listener for an address such as tcp://127.0.0.1:8080 or unix:///run/nix-sigman.sock
+func listen(address string) (net.Listener, error) {
+	network, addr, err := multihttp.ParseAddress(address)
+	if err != nil {
+		return nil, errors.Join(&ErrInvalidListenAddress{Address: address}, err)
+	}
+	return net.Listen(network, addr)
+}
+
+// certReloader holds the current TLS certificate and client CAs, which can be reloaded from disk
+// without restarting the listeners. New connections use whatever was last loaded successfully.
+type certReloader struct {
+	config TLSConfig
+	mtx    sync.RWMutex
+	cert   *tls.Certificate
+	// clientCAs is nil unless mutual TLS is enabled
+	clientCAs *x509.CertPool
+}
+
+func newCertReloader(config TLSConfig) (*certReloader, error) {
+	if config.TLSCert == "" || config.TLSKey == "" {
+		return nil, &ErrInvalidTLSConfig{Reason: "both a certificate and key must be specified"}
+	}
+	reloader := &certReloader{config: config}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// reload loads the certificate, key and client CA files. On error the previous ones are kept.
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.config.TLSCert, c.config.TLSKey)
+	if err != nil {
+		return errors.Join(&ErrInvalidTLSConfig{Reason: "could not load certificate and key"}, err)
+	}
+
+	var clientCAs *x509.CertPool
+	if c.config.TLSClientCA != "" {
+		caBytes, err := os.ReadFile(c.config.TLSClientCA)
+		if err != nil {
+			return errors.Join(&ErrInvalidTLSConfig{Reason: "could not read client CA file"}, err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caBytes) {
+			return &ErrInvalidTLSConfig{Reason: "no certificates found in client CA file"}
+		}
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.cert = &cert
+	c.clientCAs = clientCAs
+	return nil
+}
+
+// tlsConfig returns a TLS config for listeners which always uses the latest certificates
+func (c *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mtx.RLock()
+			defer c.mtx.RUnlock()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c.cert},
+				NextProtos:   []string{"http/1.1"},
+			}
+			if c.clientCAs != nil {
+				config.ClientCAs = c.clientCAs
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
+
+// ShutdownConfig configures how the HTTP server commands shut down
+type ShutdownConfig struct {
+	DrainTimeout time.Duration `help:"How long to wait for in-flight requests to finish on shutdown before aborting them" default:"30s"`
+}
+
+// abortCleanupTimeout is how long aborted requests get to clean up (e.g. remove partially pushed
+// files) before the server exits anyway.
+const abortCleanupTimeout = 10 * time.Second
+
+type serverContextKey struct{}
+
+// serverContext returns a context for work done on behalf of a request which should outlive the
+// client (such as filling the cache from upstream), but not the server. It is only cancelled
+// when in-flight requests are aborted at the end of the shutdown drain. fallback is used outside
+// of listenAndServe.
+func serverContext(r *http.Request, fallback context.Context) context.Context {
+	if ctx, ok := r.Context().Value(serverContextKey{}).(context.Context); ok {
+		return ctx
+	}
+	return fallback
+}
+
+// httpEndpoint is a handler served on a set of listen addresses
+type httpEndpoint struct {
+	Name    string
+	Listen  []string
+	TLS     TLSConfig
+	Handler http.Handler
+	// Reload is called on SIGHUP, if set
+	Reload func()
+}
+
+// listenAndServe serves the endpoints until the command context is cancelled or a listener
+// fails. TLS certificates are reloaded, and endpoint Reload functions called, on SIGHUP.
+//
+// When the command context is cancelled the listeners are closed and in-flight requests get
+// config.DrainTimeout to finish. After that, the requests still running are aborted by closing
+// their connections, which fails any push still being received so it cleans up after itself.
+func listenAndServe(cmdCtx *CmdContext, config ShutdownConfig, endpoints ...httpEndpoint) error {
+	l := cmdCtx.logger
+
+	// abortCtx outlives the command context so requests can finish while draining
+	abortCtx, abort := context.WithCancel(context.WithoutCancel(cmdCtx.ctx))
+	defer abort()
+	inFlight := &sync.WaitGroup{}
+
+	servers := []*http.Server{}
+	reloaders := []*certReloader{}
+	reloads := []func(){}
+	listeners := []net.Listener{}
+	closeListeners := func() {
+		for _, listener := range listeners {
+			if err := listener.Close(); err != nil {
+				l.Warn("Error closing listener during shutdown", zap.Error(err))
+			}
+		}
+	}
+	closeServers := func() error {
+		var closeErr error
+		for _, server := range servers {
+			closeErr = errors.Join(closeErr, server.Close())
+		}
+		return closeErr
+	}
+
+	errCh := make(chan error, 1)
+	startServing := []func(){}
+	for _, endpoint := range endpoints {
+		l := l.With(zap.String("endpoint", endpoint.Name))
+		tlsConfig := endpoint.TLS
+
+		var reloader *certReloader
+		if tlsConfig.TLSCert != "" || tlsConfig.TLSKey != "" || tlsConfig.TLSClientCA != "" {
+			var err error
+			reloader, err = newCertReloader(tlsConfig)
+			if err != nil {
+				l.Error("Error loading TLS certificates", zap.Error(err))
+				closeListeners()
+				return errors.Join(&ErrCommand{}, err)
+			}
+			l.Info("TLS enabled", zap.Bool("mutual_tls", tlsConfig.TLSClientCA != ""))
+			reloaders = append(reloaders, reloader)
+		}
+
+		endpointListeners := []net.Listener{}
+		for _, address := range endpoint.Listen {
+			listener, err := listen(address)
+			if err != nil {
+				l.Error("Error setting up listener", zap.String("address", address), zap.Error(err))
+				closeListeners()
+				return errors.Join(&ErrCommand{}, err)
+			}
+			if reloader != nil {
+				listener = tls.NewListener(listener, reloader.tlsConfig())
+			}
+			l.Info("Listening", zap.String("addr", listener.Addr().String()), zap.Bool("tls", reloader != nil))
+			listeners = append(listeners, listener)
+			endpointListeners = append(endpointListeners, listener)
+		}
+
+		if endpoint.Reload != nil {
+			reloads = append(reloads, endpoint.Reload)
+		}
+
+		handler := endpoint.Handler
+		server := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				inFlight.Add(1)
+				defer inFlight.Done()
+				handler.ServeHTTP(w, r)
+			}),
+			ErrorLog: zap.NewStdLog(l.Named("http")),
+			BaseContext: func(net.Listener) context.Context {
+				return context.WithValue(abortCtx, serverContextKey{}, abortCtx)
+			},
+		}
+		servers = append(servers, server)
+		for _, listener := range endpointListeners {
+			// Serving only starts once every listener is set up
+			startServing = append(startServing, func() {
+				if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					l.Error("Error from listener", zap.Error(err), zap.String("listener_addr", listener.Addr().String()))
+					select {
+					case errCh <- err:
+					default:
+					}
+				}
+			})
+		}
+	}
+	for _, serve := range startServing {
+		go serve()
+	}
+
+	sighupCh := make(chan os.Signal, 1)
+	signal.Notify(sighupCh, syscall.SIGHUP)
+	defer signal.Stop(sighupCh)
+
+	for {
+		select {
+		case <-cmdCtx.ctx.Done():
+			l.Info("Shutting down HTTP server - draining in-flight requests", zap.Duration("drain_timeout", config.DrainTimeout))
+			if drainServers(servers, config.DrainTimeout) {
+				l.Info("All in-flight requests finished")
+				return nil
+			}
+
+			l.Warn("Drain timeout exceeded - aborting in-flight requests")
+			abort()
+			if err := closeServers(); err != nil {
+				l.Warn("Error closing HTTP servers", zap.Error(err))
+			}
+			if !waitTimeout(inFlight, abortCleanupTimeout) {
+				l.Warn("Aborted requests did not finish cleaning up before exit")
+			}
+			return nil
+		case err := <-errCh:
+			// On the first listener error, shut everything down
+			_ = closeServers()
+			return errors.Join(&ErrCommand{}, err)
+		case <-sighupCh:
+			for _, reloader := range reloaders {
+				if err := reloader.reload(); err != nil {
+					l.Error("Error reloading TLS certificates - keeping the current ones", zap.Error(err))
+				} else {
+					l.Info("Reloaded TLS certificates")
+				}
+			}
+			for _, reload := range reloads {
+				reload()
+			}
+		}
+	}
+}
+
+// drainServers gracefully shuts down the servers, and reports if they all finished their
+// in-flight requests before the drain timeout.
+func drainServers(servers []*http.Server, drainTimeout time.Duration) bool {
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	drained := true
+	mtx := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, server := range servers {
+		wg.Go(func() {
+			if err := server.Shutdown(drainCtx); err != nil {
+				mtx.Lock()
+				drained = false
+				mtx.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	return drained
+}
+
+// waitTimeout waits for a WaitGroup, and reports if it finished before the timeout
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,266 @@
+package entrypoint
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+)
+
+// ListenersSuite checks TLS and mutual TLS listeners and certificate reloading
+type ListenersSuite struct {
+	dir      string
+	ca       *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+	listener net.Listener
+	server   *http.Server
+	reloader *certReloader
+}
+
+var _ = Suite(&ListenersSuite{})
+
+// issue creates a certificate signed by the suite CA (or self-signed if the CA is nil)
+func (s *ListenersSuite) issue(c *C, commonName string, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, parentKey := template, key
+	if s.ca != nil {
+		parent, parentKey = s.ca, s.caKey
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	c.Assert(err, IsNil)
+	cert, err := x509.ParseCertificate(certDer)
+	c.Assert(err, IsNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func (s *ListenersSuite) writeServerCert(c *C, commonName string) {
+	_, _, certPem, keyPem := s.issue(c, commonName, false)
+	c.Assert(os.WriteFile(filepath.Join(s.dir, "server.crt"), certPem, 0o600), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(s.dir, "server.key"), keyPem, 0o600), IsNil)
+}
+
+func (s *ListenersSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.ca = nil
+	var caPem []byte
+	s.ca, s.caKey, caPem, _ = s.issue(c, "test-ca", true)
+	c.Assert(os.WriteFile(filepath.Join(s.dir, "ca.crt"), caPem, 0o600), IsNil)
+	s.writeServerCert(c, "server-1")
+
+	var err error
+	s.reloader, err = newCertReloader(TLSConfig{
+		TLSCert:     filepath.Join(s.dir, "server.crt"),
+		TLSKey:      filepath.Join(s.dir, "server.key"),
+		TLSClientCA: filepath.Join(s.dir, "ca.crt"),
+	})
+	c.Assert(err, IsNil)
+
+	s.listener, err = listen("tcp://127.0.0.1:0")
+	c.Assert(err, IsNil)
+	s.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})}
+	go s.server.Serve(tls.NewListener(s.listener, s.reloader.tlsConfig()))
+}
+
+func (s *ListenersSuite) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+// connect makes a request with the given client certificate and returns the server certificate
+func (s *ListenersSuite) connect(c *C, clientCerts []tls.Certificate) (*x509.Certificate, error) {
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(s.ca)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: rootCAs, Certificates: clientCerts},
+		DisableKeepAlives: true,
+	}}
+	resp, err := client.Get("https://" + s.listener.Addr().String() + "/")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	return resp.TLS.PeerCertificates[0], nil
+}
+
+func (s *ListenersSuite) clientCert(c *C) []tls.Certificate {
+	_, _, certPem, keyPem := s.issue(c, "client", false)
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	c.Assert(err, IsNil)
+	return []tls.Certificate{cert}
+}
+
+func (s *ListenersSuite) TestMutualTLS(c *C) {
+	serverCert, err := s.connect(c, s.clientCert(c))
+	c.Assert(err, IsNil)
+	c.Check(serverCert.Subject.CommonName, Equals, "server-1")
+
+	_, err = s.connect(c, nil)
+	c.Check(err, NotNil)
+}
+
+func (s *ListenersSuite) TestReload(c *C) {
+	clientCerts := s.clientCert(c)
+	s.writeServerCert(c, "server-2")
+	serverCert, err := s.connect(c, clientCerts)
+	c.Assert(err, IsNil)
+	c.Check(serverCert.Subject.CommonName, Equals, "server-1")
+
+	c.Assert(s.reloader.reload(), IsNil)
+	serverCert, err = s.connect(c, clientCerts)
+	c.Assert(err, IsNil)
+	c.Check(serverCert.Subject.CommonName, Equals, "server-2")
+
+	// A bad reload keeps the current certificate
+	c.Assert(os.WriteFile(filepath.Join(s.dir, "server.key"), []byte("garbage"), 0o600), IsNil)
+	c.Check(s.reloader.reload(), NotNil)
+	serverCert, err = s.connect(c, clientCerts)
+	c.Assert(err, IsNil)
+	c.Check(serverCert.Subject.CommonName, Equals, "server-2")
+}
+
+func (s *ListenersSuite) TestInvalidListenAddress(c *C) {
+	_, err := listen("udp://127.0.0.1:0")
+	c.Check(err, NotNil)
+}
+
+// ShutdownSuite checks in-flight requests are drained, and aborted pushes are cleaned up
+type ShutdownSuite struct {
+	socket string
+	client *http.Client
+}
+
+var _ = Suite(&ShutdownSuite{})
+
+func (s *ShutdownSuite) SetUpTest(c *C) {
+	s.socket = filepath.Join(c.MkDir(), "http.sock")
+	s.client = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", s.socket)
+		},
+	}}
+}
+
+func (s *ShutdownSuite) TearDownTest(c *C) {
+	CLI.Proxy = ProxyConfig{}
+}
+
+// serve runs listenAndServe in the background until the returned cancel function is called
+func (s *ShutdownSuite) serve(c *C, drainTimeout time.Duration, handler http.Handler) (context.CancelFunc, chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- listenAndServe(&CmdContext{logger: zap.NewNop(), ctx: ctx}, ShutdownConfig{DrainTimeout: drainTimeout},
+			httpEndpoint{Name: "test", Listen: []string{"unix://" + s.socket}, Handler: handler})
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(s.socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cancel, result
+}
+
+func (s *ShutdownSuite) TestDrainsInFlightRequests(c *C) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cancel, result := s.serve(c, time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}))
+
+	respCh := make(chan string, 1)
+	go func() {
+		resp, err := s.client.Get("http://unix/slow")
+		c.Check(err, IsNil)
+		if err != nil {
+			respCh <- ""
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		respCh <- string(body)
+	}()
+	<-started
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-result:
+		c.Fatalf("server exited before draining: %v", err)
+	default:
+	}
+
+	close(release)
+	c.Check(<-respCh, Equals, "done")
+	c.Check(<-result, IsNil)
+}
+
+func (s *ShutdownSuite) TestAbortsPushAtDrainTimeout(c *C) {
+	proxyFs := afero.NewMemMapFs()
+	CLI.Proxy = ProxyConfig{AllowPush: true, NarDir: "nar", Root: "/cache"}
+	handler, _, err := newProxyHandler(&CmdContext{logger: zap.NewNop(), ctx: context.Background(), fs: proxyFs})
+	c.Assert(err, IsNil)
+	cancel, result := s.serve(c, 50*time.Millisecond, handler)
+
+	// Send part of a NAR and then stall
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		req, err := http.NewRequest(http.MethodPut, "http://unix/nar/partial.nar", pr)
+		c.Check(err, IsNil)
+		req.ContentLength = 1024
+		if resp, err := s.client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	_, err = pw.Write(make([]byte, 512))
+	c.Assert(err, IsNil)
+	exists := false
+	for i := 0; i < 100 && !exists; i++ {
+		time.Sleep(10 * time.Millisecond)
+		exists, _ = afero.Exists(proxyFs, "/cache/nar/partial.nar")
+	}
+	c.Assert(exists, Equals, true)
+
+	cancel()
+	c.Check(<-result, IsNil)
+	exists, err = afero.Exists(proxyFs, "/cache/nar/partial.nar")
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, false)
+}
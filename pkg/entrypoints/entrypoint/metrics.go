@@ -0,0 +1,205 @@
+package entrypoint
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/samber/lo"
+	"github.com/wrouesnel/nix-sigman/pkg/resigning"
+)
+
+// MetricsConfig configures where the Prometheus metrics of the HTTP server commands are served
+type MetricsConfig struct {
+	MetricsListen []string `help:"Serve /metrics on these listen addresses instead of the main listeners"`
+}
+
+const metricsPath = "/metrics"
+
+// Resign outcomes
+const (
+	resignSigned  = "signed"
+	resignNoMatch = "no_match"
+	resignError   = "error"
+)
+
+// Push results
+const (
+	pushAccepted = "accepted"
+	pushRejected = "rejected"
+)
+
+//nolint:gochecknoglobals
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nix_sigman",
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by handler, method, object type and response status",
+	}, []string{"handler", "method", "object", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "nix_sigman",
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by handler, method, object type and response status",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"handler", "method", "object", "status"})
+
+	httpResponseBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nix_sigman",
+		Name:      "http_response_bytes_total",
+		Help:      "Response body bytes served by handler and object type",
+	}, []string{"handler", "object"})
+
+	resignTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nix_sigman",
+		Name:      "resign_total",
+		Help:      "Narinfo resigning outcomes (signed, no_match or error)",
+	}, []string{"handler", "outcome"})
+
+	pushTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nix_sigman",
+		Name:      "push_total",
+		Help:      "Pushes to the proxy by result (accepted or rejected) and reason",
+	}, []string{"result", "reason"})
+
+	backendErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nix_sigman",
+		Name:      "backend_errors_total",
+		Help:      "Errors from the storage backend by operation",
+	}, []string{"handler", "operation"})
+)
+
+//nolint:gochecknoinits
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestsTotal,
+		httpRequestDuration,
+		httpResponseBytesTotal,
+		resignTotal,
+		pushTotal,
+		backendErrorsTotal,
+	)
+}
+
+// objectType classifies a request path for metric labels. Paths are not used directly so label
+// cardinality stays bounded.
+func objectType(name string) string {
+	base := path.Base(name)
+	switch {
+	case base == NixCacheInfoName:
+		return "nix-cache-info"
+	case strings.HasSuffix(base, ".narinfo"):
+		return "narinfo"
+	case strings.Contains(base, ".nar"):
+		return "nar"
+	default:
+		return "other"
+	}
+}
+
+// observeResign records the outcome of resigning a narinfo
+func observeResign(handler string, decision resigning.Decision, err error) {
+	switch {
+	case err != nil:
+		resignTotal.WithLabelValues(handler, resignError).Inc()
+	case decision.Signed:
+		resignTotal.WithLabelValues(handler, resignSigned).Inc()
+	default:
+		resignTotal.WithLabelValues(handler, resignNoMatch).Inc()
+	}
+}
+
+// observePush records an accepted push, or a rejected one and why
+func observePush(accepted bool, reason string) {
+	pushTotal.WithLabelValues(lo.Ternary(accepted, pushAccepted, pushRejected), reason).Inc()
+}
+
+// observeBackendError records a failed storage operation
+func observeBackendError(handler string, operation string) {
+	backendErrorsTotal.WithLabelValues(handler, operation).Inc()
+}
+
+// metricsResponseWriter captures the status and size of a response
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (m *metricsResponseWriter) WriteHeader(status int) {
+	if m.status == 0 {
+		m.status = status
+	}
+	m.ResponseWriter.WriteHeader(status)
+}
+
+func (m *metricsResponseWriter) Write(p []byte) (int, error) {
+	if m.status == 0 {
+		m.status = http.StatusOK
+	}
+	n, err := m.ResponseWriter.Write(p)
+	m.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (m *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
+
+// instrumentHandler records request counts, latency and response sizes for a handler
+func instrumentHandler(handler string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		mw := &metricsResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(mw, r)
+
+		status := mw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		object := objectType(r.URL.Path)
+		labels := []string{handler, r.Method, object, strconv.Itoa(status)}
+		httpRequestsTotal.WithLabelValues(labels...).Inc()
+		httpRequestDuration.WithLabelValues(labels...).Observe(time.Since(startTime).Seconds())
+		httpResponseBytesTotal.WithLabelValues(handler, object).Add(float64(mw.bytes))
+	})
+}
+
+// metricsHandler serves the registered metrics
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// withMetricsEndpoint serves /metrics ahead of a handler which would otherwise take every path
+func withMetricsEndpoint(next http.Handler) http.Handler {
+	metrics := metricsHandler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == metricsPath && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			metrics.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// metricsEndpoints returns the endpoints for a cache handler, with /metrics either served
+// alongside it or on its own listeners.
+func metricsEndpoints(config MetricsConfig, cache httpEndpoint) []httpEndpoint {
+	if len(config.MetricsListen) == 0 {
+		cache.Handler = withMetricsEndpoint(cache.Handler)
+		return []httpEndpoint{cache}
+	}
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, metricsHandler())
+	return []httpEndpoint{cache, {Name: "metrics", Listen: config.MetricsListen, Handler: mux}}
+}
@@ -0,0 +1,121 @@
+package entrypoint
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+)
+
+// MetricsSuite checks the proxy records metrics and serves them on /metrics
+type MetricsSuite struct {
+	server *httptest.Server
+}
+
+var _ = Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) SetUpTest(c *C) {
+	proxyFs := afero.NewMemMapFs()
+	c.Assert(afero.WriteFile(proxyFs, "/cache/"+NixCacheInfoName, []byte("StoreDir: /nix/store\n"), 0o644), IsNil)
+
+	CLI.Proxy = ProxyConfig{AllowPush: true, NarDir: "nar", Root: "/cache"}
+	handler, _, err := newProxyHandler(&CmdContext{
+		logger: zap.NewNop(),
+		ctx:    context.Background(),
+		fs:     proxyFs,
+	})
+	c.Assert(err, IsNil)
+	endpoints := metricsEndpoints(CLI.Proxy.MetricsConfig, httpEndpoint{Name: "cache", Handler: handler})
+	c.Assert(endpoints, HasLen, 1)
+	s.server = httptest.NewServer(endpoints[0].Handler)
+}
+
+func (s *MetricsSuite) TearDownTest(c *C) {
+	s.server.Close()
+	CLI.Proxy = ProxyConfig{}
+}
+
+func (s *MetricsSuite) request(c *C, method string, name string, body []byte) int {
+	req, err := http.NewRequest(method, s.server.URL+"/"+name, bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	c.Assert(err, IsNil)
+	return resp.StatusCode
+}
+
+// scrape fetches /metrics and returns the value of a sample, or 0 if it's not present
+func (s *MetricsSuite) scrape(c *C, sample string) float64 {
+	resp, err := http.Get(s.server.URL + metricsPath)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if value, found := strings.CutPrefix(sc.Text(), sample+" "); found {
+			result, err := strconv.ParseFloat(value, 64)
+			c.Assert(err, IsNil)
+			return result
+		}
+	}
+	c.Assert(sc.Err(), IsNil)
+	return 0
+}
+
+func (s *MetricsSuite) TestRequestMetrics(c *C) {
+	okSample := `nix_sigman_http_requests_total{handler="proxy",method="GET",object="nix-cache-info",status="200"}`
+	notFoundSample := `nix_sigman_http_requests_total{handler="proxy",method="GET",object="narinfo",status="404"}`
+	bytesSample := `nix_sigman_http_response_bytes_total{handler="proxy",object="nix-cache-info"}`
+	okBefore, notFoundBefore, bytesBefore := s.scrape(c, okSample), s.scrape(c, notFoundSample), s.scrape(c, bytesSample)
+
+	c.Assert(s.request(c, http.MethodGet, NixCacheInfoName, nil), Equals, http.StatusOK)
+	c.Assert(s.request(c, http.MethodGet, fmt.Sprintf("%s.narinfo", testHashPart), nil), Equals, http.StatusNotFound)
+
+	c.Check(s.scrape(c, okSample)-okBefore, Equals, float64(1))
+	c.Check(s.scrape(c, notFoundSample)-notFoundBefore, Equals, float64(1))
+	c.Check(s.scrape(c, bytesSample)-bytesBefore, Equals, float64(len("StoreDir: /nix/store\n")))
+}
+
+func (s *MetricsSuite) TestPushMetrics(c *C) {
+	createdSample := `nix_sigman_push_total{reason="created",result="accepted"}`
+	invalidSample := `nix_sigman_push_total{reason="invalid_narinfo",result="rejected"}`
+	resignSample := `nix_sigman_resign_total{handler="proxy",outcome="no_match"}`
+	createdBefore, invalidBefore, resignBefore := s.scrape(c, createdSample), s.scrape(c, invalidSample), s.scrape(c, resignSample)
+
+	ninfoName := fmt.Sprintf("%s.narinfo", testHashPart)
+	c.Assert(s.request(c, http.MethodPut, ninfoName, []byte("garbage")), Equals, http.StatusBadRequest)
+	c.Assert(s.request(c, http.MethodPut, ninfoName, testNarInfo(c, "metrics")), Equals, http.StatusOK)
+	c.Assert(s.request(c, http.MethodGet, ninfoName, nil), Equals, http.StatusOK)
+
+	c.Check(s.scrape(c, createdSample)-createdBefore, Equals, float64(1))
+	c.Check(s.scrape(c, invalidSample)-invalidBefore, Equals, float64(1))
+	c.Check(s.scrape(c, resignSample)-resignBefore, Equals, float64(1))
+}
+
+func (s *MetricsSuite) TestSeparateListener(c *C) {
+	endpoints := metricsEndpoints(MetricsConfig{MetricsListen: []string{"tcp://127.0.0.1:0"}},
+		httpEndpoint{Name: "cache", Handler: http.NotFoundHandler()})
+	c.Assert(endpoints, HasLen, 2)
+	c.Check(endpoints[1].Name, Equals, "metrics")
+
+	rec := httptest.NewRecorder()
+	endpoints[0].Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	c.Check(rec.Code, Equals, http.StatusNotFound)
+
+	rec = httptest.NewRecorder()
+	endpoints[1].Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(strings.Contains(rec.Body.String(), "nix_sigman_http_requests_total"), Equals, true)
+}
@@ -2,22 +2,26 @@ package entrypoint
 
 import (
 	"bytes"
-	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/MadAppGang/httplog"
 	lzap "github.com/MadAppGang/httplog/zap"
 	"github.com/chigopher/pathlib"
 	"github.com/julienschmidt/httprouter"
 	"github.com/mailgun/multibuf"
-	"github.com/wrouesnel/multihttp"
+	"github.com/samber/lo"
 	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
 	"github.com/wrouesnel/nix-sigman/pkg/resigning"
+	"github.com/wrouesnel/nix-sigman/pkg/upstream"
 	"go.uber.org/zap"
 	"go.withmatt.com/httpheaders"
 )
@@ -25,10 +29,23 @@ import (
 //nolint:gochecknoglobals
 type ProxyConfig struct {
 	resigning.ResigningConfig `embed:""`
+	TLSConfig                 `embed:""`
+	MetricsConfig             `embed:""`
+	HealthConfig              `embed:""`
+	ShutdownConfig            `embed:""`
+	ReloadConfig              `embed:""`
 	AllowPush                 bool                      `help:"Enable writing to the proxied store"`
 	PushResigningConfig       resigning.ResigningConfig `embed:"" prefix:"push-"`
 	PushRequiresResigning     bool                      `help:"Require pushed packages to match a resigning rule"`
 	PushOverwrite             bool                      `help:"Try and overwrite conflicting store paths if they're non-identical'"`
+	DecisionHeader            bool                      `help:"Explain the resigning decision for narinfo files in an X-Nix-Sigman-Decision response header"`
+	Upstreams                 []string                  `help:"Upstream binary caches to fetch and cache missing paths from"`
+	UpstreamTrustedKeys       []string                  `help:"Names of public keys trusted to sign upstream narinfo files (default all)" default:"*"`
+	UpstreamTimeout           time.Duration             `help:"Timeout for requests to upstream caches" default:"10m"`
+	AuthTokensFile            string                    `help:"File of client access tokens and their permissions (enables authentication)"`
+	AnonymousRead             bool                      `help:"Allow reads without credentials when authentication is enabled" default:"true" negatable:""`
+	NarDir                    string                    `help:"Directory under the root NAR files are stored in" default:"nar"`
+	ShardLevels               int                       `help:"Number of directory levels to shard pushed NAR files into (0 for a flat layout)" default:"0"`
 	Listen                    []string                  `help:"Listen addresses" default:"tcp://127.0.0.1:8080"`
 	Root                      string                    `arg:"" help:"Root path of the binary cache"`
 }
@@ -37,40 +54,80 @@ type ProxyConfig struct {
 func Proxy(cmdCtx *CmdContext) error {
 	l := cmdCtx.logger
 
-	l.Debug("Loading private keys")
-	privateKeys, err := loadPrivateKeys(cmdCtx.logger)
+	handler, keys, err := newProxyHandler(cmdCtx)
 	if err != nil {
-		cmdCtx.logger.Error("Error loading private keys", zap.Error(err))
-		return errors.Join(&ErrCommand{}, err)
+		return err
 	}
 
-	l.Debug("Loading public keys")
-	publicKeys, err := loadPublicKeys(cmdCtx.logger)
+	l.Info("Starting HTTP server")
+	if err := listenAndServe(cmdCtx, CLI.Proxy.ShutdownConfig, metricsEndpoints(CLI.Proxy.MetricsConfig,
+		httpEndpoint{Name: "cache", Listen: CLI.Proxy.Listen, TLS: CLI.Proxy.TLSConfig, Handler: handler,
+			Reload: keys.startReloading(cmdCtx.ctx, CLI.Proxy.ReloadConfig)})...); err != nil {
+		return err
+	}
+
+	l.Info("Exiting")
+	return nil
+}
+
+// newProxyHandler configures the proxy request handler from the proxy settings. The keys and
+// signing rules it uses are reloaded by the returned signingReloader.
+func newProxyHandler(cmdCtx *CmdContext) (http.Handler, *signingReloader, error) {
+	l := cmdCtx.logger
+
+	if err := validateShardLevels(CLI.Proxy.ShardLevels); err != nil {
+		return nil, nil, errors.Join(&ErrCommand{}, err)
+	}
+
+	keys, err := newSigningReloader(l)
 	if err != nil {
-		cmdCtx.logger.Error("Error loading public keys", zap.Error(err))
-		return errors.Join(&ErrCommand{}, err)
+		return nil, nil, errors.Join(&ErrCommand{}, err)
 	}
 
 	l.Debug("Load signing map")
-	signers, err := resigning.LoadSigningMap(l,
-		&CLI.Proxy.ResigningConfig,
-		privateKeys,
-		publicKeys,
-	)
+	signers, err := keys.Manager(&CLI.Proxy.ResigningConfig)
 	if err != nil {
-		return errors.Join(&ErrCommand{}, err)
+		return nil, nil, errors.Join(&ErrCommand{}, err)
 	}
 
 	l.Debug("Load push signing map")
-	var pushSigners resigning.ConditionalResigners
+	var pushSigners *resigning.Manager
 	if CLI.Proxy.AllowPush {
-		pushSigners, err = resigning.LoadSigningMap(l,
-			&CLI.Proxy.PushResigningConfig,
-			privateKeys,
-			publicKeys)
+		pushSigners, err = keys.Manager(&CLI.Proxy.PushResigningConfig)
+		if err != nil {
+			return nil, nil, errors.Join(&ErrCommand{}, err)
+		}
+	}
+
+	var upstreams *upstream.Upstream
+	if len(CLI.Proxy.Upstreams) > 0 {
+		l.Debug("Configuring upstream caches")
+		_, publicKeys := keys.Keys()
+		upstreams, err = loadUpstreams(l, publicKeys, keys.Revoked())
 		if err != nil {
-			return errors.Join(&ErrCommand{}, err)
+			l.Error("Error configuring upstream caches", zap.Error(err))
+			return nil, nil, errors.Join(&ErrCommand{}, err)
 		}
+		keys.AddHook(func(_ []nixtypes.NamedPrivateKey, publicKeys []nixtypes.NamedPublicKey,
+			revoked nixtypes.RevocationList) (func(), error) {
+			trustedKeys := upstreamTrustedKeys(l, publicKeys, revoked)
+			if len(trustedKeys) == 0 {
+				return nil, &upstream.ErrNoTrustedKeys{}
+			}
+			return func() { _ = upstreams.SetTrustedKeys(trustedKeys) }, nil
+		})
+	}
+
+	var tokens proxyTokens
+	if CLI.Proxy.AuthTokensFile != "" {
+		tokens, err = loadProxyTokens(CLI.Proxy.AuthTokensFile)
+		if err != nil {
+			l.Error("Error loading auth tokens file", zap.Error(err))
+			return nil, nil, errors.Join(&ErrCommand{}, err)
+		}
+		l.Info("Authentication enabled", zap.Int("num_tokens", len(tokens)), zap.Bool("anonymous_read", CLI.Proxy.AnonymousRead))
+	} else if CLI.Proxy.AllowPush {
+		l.Warn("Push is enabled without authentication - anyone who can reach the proxy can push")
 	}
 
 	rootDir := pathlib.NewPath(CLI.Proxy.Root, pathlib.PathWithAfero(cmdCtx.fs)).Clean()
@@ -80,24 +137,67 @@ func Proxy(cmdCtx *CmdContext) error {
 		// Handle both GET and HEAD.
 		defer r.Body.Close()
 		name := p.ByName("name")
+
+		// Authenticate and authorize before anything else. The logger is per-request so it can
+		// carry the identity.
+		l := l
+		var identity *proxyIdentity
+		if tokens != nil {
+			var authErr error
+			identity, authErr = tokens.authenticate(r)
+			if authErr != nil {
+				l.Info("Rejected request with invalid credentials", zap.String("remote_addr", r.RemoteAddr), zap.Error(authErr))
+				if r.Method == http.MethodPut {
+					observePush(false, "unauthenticated")
+				}
+				writeAuthChallenge(w, r, name)
+				return
+			}
+			allowed := CLI.Proxy.AnonymousRead || (identity != nil && identity.Read)
+			if r.Method == http.MethodPut {
+				allowed = identity != nil && identity.CanPush()
+			}
+			if !allowed && identity == nil {
+				if r.Method == http.MethodPut {
+					observePush(false, "unauthenticated")
+				}
+				writeAuthChallenge(w, r, name)
+				return
+			}
+			if identity != nil {
+				l = l.With(zap.String("identity", identity.Name))
+			}
+			if !allowed {
+				l.Info("Rejected request without permission", zap.String("method", r.Method), zap.String("name", name))
+				if r.Method == http.MethodPut {
+					observePush(false, "forbidden")
+				}
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(fmt.Sprintf("Forbidden: %s", name)))
+				return
+			}
+		}
 		requestName := rootDir.Join(name).Clean()
 		// Stat the request path so HEAD requests can work
 		st, err := requestName.Stat()
 		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				observeBackendError("proxy", "stat")
+			}
 			st = nil
 		}
 
 		if name == NixCacheInfoName {
 			if r.Method == http.MethodPut {
 				// Push mode does not allow changing cache parameters
+				observePush(false, "forbidden")
 				w.WriteHeader(http.StatusForbidden)
 				w.Write([]byte(fmt.Sprintf("Forbidden")))
 				return
 			}
 			fh, err := requestName.Open()
-			defer fh.Close()
-			if err != nil {
-				l.Warn("File Not Found", zap.String("error", err.Error()))
+			if err != nil || st == nil {
+				l.Warn("File Not Found", zap.String("name", name))
 				w.WriteHeader(http.StatusNotFound)
 				if r.Method == http.MethodHead {
 					// HEAD - no body response
@@ -106,18 +206,9 @@ func Proxy(cmdCtx *CmdContext) error {
 				w.Write([]byte(fmt.Sprintf("Not Found: %s", name)))
 				return
 			}
+			defer fh.Close()
 
-			w.Header().Set(httpheaders.ContentType, "text/x-nix-cache-info")
-			if st != nil {
-				w.Header().Set(httpheaders.ContentLength, fmt.Sprintf("%d", st.Size()))
-				w.Header().Set(httpheaders.LastModified, st.ModTime().Format(http.TimeFormat))
-			}
-			w.WriteHeader(http.StatusOK)
-			if r.Method == http.MethodHead {
-				// HEAD - no body response
-				return
-			}
-			io.Copy(w, fh)
+			serveContent(w, r, "text/x-nix-cache-info", st.ModTime(), fileEtag(st), seekableContent(fh, st.Size()))
 			return
 		}
 
@@ -128,24 +219,28 @@ func Proxy(cmdCtx *CmdContext) error {
 				ninfoReceiver, err := multibuf.NewWriterOnce()
 				if err != nil {
 					l.Info("Error setting up new buffer space", zap.Error(err))
+					observePush(false, "internal_error")
 					w.WriteHeader(http.StatusInternalServerError)
 					w.Write([]byte(fmt.Sprintf("Internal Server Error: %s", name)))
 					return
 				}
 				nBytes, err := io.Copy(ninfoReceiver, r.Body)
 				if err != nil {
+					observePush(false, "internal_error")
 					w.WriteHeader(http.StatusInternalServerError)
 					w.Write([]byte(fmt.Sprintf("Internal Server Error: %s", name)))
 					return
 				}
 				ninfoReader, err := ninfoReceiver.Reader()
 				if err != nil {
+					observePush(false, "internal_error")
 					w.WriteHeader(http.StatusInternalServerError)
 					w.Write([]byte(fmt.Sprintf("Internal Server Error: %s", name)))
 					return
 				}
 				ninfoBytes, err := io.ReadAll(ninfoReader)
 				if err != nil {
+					observePush(false, "internal_error")
 					w.WriteHeader(http.StatusInternalServerError)
 					w.Write([]byte(fmt.Sprintf("Internal Server Error: %s", name)))
 					return
@@ -153,24 +248,52 @@ func Proxy(cmdCtx *CmdContext) error {
 
 				receivedNinfo := nixtypes.NarInfo{}
 				if err := receivedNinfo.UnmarshalText(ninfoBytes); err != nil {
+					observePush(false, "invalid_narinfo")
 					w.WriteHeader(http.StatusBadRequest)
 					w.Write([]byte(fmt.Sprintf("Bad Request (could not parse NARinfo file): %s", name)))
 					return
 				}
+				// Push permissions are granted on the store path, so it must be the one the narinfo
+				// is stored under.
+				if strings.TrimSuffix(path.Base(name), ".narinfo") != receivedNinfo.NixHash() {
+					observePush(false, "invalid_narinfo")
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(fmt.Sprintf("Bad Request (NARinfo store path does not match its name): %s", name)))
+					return
+				}
 
 				l.Debug("Received new NAR info file", zap.Int64("num_bytes", nBytes))
+				if identity != nil {
+					if !identity.CanPushStorePath(receivedNinfo.StorePath) {
+						l.Info("Rejected push of store path without permission", zap.String("store_path", receivedNinfo.StorePath))
+						observePush(false, "forbidden")
+						w.WriteHeader(http.StatusForbidden)
+						w.Write([]byte(fmt.Sprintf("Forbidden (not permitted to push this store path): %s", name)))
+						return
+					}
+					l.Info("Authenticated push", zap.String("store_path", receivedNinfo.StorePath))
+					receivedNinfo.Extra[PushedByField] = identity.Name
+				}
+				// Point the narinfo at where the NAR was actually stored. The URL is not part of the
+				// fingerprint so this does not disturb signatures.
+				receivedNinfo.URL = shardNarName(receivedNinfo.URL, CLI.Proxy.NarDir, CLI.Proxy.ShardLevels)
 				if pushSigners != nil {
-					if didSignature, err := pushSigners.MaybeResign(l, &receivedNinfo); err != nil {
+					decision, err := pushSigners.Resign(r.Context(), &receivedNinfo)
+					observeResign("proxy_push", decision, err)
+					if err != nil {
 						l.Warn("Signing Error", zap.String("error", err.Error()))
+						observePush(false, "signing_error")
 						w.WriteHeader(http.StatusBadRequest)
 						w.Write([]byte(fmt.Sprintf("Signing Error: %s", name)))
 						return
-					} else if !didSignature && CLI.Proxy.PushRequiresResigning {
+					} else if !decision.Signed && CLI.Proxy.PushRequiresResigning {
+						observePush(false, "no_resigning_match")
 						w.WriteHeader(http.StatusForbidden)
 						w.Write([]byte(fmt.Sprintf("Forbidden (supplied path did not match any push resigning rules): %s", name)))
 						return
 					}
 				} else if CLI.Proxy.PushRequiresResigning && pushSigners == nil {
+					observePush(false, "internal_error")
 					w.WriteHeader(http.StatusInternalServerError)
 					w.Write([]byte(fmt.Sprintf("Internal Server Error (resigning required but no resigners configured): %s", name)))
 					return
@@ -178,6 +301,7 @@ func Proxy(cmdCtx *CmdContext) error {
 
 				marshalledNinfo, err := receivedNinfo.MarshalText()
 				if err != nil {
+					observePush(false, "internal_error")
 					w.WriteHeader(http.StatusInternalServerError)
 					w.Write([]byte(fmt.Sprintf("Internal Server Error (could not marshal resigned received NARinfo): %s", name)))
 					return
@@ -207,12 +331,14 @@ func Proxy(cmdCtx *CmdContext) error {
 						}
 						marshalledNinfo, err = ninfo.MarshalText()
 						if err != nil {
+							observePush(false, "internal_error")
 							w.WriteHeader(http.StatusInternalServerError)
 							w.Write([]byte(fmt.Sprintf("Internal Server Error (could not marshal resigned received NARinfo): %s", name)))
 							return
 						}
 						if !changed {
 							// No changes - return immediately.
+							observePush(true, "unchanged")
 							w.Header().Set(httpheaders.ContentLength, fmt.Sprintf("%d", len(marshalledNinfo)))
 							w.Header().Set(httpheaders.LastModified, st.ModTime().Format(http.TimeFormat))
 							w.WriteHeader(http.StatusOK)
@@ -221,25 +347,34 @@ func Proxy(cmdCtx *CmdContext) error {
 						}
 					} else {
 						if !CLI.Proxy.PushOverwrite {
+							observePush(false, "conflict")
 							w.WriteHeader(http.StatusConflict)
 							w.Write([]byte(fmt.Sprintf("Conflict: Remote path already exists and replacing is not allowed: %s", name)))
-						} else {
-							l.Info("Overwriting colliding store path with incoming one")
+							return
 						}
+						l.Info("Overwriting colliding store path with incoming one")
 					}
 				}
 
 				l.Debug("Uploading new NAR info file")
 				f, err := requestName.OpenFile(os.O_CREATE | os.O_WRONLY)
 				if err != nil {
+					observeBackendError("proxy", "create")
+					observePush(false, "backend_error")
 					w.WriteHeader(http.StatusInternalServerError)
 					w.Write([]byte(fmt.Sprintf("Internal Server Error (could not create file): %s", name)))
 					return
 				}
 				_, err = io.Copy(f, bytes.NewReader(marshalledNinfo))
-				f.Close()
+				if err != nil {
+					abortWrite(f, err)
+				} else {
+					err = f.Close()
+				}
 				if err != nil {
 					l.Error("Error writing NARinfo file to backend", zap.Error(err))
+					observeBackendError("proxy", "write")
+					observePush(false, "backend_error")
 					l.Debug("Attempting to remove partially written file")
 					if err := requestName.Remove(); err != nil {
 						l.Error("Could not remove partially written file", zap.Error(err))
@@ -252,12 +387,15 @@ func Proxy(cmdCtx *CmdContext) error {
 				st, err = requestName.Stat()
 				if err != nil {
 					// If we can't stat the path after writing it, something has gone wrong.
+					observeBackendError("proxy", "stat")
+					observePush(false, "backend_error")
 					w.WriteHeader(http.StatusInternalServerError)
 					w.Write([]byte(fmt.Sprintf("Internal Server Error (could not stat new file): %s", name)))
 					return
 				}
 
 				// Success uploading new NARinfo
+				observePush(true, "created")
 				w.Header().Set(httpheaders.ContentLength, fmt.Sprintf("%d", len(marshalledNinfo)))
 				w.Header().Set(httpheaders.LastModified, st.ModTime().Format(http.TimeFormat))
 				w.WriteHeader(http.StatusOK)
@@ -266,6 +404,16 @@ func Proxy(cmdCtx *CmdContext) error {
 			}
 
 			ninfo, err := loadNarInfo(l, requestName)
+			if err != nil && upstreams != nil {
+				// Fill from upstream. The server context is used so a disconnecting client
+				// doesn't abort a fetch other requests may be waiting on.
+				hashPart := strings.TrimSuffix(path.Base(name), ".narinfo")
+				if ninfo, err = upstreams.CacheNarInfo(serverContext(r, cmdCtx.ctx), rootDir, hashPart); err == nil {
+					st, _ = requestName.Stat()
+				} else {
+					l.Debug("Could not fetch from upstream", zap.String("name", name), zap.Error(err))
+				}
+			}
 			if err != nil {
 				//l.Warn("File Not Found", zap.String("error", err.Error()))
 				w.WriteHeader(http.StatusNotFound)
@@ -277,7 +425,12 @@ func Proxy(cmdCtx *CmdContext) error {
 				return
 			}
 
-			if _, err := signers.MaybeResign(l, &ninfo); err != nil {
+			decision, err := signers.Resign(r.Context(), &ninfo)
+			observeResign("proxy", decision, err)
+			if CLI.Proxy.DecisionHeader {
+				w.Header().Set(decisionHeader, decisionHeaderValue(decision))
+			}
+			if err != nil {
 				l.Warn("Signing Error", zap.String("error", err.Error()))
 				w.WriteHeader(http.StatusInternalServerError)
 				w.Write([]byte(fmt.Sprintf("Signing Error: %s", name)))
@@ -293,49 +446,58 @@ func Proxy(cmdCtx *CmdContext) error {
 					return
 				}
 				w.Write([]byte(fmt.Sprintf("Signing Error: %s", name)))
-			}
-
-			if st != nil {
-				w.Header().Set(httpheaders.ContentLength, fmt.Sprintf("%d", len(content)))
-				w.Header().Set(httpheaders.LastModified, st.ModTime().Format(http.TimeFormat))
-			}
-			w.Header().Set(httpheaders.ContentType, "text/x-nix-narinfo")
-			w.WriteHeader(http.StatusOK)
-			if r.Method == http.MethodHead {
-				// HEAD - no body response
 				return
 			}
-			w.Write(content)
+
+			// The ETag is of the resigned content, so clients revalidate when signatures change. There
+			// is no Last-Modified: signatures can change while the file on disk doesn't.
+			serveContent(w, r, "text/x-nix-narinfo", time.Time{}, contentEtag(content), bytes.NewReader(content))
 			return
 		}
 		// Everything else
-		if st != nil {
-			w.Header().Set(httpheaders.LastModified, st.ModTime().Format(http.TimeFormat))
+		// Flat NAR names are resolved into the sharded layout if they don't exist, and pushes are
+		// always stored sharded.
+		if shardedName := shardNarName(name, CLI.Proxy.NarDir, CLI.Proxy.ShardLevels); shardedName != name {
+			shardedPath := rootDir.Join(shardedName).Clean()
+			shardedSt, err := shardedPath.Stat()
+			if err != nil {
+				shardedSt = nil
+			}
+			if r.Method == http.MethodPut || (st == nil && shardedSt != nil) {
+				requestName = shardedPath
+				st = shardedSt
+			}
 		}
-		switch r.Method {
-		case http.MethodHead:
-			if st != nil {
-				w.Header().Set(httpheaders.ContentLength, fmt.Sprintf("%d", st.Size()))
-				w.WriteHeader(http.StatusOK)
+		if st == nil && upstreams != nil && r.Method != http.MethodPut {
+			if err := upstreams.CacheNar(serverContext(r, cmdCtx.ctx), rootDir, name); err == nil {
+				st, _ = requestName.Stat()
 			} else {
+				l.Debug("Could not fetch from upstream", zap.String("name", name), zap.Error(err))
+			}
+		}
+		switch r.Method {
+		case http.MethodHead, http.MethodGet:
+			if st == nil {
 				w.WriteHeader(http.StatusNotFound)
+				if r.Method == http.MethodHead {
+					// HEAD - no body response
+					return
+				}
 				w.Write([]byte(fmt.Sprintf("Not Found: %s", name)))
-			}
-			return
-		case http.MethodGet:
-			if st != nil {
-				w.Header().Set(httpheaders.ContentLength, fmt.Sprintf("%d", st.Size()))
+				return
 			}
 			fh, err := requestName.Open()
 			if err != nil {
 				l.Warn("File Not Found", zap.String("error", err.Error()))
+				observeBackendError("proxy", "open")
 				w.WriteHeader(http.StatusNotFound)
 				w.Write([]byte(fmt.Sprintf("Not Found: %s", name)))
 				return
 			}
 			defer fh.Close()
-			w.WriteHeader(http.StatusOK)
-			io.Copy(w, fh)
+			// NARs support Range requests so interrupted downloads can be resumed
+			contentType := lo.Ternary(strings.Contains(path.Base(name), ".nar"), "application/x-nix-nar", "application/octet-stream")
+			serveContent(w, r, contentType, st.ModTime(), fileEtag(st), seekableContent(fh, st.Size()))
 			return
 		case http.MethodPut:
 			// PUT is only allowed to create files. I'm sure I'll get burned by this
@@ -347,28 +509,44 @@ func Proxy(cmdCtx *CmdContext) error {
 					l.Debug("Removing 0-byte file and continuing")
 					if err := requestName.Remove(); err != nil {
 						l.Error("Could not remove partially written file", zap.Error(err))
+						observeBackendError("proxy", "remove")
+						observePush(false, "backend_error")
 						w.WriteHeader(http.StatusInternalServerError)
 						w.Write([]byte(fmt.Sprintf("Internal Server Error (could not remove 0-byte file): %s", name)))
 						return
 					}
 				} else {
 					l.Debug("Forbidding upload erasing existing file")
+					observePush(false, "exists")
 					w.WriteHeader(http.StatusForbidden)
 					w.Write([]byte(fmt.Sprintf("Forbidden (overwriting existing files not allowed): %s", name)))
 					return
 				}
 			}
+			if err := requestName.Parent().MkdirAllMode(os.FileMode(0755)); err != nil {
+				l.Warn("Could not create parent directory", zap.Error(err))
+			}
 			f, err := requestName.OpenFile(os.O_CREATE | os.O_WRONLY)
 			if err != nil {
+				observeBackendError("proxy", "create")
+				observePush(false, "backend_error")
 				w.WriteHeader(http.StatusInternalServerError)
 				w.Write([]byte(fmt.Sprintf("Internal Server Error (could not open file): %s", name)))
 				return
 			}
 			nbytes, err := io.Copy(f, r.Body)
-			f.Close()
+			if err != nil {
+				// Usually the client went away or the push was aborted by shutdown. Make sure
+				// streaming backends don't commit what was received so far.
+				abortWrite(f, err)
+			} else {
+				err = f.Close()
+			}
 			l.Info("Copied incoming file to backend", zap.Int64("nbytes", nbytes))
 			if err != nil {
 				l.Error("Error writing file", zap.Error(err))
+				observeBackendError("proxy", "write")
+				observePush(false, "backend_error")
 				l.Debug("Attempting to remove partially written file")
 				if err := requestName.Remove(); err != nil {
 					l.Error("Could not remove partially written file", zap.Error(err))
@@ -381,11 +559,14 @@ func Proxy(cmdCtx *CmdContext) error {
 			st, err = requestName.Stat()
 			if err != nil {
 				// If we can't stat the path after writing it, something has gone wrong.
+				observeBackendError("proxy", "stat")
+				observePush(false, "backend_error")
 				w.WriteHeader(http.StatusInternalServerError)
 				w.Write([]byte(fmt.Sprintf("Internal Server Error (could not stat new file): %s", name)))
 				return
 			}
 			w.Header().Set(httpheaders.LastModified, st.ModTime().Format(http.TimeFormat))
+			observePush(true, "created")
 			w.WriteHeader(http.StatusCreated)
 			return
 		default:
@@ -395,7 +576,6 @@ func Proxy(cmdCtx *CmdContext) error {
 		}
 	}
 
-	l.Info("Starting HTTP server")
 	router := httprouter.New()
 	router.GET("/*name", handle)
 	router.HEAD("/*name", handle)
@@ -412,33 +592,52 @@ func Proxy(cmdCtx *CmdContext) error {
 		},
 	)
 
-	webCtx, webCancel := context.WithCancel(cmdCtx.ctx)
-	listeners, errCh, listenerErr := multihttp.Listen(CLI.Proxy.Listen, logger(router))
-	if listenerErr != nil {
-		l.Error("Error setting up listeners", zap.Error(listenerErr))
-		webCancel()
+	checks := []readinessCheck{
+		keysCheck(keys),
+		signingMapCheck("signing_map", &CLI.Proxy.ResigningConfig, signers),
+		backendCheck(rootDir.Join(NixCacheInfoName)),
+	}
+	if CLI.Proxy.AllowPush {
+		checks = append(checks, signingMapCheck("push_signing_map", &CLI.Proxy.PushResigningConfig, pushSigners))
 	}
 
-	// Log errors from the listener
-	go func() {
-		listenerErrInfo := <-errCh
-		// On the first error, cancel the webCtx to shutdown
-		webCancel()
-		for {
-			l.Error("Error from listener",
-				zap.Error(listenerErrInfo.Error),
-				zap.String("listener_addr", listenerErrInfo.Listener.Addr().String()))
-			// Keep receiving the rest of the errors so we can log them
-			listenerErrInfo = <-errCh
-		}
-	}()
-	<-webCtx.Done()
-	for _, listener := range listeners {
-		if err := listener.Close(); err != nil {
-			l.Warn("Error closing listener during shutdown", zap.Error(err))
+	return withHealthEndpoints(newReadiness(CLI.Proxy.HealthConfig, checks...),
+		logger(instrumentHandler("proxy", router))), keys, nil
+}
+
+// loadUpstreams configures pull-through caching from the proxy upstream settings
+func loadUpstreams(l *zap.Logger, publicKeys []nixtypes.NamedPublicKey,
+	revoked nixtypes.RevocationList) (*upstream.Upstream, error) {
+	upstreamUrls := []*url.URL{}
+	for _, upstreamStr := range CLI.Proxy.Upstreams {
+		upstreamUrl, err := url.Parse(upstreamStr)
+		if err != nil {
+			return nil, err
 		}
+		upstreamUrls = append(upstreamUrls, upstreamUrl)
 	}
 
-	l.Info("Exiting")
-	return nil
+	trustedKeys := upstreamTrustedKeys(l, publicKeys, revoked)
+	l.Info("Pull-through caching enabled",
+		zap.Strings("upstreams", lo.Map(upstreamUrls, func(item *url.URL, _ int) string { return item.Redacted() })),
+		zap.Int("num_trusted_keys", len(trustedKeys)))
+
+	return upstream.NewUpstream(l, upstreamUrls, trustedKeys, &http.Client{Timeout: CLI.Proxy.UpstreamTimeout})
+}
+
+// upstreamTrustedKeys selects the public keys trusted to sign upstream narinfo files. Revoked
+// keys are never trusted.
+func upstreamTrustedKeys(l *zap.Logger, publicKeys []nixtypes.NamedPublicKey,
+	revoked nixtypes.RevocationList) []nixtypes.NamedPublicKey {
+	publicKeys = lo.Reject(publicKeys, func(item nixtypes.NamedPublicKey, _ int) bool { return revoked.IsRevoked(item) })
+	if lo.Contains(CLI.Proxy.UpstreamTrustedKeys, "*") {
+		l.Debug("Trust upstreams signed by ALL public keys")
+		return publicKeys
+	}
+	desiredKeyNames := lo.SliceToMap(CLI.Proxy.UpstreamTrustedKeys, func(item string) (string, struct{}) {
+		return item, struct{}{}
+	})
+	return lo.Filter(publicKeys, func(item nixtypes.NamedPublicKey, index int) bool {
+		return lo.HasKey(desiredKeyNames, item.KeyName)
+	})
 }
@@ -0,0 +1,446 @@
+package entrypoint
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chigopher/pathlib"
+	"github.com/spf13/afero"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"github.com/wrouesnel/nix-sigman/pkg/resigning"
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+	"zombiezen.com/go/nix/nar"
+)
+
+// ProxySuite checks the HTTP semantics of the proxy handler
+type ProxySuite struct {
+	proxyFs  afero.Fs
+	server   *httptest.Server
+	narBytes []byte
+	ninfo    nixtypes.NarInfo
+}
+
+var _ = Suite(&ProxySuite{})
+
+func (s *ProxySuite) SetUpTest(c *C) {
+	s.proxyFs = afero.NewMemMapFs()
+
+	s.narBytes = make([]byte, 64*1024)
+	_, err := rand.Read(s.narBytes)
+	c.Assert(err, IsNil)
+	narHash := sha256.Sum256(s.narBytes)
+	typedHash := nixtypes.TypedNixHash{HashName: "sha256", Hash: narHash[:]}
+	s.ninfo = nixtypes.NarInfo{
+		StorePath:   fmt.Sprintf("/nix/store/%s-test", testHashPart),
+		URL:         fmt.Sprintf("nar/%s.nar", typedHash.Hash.String()),
+		Compression: "none",
+		FileHash:    typedHash,
+		FileSize:    uint64(len(s.narBytes)),
+		NarHash:     typedHash,
+		NarSize:     uint64(len(s.narBytes)),
+		References:  []string{},
+		Extra:       map[string]string{},
+	}
+	ninfoBytes, err := s.ninfo.MarshalText()
+	c.Assert(err, IsNil)
+	c.Assert(afero.WriteFile(s.proxyFs, "/cache/"+s.ninfo.URL, s.narBytes, 0o644), IsNil)
+	c.Assert(afero.WriteFile(s.proxyFs, fmt.Sprintf("/cache/%s.narinfo", testHashPart), ninfoBytes, 0o644), IsNil)
+	c.Assert(afero.WriteFile(s.proxyFs, "/cache/"+NixCacheInfoName, []byte("StoreDir: /nix/store\n"), 0o644), IsNil)
+
+	CLI.Proxy = ProxyConfig{NarDir: "nar", Root: "/cache"}
+	handler, _, err := newProxyHandler(&CmdContext{
+		logger: zap.NewNop(),
+		ctx:    context.Background(),
+		fs:     s.proxyFs,
+	})
+	c.Assert(err, IsNil)
+	s.server = httptest.NewServer(handler)
+}
+
+func (s *ProxySuite) TearDownTest(c *C) {
+	s.server.Close()
+	CLI.Proxy = ProxyConfig{}
+}
+
+func (s *ProxySuite) get(c *C, name string, headers map[string]string) (*http.Response, []byte) {
+	req, err := http.NewRequest(http.MethodGet, s.server.URL+"/"+name, nil)
+	c.Assert(err, IsNil)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	return resp, body
+}
+
+func (s *ProxySuite) TestNarInfoEtag(c *C) {
+	ninfoName := fmt.Sprintf("%s.narinfo", testHashPart)
+	resp, body := s.get(c, ninfoName, nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(resp.Header.Get("Content-Type"), Equals, "text/x-nix-narinfo")
+	etag := resp.Header.Get("ETag")
+	c.Assert(etag, Not(Equals), "")
+	c.Check(strings.HasPrefix(etag, "W/"), Equals, false)
+	c.Check(etag, Equals, contentEtag(body))
+
+	resp, body = s.get(c, ninfoName, map[string]string{"If-None-Match": etag})
+	c.Check(resp.StatusCode, Equals, http.StatusNotModified)
+	c.Check(body, HasLen, 0)
+
+	resp, _ = s.get(c, ninfoName, map[string]string{"If-None-Match": `"stale"`})
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *ProxySuite) TestDecisionHeader(c *C) {
+	key, err := nixtypes.GeneratePrivateKey("internal-1")
+	c.Assert(err, IsNil)
+	CLI.PrivateKeys = []string{key.String()}
+	defer func() { CLI.PrivateKeys = nil }()
+	CLI.Proxy.DecisionHeader = true
+	CLI.Proxy.AllowUnsignedResigning = true
+	CLI.Proxy.UnsignedResigningKeys = []string{"internal-1"}
+	handler, _, err := newProxyHandler(&CmdContext{
+		logger: zap.NewNop(),
+		ctx:    context.Background(),
+		fs:     s.proxyFs,
+	})
+	c.Assert(err, IsNil)
+	s.server.Config.Handler = handler
+
+	resp, _ := s.get(c, fmt.Sprintf("%s.narinfo", testHashPart), nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	decision := resigning.Decision{}
+	c.Assert(json.Unmarshal([]byte(resp.Header.Get(decisionHeader)), &decision), IsNil)
+	c.Check(decision.StorePath, Equals, s.ninfo.StorePath)
+	c.Check(decision.Signed, Equals, true)
+	c.Check(decision.Rules, DeepEquals, []resigning.RuleDecision{{
+		Rule:       resigning.UnsignedRuleName,
+		Matched:    true,
+		Reason:     "all conditions matched",
+		SignedWith: []string{"internal-1"},
+	}})
+
+	// Only narinfo responses explain a decision
+	resp, _ = s.get(c, NixCacheInfoName, nil)
+	c.Check(resp.Header.Get(decisionHeader), Equals, "")
+}
+
+func (s *ProxySuite) TestRevokedSignaturesRemoved(c *C) {
+	leaked, err := nixtypes.GeneratePrivateKey("leaked-1")
+	c.Assert(err, IsNil)
+	kept, err := nixtypes.GeneratePrivateKey("kept-1")
+	c.Assert(err, IsNil)
+	for _, key := range []nixtypes.NamedPrivateKey{leaked, kept} {
+		_, _, err := s.ninfo.Sign(key)
+		c.Assert(err, IsNil)
+	}
+	ninfoBytes, err := s.ninfo.MarshalText()
+	c.Assert(err, IsNil)
+	c.Assert(afero.WriteFile(s.proxyFs, fmt.Sprintf("/cache/%s.narinfo", testHashPart), ninfoBytes, 0o644), IsNil)
+
+	publicKey := leaked.PublicKey()
+	CLI.RevokedKeys = []string{publicKey.String()}
+	defer func() { CLI.RevokedKeys = nil }()
+	handler, _, err := newProxyHandler(&CmdContext{
+		logger: zap.NewNop(),
+		ctx:    context.Background(),
+		fs:     s.proxyFs,
+	})
+	c.Assert(err, IsNil)
+	s.server.Config.Handler = handler
+
+	resp, body := s.get(c, fmt.Sprintf("%s.narinfo", testHashPart), nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	served := nixtypes.NarInfo{}
+	c.Assert(served.UnmarshalText(body), IsNil)
+	c.Assert(served.Sig, HasLen, 1)
+	c.Check(served.Sig[0].KeyName, Equals, "kept-1")
+}
+
+// testNar returns a NAR of a single file with random content
+func testNar(c *C) []byte {
+	content := make([]byte, 4096)
+	_, err := rand.Read(content)
+	c.Assert(err, IsNil)
+	contentPath := filepath.Join(c.MkDir(), "content")
+	c.Assert(os.WriteFile(contentPath, content, 0o644), IsNil)
+	narBuf := &bytes.Buffer{}
+	c.Assert(nar.DumpPath(narBuf, contentPath), IsNil)
+	return narBuf.Bytes()
+}
+
+func (s *ProxySuite) TestUpstreamFetchThrough(c *C) {
+	const upstreamHashPart = "1b8m1dp0ln4rlvkbi7zyb5yvvfzwhbsm"
+	key, err := nixtypes.GeneratePrivateKey("upstream-1")
+	c.Assert(err, IsNil)
+	narBytes := testNar(c)
+	narHash := sha256.Sum256(narBytes)
+	typedHash := nixtypes.TypedNixHash{HashName: "sha256", Hash: narHash[:]}
+	ninfo := nixtypes.NarInfo{
+		StorePath:   fmt.Sprintf("/nix/store/%s-upstream", upstreamHashPart),
+		URL:         fmt.Sprintf("nar/%s.nar", typedHash.Hash.String()),
+		Compression: "none",
+		FileHash:    typedHash,
+		FileSize:    uint64(len(narBytes)),
+		NarHash:     typedHash,
+		NarSize:     uint64(len(narBytes)),
+		References:  []string{},
+		Extra:       map[string]string{},
+	}
+	_, _, err = ninfo.Sign(key)
+	c.Assert(err, IsNil)
+	ninfoBytes, err := ninfo.MarshalText()
+	c.Assert(err, IsNil)
+
+	upstreamFiles := map[string][]byte{
+		fmt.Sprintf("/%s.narinfo", upstreamHashPart): ninfoBytes,
+		"/" + ninfo.URL: narBytes,
+	}
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, found := upstreamFiles[r.URL.Path]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(content)
+	}))
+	defer upstreamServer.Close()
+
+	publicKey := key.PublicKey()
+	CLI.PublicKeys = []string{publicKey.String()}
+	defer func() { CLI.PublicKeys = nil }()
+	CLI.Proxy.Upstreams = []string{upstreamServer.URL}
+	CLI.Proxy.UpstreamTrustedKeys = []string{"*"}
+	handler, _, err := newProxyHandler(&CmdContext{
+		logger: zap.NewNop(),
+		ctx:    context.Background(),
+		fs:     s.proxyFs,
+	})
+	c.Assert(err, IsNil)
+	s.server.Config.Handler = handler
+
+	ninfoName := fmt.Sprintf("%s.narinfo", upstreamHashPart)
+	resp, body := s.get(c, ninfoName, nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	served := nixtypes.NarInfo{}
+	c.Assert(served.UnmarshalText(body), IsNil)
+	c.Check(served.StorePath, Equals, ninfo.StorePath)
+	resp, body = s.get(c, ninfo.URL, nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(body, DeepEquals, narBytes)
+
+	cachedNar, err := afero.ReadFile(s.proxyFs, "/cache/"+ninfo.URL)
+	c.Assert(err, IsNil)
+	c.Check(cachedNar, DeepEquals, narBytes)
+	exists, err := afero.Exists(s.proxyFs, "/cache/"+ninfoName)
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, true)
+
+	// Once cached, both are served locally without the upstream
+	upstreamServer.Close()
+	resp, _ = s.get(c, ninfoName, nil)
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	resp, body = s.get(c, ninfo.URL, nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(body, DeepEquals, narBytes)
+}
+
+func (s *ProxySuite) TestIfModifiedSince(c *C) {
+	resp, _ := s.get(c, NixCacheInfoName, map[string]string{
+		"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat),
+	})
+	c.Check(resp.StatusCode, Equals, http.StatusNotModified)
+
+	resp, body := s.get(c, NixCacheInfoName, map[string]string{
+		"If-Modified-Since": time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat),
+	})
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(string(body), Equals, "StoreDir: /nix/store\n")
+}
+
+func (s *ProxySuite) TestNarInfoHasNoLastModified(c *C) {
+	// The served signatures can change without the file changing, so only the ETag revalidates
+	ninfoName := fmt.Sprintf("%s.narinfo", testHashPart)
+	resp, _ := s.get(c, ninfoName, map[string]string{
+		"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat),
+	})
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(resp.Header.Get("Last-Modified"), Equals, "")
+}
+
+func (s *ProxySuite) TestNarRange(c *C) {
+	resp, body := s.get(c, s.ninfo.URL, nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(resp.Header.Get("Accept-Ranges"), Equals, "bytes")
+	c.Check(body, DeepEquals, s.narBytes)
+
+	resp, body = s.get(c, s.ninfo.URL, map[string]string{"Range": "bytes=1000-"})
+	c.Assert(resp.StatusCode, Equals, http.StatusPartialContent)
+	c.Check(resp.Header.Get("Content-Range"), Equals, fmt.Sprintf("bytes 1000-%d/%d", len(s.narBytes)-1, len(s.narBytes)))
+	c.Check(body, DeepEquals, s.narBytes[1000:])
+
+	// A stale If-Range sends the whole file again
+	resp, body = s.get(c, s.ninfo.URL, map[string]string{"Range": "bytes=1000-", "If-Range": `"stale"`})
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(body, DeepEquals, s.narBytes)
+}
+
+func (s *ProxySuite) TestStreamSeekerRange(c *C) {
+	content := []byte("0123456789abcdef")
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/nar/test.nar", nil)
+	req.Header.Set("Range", "bytes=10-13")
+	serveContent(recorder, req, "application/x-nix-nar", time.Time{}, `"test"`,
+		newStreamSeeker(bytes.NewReader(content), int64(len(content))))
+	c.Check(recorder.Code, Equals, http.StatusPartialContent)
+	c.Check(recorder.Body.String(), Equals, "abcd")
+}
+
+// ProxyAuthSuite checks authentication and per-token authorization of the proxy
+type ProxyAuthSuite struct {
+	proxyFs afero.Fs
+	server  *httptest.Server
+}
+
+var _ = Suite(&ProxyAuthSuite{})
+
+const testTokens = `# name token permissions
+reader reader-token read
+pusher pusher-token read,push
+docs docs-token push=*-docs
+`
+
+func (s *ProxyAuthSuite) SetUpTest(c *C) {
+	s.proxyFs = afero.NewMemMapFs()
+	c.Assert(afero.WriteFile(s.proxyFs, "/cache/"+NixCacheInfoName, []byte("StoreDir: /nix/store\n"), 0o644), IsNil)
+
+	tokensFile := filepath.Join(c.MkDir(), "tokens")
+	c.Assert(os.WriteFile(tokensFile, []byte(testTokens), 0o600), IsNil)
+
+	CLI.Proxy = ProxyConfig{AllowPush: true, NarDir: "nar", Root: "/cache", AuthTokensFile: tokensFile, AnonymousRead: true}
+	handler, _, err := newProxyHandler(&CmdContext{
+		logger: zap.NewNop(),
+		ctx:    context.Background(),
+		fs:     s.proxyFs,
+	})
+	c.Assert(err, IsNil)
+	s.server = httptest.NewServer(handler)
+}
+
+func (s *ProxyAuthSuite) TearDownTest(c *C) {
+	s.server.Close()
+	CLI.Proxy = ProxyConfig{}
+}
+
+func (s *ProxyAuthSuite) request(c *C, method string, name string, body []byte, setAuth func(r *http.Request)) int {
+	req, err := http.NewRequest(method, s.server.URL+"/"+name, bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	if setAuth != nil {
+		setAuth(req)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode == http.StatusUnauthorized {
+		c.Check(resp.Header.Values("WWW-Authenticate"), HasLen, 2)
+	}
+	return resp.StatusCode
+}
+
+func bearer(token string) func(r *http.Request) {
+	return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+}
+
+func basic(username string, password string) func(r *http.Request) {
+	return func(r *http.Request) { r.SetBasicAuth(username, password) }
+}
+
+func testNarInfo(c *C, storeName string) []byte {
+	ninfo := nixtypes.NarInfo{
+		StorePath:   fmt.Sprintf("/nix/store/%s-%s", testHashPart, storeName),
+		URL:         "nar/test.nar",
+		Compression: "none",
+		FileHash:    nixtypes.TypedNixHash{HashName: "sha256", Hash: make([]byte, sha256.Size)},
+		FileSize:    1,
+		NarHash:     nixtypes.TypedNixHash{HashName: "sha256", Hash: make([]byte, sha256.Size)},
+		NarSize:     1,
+		References:  []string{},
+		Extra:       map[string]string{},
+	}
+	ninfoBytes, err := ninfo.MarshalText()
+	c.Assert(err, IsNil)
+	return ninfoBytes
+}
+
+func (s *ProxyAuthSuite) TestAnonymousRead(c *C) {
+	c.Check(s.request(c, http.MethodGet, NixCacheInfoName, nil, nil), Equals, http.StatusOK)
+	c.Check(s.request(c, http.MethodPut, "nar/test.nar", []byte("x"), nil), Equals, http.StatusUnauthorized)
+
+	CLI.Proxy.AnonymousRead = false
+	c.Check(s.request(c, http.MethodGet, NixCacheInfoName, nil, nil), Equals, http.StatusUnauthorized)
+	c.Check(s.request(c, http.MethodGet, NixCacheInfoName, nil, bearer("reader-token")), Equals, http.StatusOK)
+	c.Check(s.request(c, http.MethodGet, NixCacheInfoName, nil, basic("reader", "reader-token")), Equals, http.StatusOK)
+	c.Check(s.request(c, http.MethodGet, NixCacheInfoName, nil, bearer("docs-token")), Equals, http.StatusForbidden)
+}
+
+func (s *ProxyAuthSuite) TestInvalidCredentials(c *C) {
+	c.Check(s.request(c, http.MethodGet, NixCacheInfoName, nil, bearer("wrong-token")), Equals, http.StatusUnauthorized)
+	// The username must match the name the token belongs to
+	c.Check(s.request(c, http.MethodGet, NixCacheInfoName, nil, basic("reader", "pusher-token")), Equals, http.StatusUnauthorized)
+}
+
+func (s *ProxyAuthSuite) TestPushPermissions(c *C) {
+	ninfoName := fmt.Sprintf("%s.narinfo", testHashPart)
+	c.Check(s.request(c, http.MethodPut, "nar/test.nar", []byte("x"), bearer("reader-token")), Equals, http.StatusForbidden)
+	c.Check(s.request(c, http.MethodPut, ninfoName, testNarInfo(c, "hello"), bearer("docs-token")), Equals, http.StatusForbidden)
+	c.Check(s.request(c, http.MethodPut, ninfoName, testNarInfo(c, "hello-docs"), bearer("docs-token")), Equals, http.StatusOK)
+
+	cacheRoot := pathlib.NewPath("/cache", pathlib.PathWithAfero(s.proxyFs))
+	storedNinfo, err := loadNarInfo(zap.NewNop(), cacheRoot.Join(ninfoName))
+	c.Assert(err, IsNil)
+	c.Check(storedNinfo.Extra[PushedByField], Equals, "docs")
+}
+
+func (s *ProxyAuthSuite) TestPushUnderOtherHashRejected(c *C) {
+	// A token allowed to push *-docs must not be able to store that narinfo as another path
+	const otherHashPart = "1b8m1dp0ln4rlvkbi7zyb5yvvfzwhbsm"
+	ninfoName := fmt.Sprintf("%s.narinfo", otherHashPart)
+	c.Check(s.request(c, http.MethodPut, ninfoName, testNarInfo(c, "hello-docs"), bearer("docs-token")), Equals, http.StatusBadRequest)
+
+	exists, err := afero.Exists(s.proxyFs, "/cache/"+ninfoName)
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, false)
+}
+
+func (s *ProxyAuthSuite) TestPushThroughHttpCacheBackend(c *C) {
+	serverUrl, err := url.Parse(s.server.URL)
+	c.Assert(err, IsNil)
+	netrcFile := filepath.Join(c.MkDir(), "netrc")
+	c.Assert(os.WriteFile(netrcFile,
+		[]byte(fmt.Sprintf("machine %s login pusher password pusher-token\n", serverUrl.Hostname())), 0o600), IsNil)
+
+	fs, err := newFs(zap.NewNop(), "nix-http-cache", fmt.Sprintf("%s,netrc-file=%s", s.server.URL, netrcFile))
+	c.Assert(err, IsNil)
+	c.Assert(afero.WriteFile(fs, "/nar/test.nar", []byte("x"), 0o644), IsNil)
+
+	storedNar, err := afero.ReadFile(s.proxyFs, "/cache/nar/test.nar")
+	c.Assert(err, IsNil)
+	c.Check(string(storedNar), Equals, "x")
+}
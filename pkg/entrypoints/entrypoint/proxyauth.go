@@ -0,0 +1,162 @@
+package entrypoint
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// PushedByField is the narinfo field the identity which pushed a path is recorded in
+const PushedByField = "PushedBy"
+
+type ErrInvalidTokenEntry struct {
+	Line   int
+	Reason string
+}
+
+func (e ErrInvalidTokenEntry) Error() string {
+	return fmt.Sprintf("invalid token entry on line %d: %s", e.Line, e.Reason)
+}
+
+type ErrUnauthenticated struct{}
+
+func (e ErrUnauthenticated) Error() string {
+	return "invalid credentials"
+}
+
+// proxyIdentity is an authenticated client of the proxy and what it may do
+type proxyIdentity struct {
+	Name string
+	Read bool
+	// Push allows pushing any store path
+	Push bool
+	// PushPatterns restricts pushes to store paths whose name (without the hash) matches
+	PushPatterns []string
+}
+
+// CanPush reports if the identity may push anything at all
+func (i *proxyIdentity) CanPush() bool {
+	return i.Push || len(i.PushPatterns) > 0
+}
+
+// CanPushStorePath checks a store path against the identity's push permissions
+func (i *proxyIdentity) CanPushStorePath(storePath string) bool {
+	if i.Push {
+		return true
+	}
+	_, name, _ := strings.Cut(path.Base(storePath), "-")
+	return lo.ContainsBy(i.PushPatterns, func(pattern string) bool {
+		matched, _ := path.Match(pattern, name)
+		return matched
+	})
+}
+
+// proxyTokens maps the hashes of access tokens to the identity they authenticate. Tokens are
+// looked up by hash so lookup timing doesn't reveal anything about valid tokens.
+type proxyTokens map[[sha256.Size]byte]*proxyIdentity
+
+// loadProxyTokens loads a tokens file. Each line is an identity name, its token and a comma
+// separated list of permissions: read, push or push=<store path name pattern>.
+//
+//	# name token permissions
+//	alice 5Jd8xCkq... read,push
+//	docs-ci Vb3pLq0z... read,push=*-docs,push=*-manual
+func loadProxyTokens(tokensFile string) (proxyTokens, error) {
+	fh, err := os.Open(tokensFile)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	tokens := proxyTokens{}
+	names := map[string]struct{}{}
+	sc := bufio.NewScanner(fh)
+	lineNum := 0
+	for sc.Scan() {
+		lineNum++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			// Just skip empty lines and comments
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, &ErrInvalidTokenEntry{Line: lineNum, Reason: "expected a name, token and permissions"}
+		}
+		identity := &proxyIdentity{Name: fields[0]}
+		if _, found := names[identity.Name]; found {
+			return nil, &ErrInvalidTokenEntry{Line: lineNum, Reason: fmt.Sprintf("duplicate name: %s", identity.Name)}
+		}
+		names[identity.Name] = struct{}{}
+
+		for _, permission := range strings.Split(fields[2], ",") {
+			switch key, value, hasValue := strings.Cut(permission, "="); {
+			case key == "read" && !hasValue:
+				identity.Read = true
+			case key == "push" && !hasValue:
+				identity.Push = true
+			case key == "push" && value != "":
+				if _, err := path.Match(value, ""); err != nil {
+					return nil, &ErrInvalidTokenEntry{Line: lineNum, Reason: fmt.Sprintf("bad push pattern: %s", value)}
+				}
+				identity.PushPatterns = append(identity.PushPatterns, value)
+			default:
+				return nil, &ErrInvalidTokenEntry{Line: lineNum, Reason: fmt.Sprintf("unknown permission: %s", permission)}
+			}
+		}
+
+		tokenHash := sha256.Sum256([]byte(fields[1]))
+		if _, found := tokens[tokenHash]; found {
+			return nil, &ErrInvalidTokenEntry{Line: lineNum, Reason: "duplicate token"}
+		}
+		tokens[tokenHash] = identity
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// authenticate returns the identity the request's credentials belong to. Bearer tokens and basic
+// auth (with the identity name as the username and the token as the password) are accepted. A
+// nil identity and error means no credentials were supplied.
+func (t proxyTokens) authenticate(r *http.Request) (*proxyIdentity, error) {
+	if username, password, ok := r.BasicAuth(); ok {
+		identity, found := t[sha256.Sum256([]byte(password))]
+		if !found || identity.Name != username {
+			return nil, &ErrUnauthenticated{}
+		}
+		return identity, nil
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return nil, nil
+	}
+	scheme, token, _ := strings.Cut(authorization, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil, errors.Join(&ErrUnauthenticated{}, fmt.Errorf("unsupported authorization scheme: %s", scheme))
+	}
+	identity, found := t[sha256.Sum256([]byte(strings.TrimSpace(token)))]
+	if !found {
+		return nil, &ErrUnauthenticated{}
+	}
+	return identity, nil
+}
+
+// writeAuthChallenge responds with a 401 asking for either supported type of credentials
+func writeAuthChallenge(w http.ResponseWriter, r *http.Request, name string) {
+	w.Header().Add("WWW-Authenticate", `Basic realm="nix-sigman"`)
+	w.Header().Add("WWW-Authenticate", `Bearer realm="nix-sigman"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(fmt.Sprintf("Unauthorized: %s", name)))
+	}
+}
@@ -0,0 +1,252 @@
+package entrypoint
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"github.com/wrouesnel/nix-sigman/pkg/resigning"
+	"go.uber.org/zap"
+)
+
+// ReloadConfig configures reloading keys and signing rules while serving
+type ReloadConfig struct {
+	ReloadInterval time.Duration `help:"Interval to check key, revoked key, signing map and signing rules files for changes and reload them (0 to only reload on SIGHUP)" default:"0s"`
+}
+
+// reloadHook checks the newly loaded keys can be used, and returns a function to start using them.
+// The returned function is only called once every hook has accepted the keys.
+type reloadHook func(privateKeys []nixtypes.NamedPrivateKey, publicKeys []nixtypes.NamedPublicKey,
+	revoked nixtypes.RevocationList) (func(), error)
+
+// reloadableManager is a resigning manager and the config its rules are rebuilt from
+type reloadableManager struct {
+	config  *resigning.ResigningConfig
+	manager *resigning.Manager
+}
+
+// signingReloader holds the keys and resigning managers of a server command, and reloads them
+// together from disk. If anything fails to load, everything is left as it was.
+type signingReloader struct {
+	l *zap.Logger
+	// reloadMtx serializes reloads from SIGHUP and the file watcher
+	reloadMtx   sync.Mutex
+	mtx         sync.RWMutex
+	privateKeys []nixtypes.NamedPrivateKey
+	publicKeys  []nixtypes.NamedPublicKey
+	revoked     nixtypes.RevocationList
+	managers    []reloadableManager
+	hooks       []reloadHook
+}
+
+// newSigningReloader loads the keys from the global key options
+func newSigningReloader(l *zap.Logger) (*signingReloader, error) {
+	l.Debug("Loading private keys")
+	privateKeys, err := loadPrivateKeys(l)
+	if err != nil {
+		l.Error("Error loading private keys", zap.Error(err))
+		return nil, err
+	}
+
+	l.Debug("Loading public keys")
+	publicKeys, err := loadPublicKeys(l)
+	if err != nil {
+		l.Error("Error loading public keys", zap.Error(err))
+		return nil, err
+	}
+
+	l.Debug("Loading revoked keys")
+	revoked, err := loadRevocations(l)
+	if err != nil {
+		l.Error("Error loading revoked keys", zap.Error(err))
+		return nil, err
+	}
+
+	return &signingReloader{l: l, privateKeys: privateKeys, publicKeys: publicKeys, revoked: revoked}, nil
+}
+
+// Keys returns the keys which were last loaded successfully
+func (s *signingReloader) Keys() ([]nixtypes.NamedPrivateKey, []nixtypes.NamedPublicKey) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.privateKeys, s.publicKeys
+}
+
+// Revoked returns the revoked keys which were last loaded successfully
+func (s *signingReloader) Revoked() nixtypes.RevocationList {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.revoked
+}
+
+// Manager builds a resigning manager from config, which is rebuilt on every reload
+func (s *signingReloader) Manager(config *resigning.ResigningConfig) (*resigning.Manager, error) {
+	privateKeys, publicKeys := s.Keys()
+	manager, err := resigning.LoadManager(s.l, config, privateKeys, publicKeys, s.Revoked())
+	if err != nil {
+		return nil, err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.managers = append(s.managers, reloadableManager{config: config, manager: manager})
+	return manager, nil
+}
+
+// AddHook adds something else which uses the keys to the reload
+func (s *signingReloader) AddHook(hook reloadHook) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+// Reload loads the keys, revoked keys, signing maps and signing rules files again, and swaps them in only if
+// all of them load and every manager and hook accepts them.
+func (s *signingReloader) Reload() error {
+	s.reloadMtx.Lock()
+	defer s.reloadMtx.Unlock()
+
+	privateKeys, err := loadPrivateKeys(s.l)
+	if err != nil {
+		return err
+	}
+	publicKeys, err := loadPublicKeys(s.l)
+	if err != nil {
+		return err
+	}
+	revoked, err := loadRevocations(s.l)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.RLock()
+	managers := s.managers
+	hooks := s.hooks
+	s.mtx.RUnlock()
+
+	// Build every set of rules up front so nothing changes if any of them are invalid
+	rules := make([][]resigning.SigningRule, len(managers))
+	for idx, m := range managers {
+		if rules[idx], err = resigning.ConfigRules(s.l, m.config); err != nil {
+			return err
+		}
+		if _, err := resigning.NewManager(zap.NewNop(), rules[idx], privateKeys, publicKeys, revoked); err != nil {
+			return err
+		}
+	}
+	applyHooks := []func(){}
+	for _, hook := range hooks {
+		apply, err := hook(privateKeys, publicKeys, revoked)
+		if err != nil {
+			return err
+		}
+		applyHooks = append(applyHooks, apply)
+	}
+
+	for idx, m := range managers {
+		if err := m.manager.Reload(rules[idx], privateKeys, publicKeys, revoked); err != nil {
+			// Can't happen since the same rules and keys were just checked
+			return err
+		}
+	}
+	for _, apply := range applyHooks {
+		apply()
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.privateKeys = privateKeys
+	s.publicKeys = publicKeys
+	s.revoked = revoked
+	return nil
+}
+
+// reloadAndLog reloads and logs the outcome
+func (s *signingReloader) reloadAndLog(reason string) {
+	if err := s.Reload(); err != nil {
+		s.l.Error("Error reloading keys and signing rules - keeping the current ones",
+			zap.String("reason", reason), zap.Error(err))
+		return
+	}
+	privateKeys, publicKeys := s.Keys()
+	revoked := s.Revoked()
+	s.l.Info("Reloaded keys and signing rules", zap.String("reason", reason),
+		zap.Int("private_keys_count", len(privateKeys)), zap.Int("public_keys_count", len(publicKeys)),
+		zap.Int("revoked_keys_count", len(revoked.Names)+len(revoked.Keys)))
+}
+
+// watchedFiles are the files a reload reads
+func (s *signingReloader) watchedFiles() []string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	files := append([]string{}, CLI.PrivateKeyFiles...)
+	files = append(files, CLI.PublicKeyFiles...)
+	files = append(files, CLI.RevokedKeyFiles...)
+	for _, m := range s.managers {
+		files = append(files, m.config.SigningMapFile, m.config.SigningRulesFile)
+	}
+	return lo.Uniq(lo.Compact(files))
+}
+
+// fileState is what the file watcher compares to detect changes
+type fileState struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+func statFiles(files []string) map[string]fileState {
+	states := map[string]fileState{}
+	for _, file := range files {
+		st, err := os.Stat(file)
+		if err != nil {
+			states[file] = fileState{}
+			continue
+		}
+		states[file] = fileState{modTime: st.ModTime(), size: st.Size(), exists: true}
+	}
+	return states
+}
+
+// Watch starts polling the watched files in the background, and reloads when any of them change
+// from how they are now, until ctx is cancelled. Files being rewritten may be caught half
+// written, but then the reload fails and the next change is picked up. The returned channel is
+// closed when polling stops.
+func (s *signingReloader) Watch(ctx context.Context, interval time.Duration) <-chan struct{} {
+	states := statFiles(s.watchedFiles())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				newStates := statFiles(s.watchedFiles())
+				changed := lo.Filter(lo.Keys(newStates), func(file string, _ int) bool {
+					return newStates[file] != states[file]
+				})
+				states = newStates
+				if len(changed) > 0 {
+					s.l.Info("Key or signing rule files changed", zap.Strings("files", changed))
+					s.reloadAndLog("file_changed")
+				}
+			}
+		}
+	}()
+	return done
+}
+
+// startReloading reloads on SIGHUP, and when files change if an interval is set. The returned
+// function is for listenAndServe's SIGHUP handler.
+func (s *signingReloader) startReloading(ctx context.Context, config ReloadConfig) func() {
+	if config.ReloadInterval > 0 {
+		s.l.Info("Watching key and signing rule files for changes", zap.Duration("reload_interval", config.ReloadInterval))
+		s.Watch(ctx, config.ReloadInterval)
+	}
+	return func() { s.reloadAndLog("sighup") }
+}
@@ -0,0 +1,105 @@
+package entrypoint
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"github.com/wrouesnel/nix-sigman/pkg/resigning"
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+)
+
+// ReloadSuite checks keys and signing maps are reloaded together
+type ReloadSuite struct {
+	dir            string
+	privateKeyFile string
+	signingMapFile string
+	config         resigning.ResigningConfig
+}
+
+var _ = Suite(&ReloadSuite{})
+
+func (s *ReloadSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.privateKeyFile = filepath.Join(s.dir, "private.key")
+	s.signingMapFile = filepath.Join(s.dir, "signing.map")
+	s.config = resigning.ResigningConfig{SigningMapFile: s.signingMapFile}
+	CLI.PrivateKeyFiles = []string{s.privateKeyFile}
+}
+
+func (s *ReloadSuite) TearDownTest(c *C) {
+	CLI.PrivateKeyFiles = nil
+}
+
+// writeKey writes a new private key file and a signing map which signs everything with it
+func (s *ReloadSuite) writeKey(c *C, name string) {
+	key, err := nixtypes.GeneratePrivateKey(name)
+	c.Assert(err, IsNil)
+	c.Assert(os.WriteFile(s.privateKeyFile, []byte(key.String()+"\n"), 0o600), IsNil)
+	c.Assert(os.WriteFile(s.signingMapFile, []byte("="+name+"\n"), 0o600), IsNil)
+}
+
+func (s *ReloadSuite) signedWith(c *C, manager *resigning.Manager) []string {
+	decision, err := manager.Resign(context.Background(), &nixtypes.NarInfo{
+		StorePath: "/nix/store/58br4vk3q5akf4g8lx0pqzfhn47k3j8d-hello-2.12",
+		URL:       "nar/test.nar",
+		NarHash:   nixtypes.TypedNixHash{HashName: "sha256", Hash: make([]byte, 32)},
+		Extra:     map[string]string{},
+	})
+	c.Assert(err, IsNil)
+	return decision.SignedWith()
+}
+
+func (s *ReloadSuite) TestReload(c *C) {
+	s.writeKey(c, "internal-1")
+	keys, err := newSigningReloader(zap.NewNop())
+	c.Assert(err, IsNil)
+	manager, err := keys.Manager(&s.config)
+	c.Assert(err, IsNil)
+	c.Check(s.signedWith(c, manager), DeepEquals, []string{"internal-1"})
+
+	s.writeKey(c, "internal-2")
+	c.Assert(keys.Reload(), IsNil)
+	c.Check(s.signedWith(c, manager), DeepEquals, []string{"internal-2"})
+	privateKeys, _ := keys.Keys()
+	c.Assert(privateKeys, HasLen, 1)
+	c.Check(privateKeys[0].KeyName, Equals, "internal-2")
+
+	// A signing map naming a key which isn't loaded leaves everything as it was
+	c.Assert(os.WriteFile(s.signingMapFile, []byte("=internal-3\n"), 0o600), IsNil)
+	c.Check(keys.Reload(), NotNil)
+	c.Check(s.signedWith(c, manager), DeepEquals, []string{"internal-2"})
+
+	// As does a key file which doesn't parse
+	c.Assert(os.WriteFile(s.privateKeyFile, []byte("not a key\n"), 0o600), IsNil)
+	c.Check(keys.Reload(), NotNil)
+	privateKeys, _ = keys.Keys()
+	c.Check(privateKeys[0].KeyName, Equals, "internal-2")
+}
+
+func (s *ReloadSuite) TestWatch(c *C) {
+	s.writeKey(c, "internal-1")
+	keys, err := newSigningReloader(zap.NewNop())
+	c.Assert(err, IsNil)
+	manager, err := keys.Manager(&s.config)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := keys.Watch(ctx, 10*time.Millisecond)
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The new key name changes the file sizes, so the change is seen even if the modification
+	// time doesn't
+	s.writeKey(c, "internal-rotated")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && manager.Rules()[0].SignWith[0] != "internal-rotated" {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(s.signedWith(c, manager), DeepEquals, []string{"internal-rotated"})
+}
@@ -0,0 +1,216 @@
+package entrypoint
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/chigopher/pathlib"
+	"go.uber.org/zap"
+)
+
+//nolint:gochecknoglobals
+type ReshardConfig struct {
+	ShardLevels int    `help:"Number of directory levels to shard NAR files into (0 to flatten)" default:"2"`
+	NarDir      string `help:"Directory under the root NAR files are stored in" default:"nar"`
+	DryRun      bool   `help:"Only report what would be moved"`
+	Root        string `arg:"" help:"Root path of the binary cache"`
+}
+
+// Reshard migrates the NAR files of a binary cache into a (possibly different) sharded layout.
+// NARs are copied to their new location, then the narinfo is updated, and only once no narinfo
+// still points at an old NAR is it removed so a live cache never serves a dangling narinfo.
+func Reshard(cmdCtx *CmdContext) error {
+	l := cmdCtx.logger
+
+	if err := validateShardLevels(CLI.Reshard.ShardLevels); err != nil {
+		return errors.Join(&ErrCommand{}, err)
+	}
+
+	rootDir := pathlib.NewPath(NormalizeOutputDir(CLI.Reshard.Root), pathlib.PathWithAfero(cmdCtx.fs)).Clean()
+	l.Info("Reading directory (this may take a while)", zap.String("root", rootDir.String()))
+	ninfoPaths, err := listNarInfos(rootDir)
+	if err != nil {
+		return errors.Join(&ErrCommand{}, err)
+	}
+
+	var reshardErr error
+	moved := 0
+	wouldMove := 0
+	unchanged := 0
+	failed := 0
+	// Every NAR still referenced by a narinfo, and the NARs narinfo files were moved away from
+	referencedNars := map[string]struct{}{}
+	oldNars := map[string]*pathlib.Path{}
+	// If a narinfo can't be read, or the run is interrupted, it isn't known which NARs are still
+	// referenced so none are removed.
+	referencesKnown := true
+	for _, ninfoPath := range ninfoPaths {
+		if err := cmdCtx.ctx.Err(); err != nil {
+			l.Warn("Context closed during iteration", zap.String("msg", err.Error()))
+			reshardErr = errors.Join(reshardErr, err)
+			referencesKnown = false
+			break
+		}
+		l := l.With(zap.String("path", ninfoPath.String()))
+
+		narPath, oldNarPath, err := reshardNarInfo(l, ninfoPath)
+		if narPath != nil {
+			referencedNars[narPath.String()] = struct{}{}
+		}
+		switch {
+		case err != nil:
+			l.Error("Error during resharding", zap.Error(err))
+			reshardErr = errors.Join(reshardErr, &ErrNinfo{Path: ninfoPath}, err)
+			failed++
+			if narPath == nil {
+				referencesKnown = false
+			}
+		case oldNarPath == nil:
+			unchanged++
+		case CLI.Reshard.DryRun:
+			wouldMove++
+		default:
+			moved++
+			oldNars[oldNarPath.String()] = oldNarPath
+		}
+	}
+
+	if len(oldNars) > 0 && !referencesKnown {
+		l.Warn("Not removing old NAR files since not every narinfo file was read - run gc to remove them",
+			zap.Int("num_old_nars", len(oldNars)))
+	} else {
+		for oldNarName, oldNarPath := range oldNars {
+			if _, found := referencedNars[oldNarName]; found {
+				continue
+			}
+			l.Debug("Removing old NAR file", zap.String("nar_path", oldNarName))
+			if err := oldNarPath.Remove(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				l.Warn("Could not remove old NAR file", zap.String("nar_path", oldNarName), zap.Error(err))
+			}
+		}
+	}
+
+	if CLI.Reshard.DryRun {
+		l.Info("Resharded cache (dry run)", zap.Int("would_move", wouldMove), zap.Int("unchanged", unchanged), zap.Int("failed", failed))
+		fmt.Fprintf(cmdCtx.stdOut, "would_move:%d unchanged:%d failed:%d\n", wouldMove, unchanged, failed)
+	} else {
+		l.Info("Resharded cache", zap.Int("moved", moved), zap.Int("unchanged", unchanged), zap.Int("failed", failed))
+		fmt.Fprintf(cmdCtx.stdOut, "moved:%d unchanged:%d failed:%d\n", moved, unchanged, failed)
+	}
+
+	if reshardErr != nil {
+		return errors.Join(&ErrCommand{}, reshardErr)
+	}
+	return nil
+}
+
+// reshardNarInfo moves the NAR of a single narinfo file into the configured layout. It returns
+// the NAR the narinfo references afterwards (nil if that isn't known), and the NAR it was moved
+// away from (nil if it wasn't moved). The old NAR isn't removed, since other narinfo files may
+// still reference it.
+func reshardNarInfo(l *zap.Logger, ninfoPath *pathlib.Path) (*pathlib.Path, *pathlib.Path, error) {
+	ninfo, err := loadNarInfo(l, ninfoPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	narURL, err := url.Parse(ninfo.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if narURL.IsAbs() || narURL.Host != "" || path.IsAbs(narURL.Path) || strings.HasPrefix(path.Clean(narURL.Path), "..") {
+		l.Warn("Skipping narinfo with a non-relative NAR URL", zap.String("url", ninfo.URL))
+		return nil, nil, nil
+	}
+	sourcePath := ninfoPath.Parent().Join(narURL.Path).Clean()
+
+	targetURL := path.Join(CLI.Reshard.NarDir, shardedName(path.Base(narURL.Path), CLI.Reshard.ShardLevels))
+	if path.Clean(narURL.Path) == targetURL {
+		l.Debug("NAR is already in the requested layout")
+		return sourcePath, nil, nil
+	}
+
+	l = l.With(zap.String("url", ninfo.URL), zap.String("target_url", targetURL))
+	if CLI.Reshard.DryRun {
+		l.Info("Would move NAR file")
+		return sourcePath, sourcePath, nil
+	}
+
+	targetPath := ninfoPath.Parent().Join(targetURL).Clean()
+
+	sourceExists, err := sourcePath.Exists()
+	if err != nil {
+		return sourcePath, nil, err
+	}
+	targetExists, err := targetPath.Exists()
+	if err != nil {
+		return sourcePath, nil, err
+	}
+
+	switch {
+	case !targetExists && sourceExists:
+		if err := copyFile(l, sourcePath, targetPath); err != nil {
+			return sourcePath, nil, err
+		}
+	case !targetExists:
+		l.Error("NAR file is missing from both the current and target locations")
+		return sourcePath, nil, errors.New("NAR file not found")
+	default:
+		// Another narinfo referencing the same NAR may have moved it already
+		l.Debug("NAR already exists at target location")
+	}
+
+	ninfo.URL = targetURL
+	if err := writeNInfo(l, ninfoPath, ninfo); err != nil {
+		// The narinfo may still point at the old NAR, so it must be kept
+		return sourcePath, nil, err
+	}
+
+	l.Info("Moved NAR file")
+	return targetPath, sourcePath, nil
+}
+
+// copyFile copies src to dest, creating parent directories as needed. On failure the
+// destination is removed.
+func copyFile(l *zap.Logger, src *pathlib.Path, dest *pathlib.Path) error {
+	srcFh, err := src.Open()
+	if err != nil {
+		return err
+	}
+	defer srcFh.Close()
+	return writeFileFrom(l, dest, srcFh)
+}
+
+// writeFileFrom writes everything read from rd to dest, creating parent directories as needed.
+// If reading or writing fails the destination is removed.
+func writeFileFrom(l *zap.Logger, dest *pathlib.Path, rd io.Reader) error {
+	if err := dest.Parent().MkdirAllMode(os.FileMode(0755)); err != nil {
+		l.Warn("Could not create parent directory", zap.Error(err))
+	}
+
+	destFh, err := dest.OpenFile(os.O_CREATE | os.O_WRONLY | os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(destFh, rd)
+	if err != nil {
+		// Don't let streaming backends publish a truncated file
+		abortWrite(destFh, err)
+	} else {
+		err = destFh.Close()
+	}
+	if err != nil {
+		l.Debug("Attempting to remove partially written file")
+		if err := dest.Remove(); err != nil {
+			l.Error("Could not remove partially written file", zap.Error(err))
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package entrypoint
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/chigopher/pathlib"
+	"github.com/spf13/afero"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+)
+
+// ReshardSuite checks NARs are moved into the sharded layout without leaving dangling narinfos
+type ReshardSuite struct {
+	fs     afero.Fs
+	root   *pathlib.Path
+	stdOut *bytes.Buffer
+}
+
+var _ = Suite(&ReshardSuite{})
+
+func (s *ReshardSuite) SetUpTest(c *C) {
+	s.fs = afero.NewMemMapFs()
+	s.root = pathlib.NewPath("/cache", pathlib.PathWithAfero(s.fs))
+	s.stdOut = &bytes.Buffer{}
+	CLI.Reshard = ReshardConfig{ShardLevels: 2, NarDir: "nar", Root: "/cache"}
+}
+
+func (s *ReshardSuite) TearDownTest(c *C) {
+	CLI.Reshard = ReshardConfig{}
+}
+
+func (s *ReshardSuite) cmdCtx() *CmdContext {
+	return &CmdContext{logger: zap.NewNop(), ctx: context.Background(), stdOut: s.stdOut, fs: s.fs}
+}
+
+// writeCachePath writes a narinfo for the hash part referencing a NAR at narURL, and writes the
+// NAR if it is non-nil.
+func writeCachePath(c *C, root *pathlib.Path, hashPart string, narURL string, narBytes []byte) nixtypes.NarInfo {
+	narHash := sha256.Sum256(narBytes)
+	typedHash := nixtypes.TypedNixHash{HashName: "sha256", Hash: narHash[:]}
+	ninfo := nixtypes.NarInfo{
+		StorePath:   fmt.Sprintf("/nix/store/%s-test", hashPart),
+		URL:         narURL,
+		Compression: "none",
+		FileHash:    typedHash,
+		FileSize:    uint64(len(narBytes)),
+		NarHash:     typedHash,
+		NarSize:     uint64(len(narBytes)),
+		References:  []string{},
+		Extra:       map[string]string{},
+	}
+	if narBytes != nil {
+		narPath := root.Join(narURL)
+		c.Assert(narPath.Parent().MkdirAll(), IsNil)
+		c.Assert(narPath.WriteFile(narBytes), IsNil)
+	}
+	c.Assert(writeNInfo(zap.NewNop(), root.Join(fmt.Sprintf("%s.narinfo", hashPart)), ninfo), IsNil)
+	return ninfo
+}
+
+func randomNar(c *C) []byte {
+	narBytes := make([]byte, 1024)
+	_, err := rand.Read(narBytes)
+	c.Assert(err, IsNil)
+	return narBytes
+}
+
+func (s *ReshardSuite) TestSharedNar(c *C) {
+	const otherHashPart = "1b8m1dp0ln4rlvkbi7zyb5yvvfzwhbsm"
+	narBytes := randomNar(c)
+	narName := "0a4kp1pbn2k4p5h5j1hr2d7xv8y3qmnlwmk9a1c6b3x2h0f8z5s.nar"
+	writeCachePath(c, s.root, testHashPart, "nar/"+narName, narBytes)
+	writeCachePath(c, s.root, otherHashPart, "nar/"+narName, nil)
+
+	CLI.Reshard.DryRun = true
+	c.Assert(Reshard(s.cmdCtx()), IsNil)
+	c.Check(s.stdOut.String(), Equals, "would_move:2 unchanged:0 failed:0\n")
+	exists, err := s.root.Join("nar", narName).Exists()
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, true)
+
+	CLI.Reshard.DryRun = false
+	s.stdOut.Reset()
+	c.Assert(Reshard(s.cmdCtx()), IsNil)
+	c.Check(s.stdOut.String(), Equals, "moved:2 unchanged:0 failed:0\n")
+
+	shardedURL := "nar/" + shardedName(narName, 2)
+	for _, hashPart := range []string{testHashPart, otherHashPart} {
+		ninfo, err := loadNarInfo(zap.NewNop(), s.root.Join(fmt.Sprintf("%s.narinfo", hashPart)))
+		c.Assert(err, IsNil)
+		c.Check(ninfo.URL, Equals, shardedURL)
+	}
+	storedNar, err := s.root.Join(shardedURL).ReadFile()
+	c.Assert(err, IsNil)
+	c.Check(storedNar, DeepEquals, narBytes)
+	exists, err = s.root.Join("nar", narName).Exists()
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, false)
+}
+
+func (s *ReshardSuite) TestKeepsNarsWhenNarInfoUnreadable(c *C) {
+	narName := "0a4kp1pbn2k4p5h5j1hr2d7xv8y3qmnlwmk9a1c6b3x2h0f8z5s.nar"
+	writeCachePath(c, s.root, testHashPart, "nar/"+narName, randomNar(c))
+	// This narinfo might reference the same NAR, but it can't be told
+	c.Assert(s.root.Join("1b8m1dp0ln4rlvkbi7zyb5yvvfzwhbsm.narinfo").WriteFile([]byte("not a narinfo")), IsNil)
+
+	c.Check(Reshard(s.cmdCtx()), NotNil)
+	c.Check(s.stdOut.String(), Equals, "moved:1 unchanged:0 failed:1\n")
+	exists, err := s.root.Join("nar", narName).Exists()
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, true)
+}
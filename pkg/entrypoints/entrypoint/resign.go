@@ -0,0 +1,134 @@
+package entrypoint
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/chigopher/pathlib"
+	"github.com/fatih/color"
+	"github.com/wrouesnel/nix-sigman/pkg/resigning"
+	"go.uber.org/zap"
+)
+
+//nolint:gochecknoglobals
+type ResignConfig struct {
+	resigning.ResigningConfig `embed:""`
+	Explain                   struct {
+		Format       string   `help:"Output format (${enum})" enum:"text,json" default:"text"`
+		NarInfoFiles []string `arg:"" help:"NARInfo files to explain - specify - to read list from stdin"`
+	} `cmd:"" help:"Explain which signing rules match NARInfo files, without changing them"`
+}
+
+// decisionHeader is the proxy debug header which explains the resigning decision for a narinfo
+const decisionHeader = "X-Nix-Sigman-Decision"
+
+// explainResult is the JSON output of resign explain
+type explainResult struct {
+	Path string `json:"path"`
+	resigning.Decision
+}
+
+// ResignExplain evaluates the signing rules against NARInfo files and reports every decision
+func ResignExplain(cmdCtx *CmdContext) error {
+	l := cmdCtx.logger
+
+	privateKeys, err := loadPrivateKeys(l)
+	if err != nil {
+		l.Error("Error loading private keys", zap.Error(err))
+		return errors.Join(&ErrCommand{}, err)
+	}
+
+	publicKeys, err := loadPublicKeys(l)
+	if err != nil {
+		l.Error("Error loading public keys", zap.Error(err))
+		return errors.Join(&ErrCommand{}, err)
+	}
+
+	revoked, err := loadRevocations(l)
+	if err != nil {
+		l.Error("Error loading revoked keys", zap.Error(err))
+		return errors.Join(&ErrCommand{}, err)
+	}
+
+	signers, err := resigning.LoadManager(l, &CLI.Resign.ResigningConfig, privateKeys, publicKeys, revoked)
+	if err != nil {
+		l.Error("Error loading signing rules", zap.Error(err))
+		return errors.Join(&ErrCommand{}, err)
+	}
+
+	return readPaths(cmdCtx, CLI.Resign.Explain.NarInfoFiles, func(path *pathlib.Path) error {
+		l := cmdCtx.logger.With(zap.String("path", path.String()))
+
+		ninfo, err := loadNarInfo(l, path)
+		if err != nil {
+			l.Warn("Could not load narinfo file", zap.Error(err))
+			return nil
+		}
+
+		// The narinfo is signed in memory only, so the decision reflects what proxy or serve would do
+		decision, signErr := signers.Resign(cmdCtx.ctx, &ninfo)
+
+		if CLI.Resign.Explain.Format == "json" {
+			content, err := json.Marshal(explainResult{Path: path.String(), Decision: decision})
+			if err != nil {
+				return err
+			}
+			cmdCtx.stdOut.Write(append(content, '\n'))
+			return nil
+		}
+
+		status := color.WhiteString("NOMATCH")
+		switch {
+		case signErr != nil:
+			status = color.RedString("FAILSIGN")
+		case decision.Signed:
+			status = color.YellowString("SIGNED")
+		}
+		cmdCtx.stdOut.Write([]byte(fmt.Sprintf("%s:%s:%s\n", color.CyanString(path.String()), status,
+			strings.Join(decision.SignedWith(), " "))))
+		if len(decision.RevokedSignatures) > 0 {
+			cmdCtx.stdOut.Write([]byte(fmt.Sprintf("  %s:%s\n", color.RedString("REVOKED"),
+				strings.Join(decision.RevokedSignatures, " "))))
+		}
+		for _, rule := range decision.Rules {
+			cmdCtx.stdOut.Write([]byte(fmt.Sprintf("  %s\n", formatRuleDecision(rule))))
+		}
+		if signErr != nil {
+			cmdCtx.stdOut.Write([]byte(fmt.Sprintf("  %s\n", color.RedString(signErr.Error()))))
+		}
+		return nil
+	})
+}
+
+// formatRuleDecision formats a rule decision as a single line
+func formatRuleDecision(rule resigning.RuleDecision) string {
+	status := color.WhiteString("NOMATCH")
+	if rule.Matched {
+		status = color.GreenString("MATCHED")
+	}
+	line := fmt.Sprintf("%s:%s:%s", rule.Rule, status, rule.Reason)
+	for _, keys := range []struct {
+		name string
+		keys []string
+	}{
+		{"verified", rule.VerifiedKeys},
+		{"failed", rule.FailedKeys},
+		{"signed", rule.SignedWith},
+	} {
+		if len(keys.keys) > 0 {
+			line += fmt.Sprintf(" %s=%s", keys.name, strings.Join(keys.keys, ","))
+		}
+	}
+	return line
+}
+
+// decisionHeaderValue encodes a decision as a single line of JSON for the decision header
+func decisionHeaderValue(decision resigning.Decision) string {
+	content, err := json.Marshal(decision)
+	if err != nil {
+		return ""
+	}
+	return string(content)
+}
@@ -2,7 +2,6 @@ package entrypoint
 
 import (
 	"bytes"
-	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -10,26 +9,29 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/MadAppGang/httplog"
 	lzap "github.com/MadAppGang/httplog/zap"
 	"github.com/chigopher/pathlib"
-	mapset "github.com/deckarep/golang-set/v2"
 	"github.com/julienschmidt/httprouter"
 	"github.com/samber/lo"
 	"github.com/spf13/afero"
-	"github.com/wrouesnel/multihttp"
 	"github.com/wrouesnel/nix-sigman/pkg/nixstore"
 	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
 	"github.com/wrouesnel/nix-sigman/pkg/resigning"
 	"go.uber.org/zap"
-	"go.withmatt.com/httpheaders"
 	_ "modernc.org/sqlite"
 )
 
 type ServeConfig struct {
 	resigning.ResigningConfig `embed:""`
+	TLSConfig                 `embed:""`
+	MetricsConfig             `embed:""`
+	HealthConfig              `embed:""`
+	ShutdownConfig            `embed:""`
+	ReloadConfig              `embed:""`
 	Listen                    []string `help:"Listen addresses" default:"tcp://127.0.0.1:8081"`
 	Root                      string   `help:"Root to search for a nix store" default:"/"`
 	NixDB                     *string  `help:"Override the database location"`
@@ -84,47 +86,30 @@ func Serve(cmdCtx *CmdContext) error {
 		return err
 	}
 
-	l.Debug("Loading private keys")
-	privateKeys, err := loadPrivateKeys(cmdCtx.logger)
+	keys, err := newSigningReloader(l)
 	if err != nil {
-		cmdCtx.logger.Error("Error loading private keys", zap.Error(err))
 		return errors.Join(&ErrCommand{}, err)
 	}
 
-	l.Debug("Loading public keys")
-	publicKeys, err := loadPublicKeys(cmdCtx.logger)
+	l.Debug("Load signing map")
+	signers, err := keys.Manager(&CLI.Serve.ResigningConfig)
 	if err != nil {
-		cmdCtx.logger.Error("Error loading public keys", zap.Error(err))
 		return errors.Join(&ErrCommand{}, err)
 	}
-
-	l.Debug("Load signing map")
-	signers, err := resigning.LoadSigningMap(l,
-		&CLI.Serve.ResigningConfig,
-		privateKeys,
-		publicKeys,
-	)
+	_, publicKeys := keys.Keys()
+	requiredSigs, err := requiredSignatureKeys(l, CLI.Serve.RequiredSignatures, publicKeys, keys.Revoked())
 	if err != nil {
 		return errors.Join(&ErrCommand{}, err)
 	}
 
-	requiredSigs := mapset.NewSet[string](CLI.Serve.RequiredSignatures...)
-	for _, sigName := range CLI.Serve.RequiredSignatures {
-		if !requiredSigs.Contains(sigName) {
-			l.Error("Required signature is not configured as a public key", zap.String("keyname", sigName))
-			return errors.Join(&ErrCommand{}, errors.New("required signature not configured as public signature"))
-		}
-	}
-
 	handlerConfig := &NixHandlerConfig{
-		StorePath:     storePath,
-		WantMassQuery: CLI.Serve.WantMassQuery,
-		Priority:      CLI.Serve.Priority,
-		RequiredSignatures: lo.FilterSliceToMap(publicKeys, func(item nixtypes.NamedPublicKey) (string, nixtypes.NamedPublicKey, bool) {
-			return item.KeyName, item, requiredSigs.Contains(item.KeyName)
-		}),
-		StartTime: startTime,
+		StorePath:          storePath,
+		WantMassQuery:      CLI.Serve.WantMassQuery,
+		Priority:           CLI.Serve.Priority,
+		RequiredSignatures: requiredSigs,
+		StartTime:          startTime,
 	}
+	keys.AddHook(reloadRequiredSignatures(l, CLI.Serve.RequiredSignatures, handlerConfig))
 	handler := NixHandler(l, store, handlerConfig, signers)
 
 	l.Info("Starting HTTP server")
@@ -139,34 +124,17 @@ func Serve(cmdCtx *CmdContext) error {
 		},
 	)
 
-	webCtx, webCancel := context.WithCancel(cmdCtx.ctx)
-	listeners, errCh, listenerErr := multihttp.Listen(CLI.Serve.Listen, logger(router))
-	if listenerErr != nil {
-		l.Error("Error setting up listeners", zap.Error(listenerErr))
-		webCancel()
-	}
-	for _, listener := range listeners {
-		l.Info("Listening", zap.String("addr", listener.Addr().String()))
-	}
+	ready := newReadiness(CLI.Serve.HealthConfig,
+		keysCheck(keys),
+		signingMapCheck("signing_map", &CLI.Serve.ResigningConfig, signers),
+		readinessCheck{Name: "database", Check: store.Ping},
+	)
 
-	// Log errors from the listener
-	go func() {
-		listenerErrInfo := <-errCh
-		// On the first error, cancel the webCtx to shutdown
-		webCancel()
-		for {
-			l.Error("Error from listener",
-				zap.Error(listenerErrInfo.Error),
-				zap.String("listener_addr", listenerErrInfo.Listener.Addr().String()))
-			// Keep receiving the rest of the errors so we can log them
-			listenerErrInfo = <-errCh
-		}
-	}()
-	<-webCtx.Done()
-	for _, listener := range listeners {
-		if err := listener.Close(); err != nil {
-			l.Warn("Error closing listener during shutdown", zap.Error(err))
-		}
+	if err := listenAndServe(cmdCtx, CLI.Serve.ShutdownConfig, metricsEndpoints(CLI.Serve.MetricsConfig,
+		httpEndpoint{Name: "cache", Listen: CLI.Serve.Listen, TLS: CLI.Serve.TLSConfig,
+			Handler: withHealthEndpoints(ready, logger(instrumentHandler("serve", router))),
+			Reload:  keys.startReloading(cmdCtx.ctx, CLI.Serve.ReloadConfig)})...); err != nil {
+		return err
 	}
 
 	l.Info("Exiting")
@@ -184,14 +152,71 @@ type NixHandlerConfig struct {
 	WantMassQuery bool
 	Priority      int
 
+	// RequiredSignatures are the public keys a narinfo must be signed by one of to be served. If
+	// nil any narinfo is served, if empty none are.
 	RequiredSignatures map[string]nixtypes.NamedPublicKey
 
 	StartTime time.Time
+
+	// mtx guards RequiredSignatures, which are replaced when keys are reloaded
+	mtx sync.RWMutex
+}
+
+// SetRequiredSignatures replaces the required signatures while the handler is in use
+func (c *NixHandlerConfig) SetRequiredSignatures(requiredSigs map[string]nixtypes.NamedPublicKey) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.RequiredSignatures = requiredSigs
+}
+
+func (c *NixHandlerConfig) requiredSignatures() map[string]nixtypes.NamedPublicKey {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.RequiredSignatures
+}
+
+// requiredSignatureKeys looks up the required signature names in the public keys. Revoked keys are
+// left out, so if every required key is revoked nothing is served.
+func requiredSignatureKeys(l *zap.Logger, names []string, publicKeys []nixtypes.NamedPublicKey,
+	revoked nixtypes.RevocationList) (map[string]nixtypes.NamedPublicKey, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	publicKeyMap := lo.SliceToMap(publicKeys, func(item nixtypes.NamedPublicKey) (string, nixtypes.NamedPublicKey) {
+		return item.KeyName, item
+	})
+	requiredSigs := map[string]nixtypes.NamedPublicKey{}
+	for _, sigName := range names {
+		publicKey, found := publicKeyMap[sigName]
+		if !found {
+			l.Error("Required signature is not configured as a public key", zap.String("keyname", sigName))
+			return nil, errors.New("required signature not configured as public signature")
+		}
+		if revoked.IsRevoked(publicKey) {
+			l.Warn("Required signature key is revoked and will not be accepted", zap.String("keyname", sigName))
+			continue
+		}
+		requiredSigs[sigName] = publicKey
+	}
+	return requiredSigs, nil
+}
+
+// reloadRequiredSignatures returns a reloadHook which looks up the required signatures in the
+// reloaded keys, so rotated and revoked keys take effect.
+func reloadRequiredSignatures(l *zap.Logger, names []string, config *NixHandlerConfig) reloadHook {
+	return func(_ []nixtypes.NamedPrivateKey, publicKeys []nixtypes.NamedPublicKey,
+		revoked nixtypes.RevocationList) (func(), error) {
+		requiredSigs, err := requiredSignatureKeys(l, names, publicKeys, revoked)
+		if err != nil {
+			return nil, err
+		}
+		return func() { config.SetRequiredSignatures(requiredSigs) }, nil
+	}
 }
 
 // NixHandler implements the Nix HTTP cache handler. nixStoreRoot is used to set a LastModifiedTime for files in the store
 // corresponding to if the directory has been modified.
-func NixHandler(l *zap.Logger, store nixstore.NixStore, config *NixHandlerConfig, signers resigning.ConditionalResigners) httprouter.Handle {
+func NixHandler(l *zap.Logger, store nixstore.NixStore, config *NixHandlerConfig, signers *resigning.Manager) httprouter.Handle {
 	nixCacheInfoPath := fmt.Sprintf("/%s", NixCacheInfoName)
 
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
@@ -202,69 +227,56 @@ func NixHandler(l *zap.Logger, store nixstore.NixStore, config *NixHandlerConfig
 		// Handle the cache info response
 		if name == nixCacheInfoPath {
 			cacheInfoResp := []byte(fmt.Sprintf(NixCacheInfoTemplate, config.StorePath, lo.Ternary(config.WantMassQuery, "1", "0"), config.Priority))
-
-			w.Header().Set(httpheaders.ContentType, "text/x-nix-cache-info")
-			w.Header().Set(httpheaders.ContentLength, fmt.Sprintf("%d", len(cacheInfoResp)))
-			w.Header().Set(httpheaders.LastModified, config.StartTime.Format(http.TimeFormat))
-
-			w.WriteHeader(http.StatusOK)
-			if r.Method == http.MethodHead {
-				// HEAD - no body response
-				return
-			}
-			io.Copy(w, bytes.NewReader(cacheInfoResp))
+			serveContent(w, r, "text/x-nix-cache-info", config.StartTime, contentEtag(cacheInfoResp), bytes.NewReader(cacheInfoResp))
 			return
 		}
 
 		if strings.HasSuffix(name, ".narinfo") {
-			ninfo, registrationTime, err := store.GetNarInfo(name)
+			ninfo, _, err := store.GetNarInfo(name)
 			if err != nil {
 				if _, found := errors.AsType[*nixstore.ErrNotFound](err); found {
 					w.WriteHeader(http.StatusNotFound)
 					w.Write([]byte(fmt.Sprintf("not found: %s\n", name)))
 					return
 				}
+				l.Warn("Error reading from the nix store", zap.Error(err))
+				observeBackendError("serve", "get_narinfo")
 				w.WriteHeader(http.StatusInternalServerError)
 				w.Write([]byte(fmt.Sprintf("error: %s\n", name)))
 				return
 			}
 
 			if signers != nil {
-				if _, err := signers.MaybeResign(l, &ninfo); err != nil {
+				decision, err := signers.Resign(r.Context(), &ninfo)
+				observeResign("serve", decision, err)
+				if err != nil {
 					l.Warn("Signing Error", zap.String("error", err.Error()))
 				}
 			}
 
-			if config.RequiredSignatures != nil {
-				if len(config.RequiredSignatures) > 0 {
-					verified := false
-					for _, publicKey := range config.RequiredSignatures {
-						if verified, _ = ninfo.Verify(publicKey); verified {
-							break
-						}
-					}
-					if !verified {
-						w.WriteHeader(http.StatusNotFound)
-						w.Write([]byte(fmt.Sprintf("not found (invalid signatures): %s\n", name)))
-						return
+			if requiredSigs := config.requiredSignatures(); requiredSigs != nil {
+				verified := false
+				for _, publicKey := range requiredSigs {
+					if verified, _ = ninfo.Verify(publicKey); verified {
+						break
 					}
 				}
+				if !verified {
+					w.WriteHeader(http.StatusNotFound)
+					w.Write([]byte(fmt.Sprintf("not found (invalid signatures): %s\n", name)))
+					return
+				}
 			}
 
 			content, err := ninfo.MarshalText()
-			w.Header().Set(httpheaders.ContentLength, fmt.Sprintf("%d", len(content)))
-			if registrationTime.After(config.StartTime) {
-				w.Header().Set(httpheaders.LastModified, registrationTime.Format(http.TimeFormat))
-			} else {
-				w.Header().Set(httpheaders.LastModified, config.StartTime.Format(http.TimeFormat))
-			}
-			w.Header().Set(httpheaders.ContentType, "text/x-nix-narinfo")
-			w.WriteHeader(http.StatusOK)
-			if r.Method == http.MethodHead {
-				// HEAD - no body response
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(fmt.Sprintf("error: %s\n", name)))
 				return
 			}
-			w.Write(content)
+			// The ETag is of the resigned content, so clients revalidate when signatures change. There
+			// is no Last-Modified: signatures can change while the store path doesn't.
+			serveContent(w, r, "text/x-nix-narinfo", time.Time{}, contentEtag(content), bytes.NewReader(content))
 			return
 		}
 
@@ -281,6 +293,8 @@ func NixHandler(l *zap.Logger, store nixstore.NixStore, config *NixHandlerConfig
 				w.Write([]byte(fmt.Sprintf("not found: %s\n", name)))
 				return
 			}
+			l.Warn("Error reading from the nix store", zap.Error(err))
+			observeBackendError("serve", "get_store_path")
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(fmt.Sprintf("error: %s\n", name)))
 			return
@@ -293,19 +307,17 @@ func NixHandler(l *zap.Logger, store nixstore.NixStore, config *NixHandlerConfig
 				w.Write([]byte(fmt.Sprintf("not found: %s\n", name)))
 				return
 			}
+			l.Warn("Error reading from the nix store", zap.Error(err))
+			observeBackendError("serve", "get_nar")
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(fmt.Sprintf("error: %s\n", name)))
 			return
 		}
-		w.Header().Set(httpheaders.ContentLength, fmt.Sprintf("%d", ninfo.FileSize))
-		w.Header().Set(httpheaders.LastModified, registrationTime.Format(http.TimeFormat))
-		w.Header().Set(httpheaders.Etag, ninfo.FileHash.String())
-		w.WriteHeader(http.StatusOK)
-		if r.Method == http.MethodHead {
-			// HEAD - no bodyresponse
-			return
-		}
-		io.Copy(w, rdr)
+		defer rdr.Close()
+		// NARs are generated as a stream, so a Range request regenerates and discards the part
+		// of the NAR before the range.
+		serveContent(w, r, "application/x-nix-nar", registrationTime, fmt.Sprintf("\"%s\"", ninfo.FileHash.String()),
+			newStreamSeeker(rdr, int64(ninfo.FileSize)))
 		return
 	}
 }
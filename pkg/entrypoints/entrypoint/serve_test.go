@@ -0,0 +1,141 @@
+package entrypoint
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/nix-sigman/pkg/nixstore"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+)
+
+// fakeNixStore serves a single narinfo registered at a fixed time
+type fakeNixStore struct {
+	ninfo            nixtypes.NarInfo
+	registrationTime time.Time
+}
+
+func (f *fakeNixStore) GetNarInfo(path string) (nixtypes.NarInfo, time.Time, error) {
+	if path != fmt.Sprintf("/%s.narinfo", f.ninfo.NixHash()) {
+		return nixtypes.NarInfo{}, time.Time{}, &nixstore.ErrNotFound{HashName: path}
+	}
+	return f.ninfo, f.registrationTime, nil
+}
+
+func (f *fakeNixStore) GetNar(path string) (io.ReadCloser, *nixtypes.NarInfo, time.Time, error) {
+	return nil, nil, time.Time{}, &nixstore.ErrNotFound{HashName: path}
+}
+
+func (f *fakeNixStore) GetStorePathByFileHash(fileHash string) (string, error) {
+	return "", &nixstore.ErrNotFound{HashName: fileHash}
+}
+
+func (f *fakeNixStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// ServeSuite checks the responses of the nix store HTTP handler
+type ServeSuite struct {
+	store  *fakeNixStore
+	config *NixHandlerConfig
+	server *httptest.Server
+}
+
+var _ = Suite(&ServeSuite{})
+
+func (s *ServeSuite) SetUpTest(c *C) {
+	s.store = &fakeNixStore{
+		ninfo: nixtypes.NarInfo{
+			StorePath:   fmt.Sprintf("/nix/store/%s-test", testHashPart),
+			URL:         fmt.Sprintf("nar/%s.nar", testHashPart),
+			Compression: "none",
+			References:  []string{},
+			Extra:       map[string]string{},
+		},
+		registrationTime: time.Now().Add(-24 * time.Hour),
+	}
+	s.config = &NixHandlerConfig{StorePath: "/nix/store", Priority: 40, StartTime: time.Now().Add(-time.Hour)}
+
+	router := httprouter.New()
+	router.GET("/*name", NixHandler(zap.NewNop(), s.store, s.config, nil))
+	s.server = httptest.NewServer(router)
+}
+
+func (s *ServeSuite) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+func (s *ServeSuite) get(c *C, name string, headers map[string]string) (*http.Response, []byte) {
+	req, err := http.NewRequest(http.MethodGet, s.server.URL+"/"+name, nil)
+	c.Assert(err, IsNil)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	return resp, body
+}
+
+func (s *ServeSuite) TestNarInfoHasNoLastModified(c *C) {
+	// The served signatures can change without the store path changing, so only the ETag revalidates
+	ninfoName := fmt.Sprintf("%s.narinfo", testHashPart)
+	resp, _ := s.get(c, ninfoName, map[string]string{
+		"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat),
+	})
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(resp.Header.Get("Last-Modified"), Equals, "")
+	c.Check(resp.Header.Get("ETag"), Not(Equals), "")
+}
+
+func (s *ServeSuite) TestRequiredSignaturesReload(c *C) {
+	key, err := nixtypes.GeneratePrivateKey("internal-1")
+	c.Assert(err, IsNil)
+	_, _, err = s.store.ninfo.Sign(key)
+	c.Assert(err, IsNil)
+
+	dir := c.MkDir()
+	publicKeyFile := filepath.Join(dir, "public.key")
+	revokedKeyFile := filepath.Join(dir, "revoked")
+	publicKey := key.PublicKey()
+	c.Assert(os.WriteFile(publicKeyFile, []byte(publicKey.String()+"\n"), 0o600), IsNil)
+	c.Assert(os.WriteFile(revokedKeyFile, []byte{}, 0o600), IsNil)
+	CLI.PublicKeyFiles = []string{publicKeyFile}
+	CLI.RevokedKeyFiles = []string{revokedKeyFile}
+	defer func() {
+		CLI.PublicKeyFiles = nil
+		CLI.RevokedKeyFiles = nil
+	}()
+
+	keys, err := newSigningReloader(zap.NewNop())
+	c.Assert(err, IsNil)
+	keys.AddHook(reloadRequiredSignatures(zap.NewNop(), []string{"internal-1"}, s.config))
+	c.Assert(keys.Reload(), IsNil)
+
+	ninfoName := fmt.Sprintf("%s.narinfo", testHashPart)
+	resp, _ := s.get(c, ninfoName, nil)
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	// Revoking the only required key means nothing verifies
+	c.Assert(os.WriteFile(revokedKeyFile, []byte("internal-1\n"), 0o600), IsNil)
+	c.Assert(keys.Reload(), IsNil)
+	resp, _ = s.get(c, ninfoName, nil)
+	c.Check(resp.StatusCode, Equals, http.StatusNotFound)
+
+	// A required key which is no longer configured leaves the current ones in place
+	c.Assert(os.WriteFile(revokedKeyFile, []byte{}, 0o600), IsNil)
+	c.Assert(os.WriteFile(publicKeyFile, []byte{}, 0o600), IsNil)
+	c.Check(keys.Reload(), NotNil)
+	resp, _ = s.get(c, ninfoName, nil)
+	c.Check(resp.StatusCode, Equals, http.StatusNotFound)
+}
@@ -0,0 +1,59 @@
+package entrypoint
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// shardCharsPerLevel is the number of leading characters of a file name used for each directory
+// level of a sharded layout.
+const shardCharsPerLevel = 2
+
+// maxShardLevels bounds the sharding depth. Beyond this nearly every directory holds a single file.
+const maxShardLevels = 4
+
+type ErrInvalidShardLevels struct {
+	Levels int
+}
+
+func (e ErrInvalidShardLevels) Error() string {
+	return fmt.Sprintf("shard levels must be between 0 and %d: got %d", maxShardLevels, e.Levels)
+}
+
+// validateShardLevels checks a shard level setting is usable
+func validateShardLevels(levels int) error {
+	if levels < 0 || levels > maxShardLevels {
+		return &ErrInvalidShardLevels{Levels: levels}
+	}
+	return nil
+}
+
+// shardedName returns the path of a file name within a sharded directory tree,
+// e.g. abcdef.nar.xz with 2 levels is ab/cd/abcdef.nar.xz. Names too short to shard are
+// returned unchanged.
+func shardedName(name string, levels int) string {
+	parts := []string{}
+	for i := 0; i < levels && (i+1)*shardCharsPerLevel < len(name); i++ {
+		parts = append(parts, name[i*shardCharsPerLevel:(i+1)*shardCharsPerLevel])
+	}
+	return path.Join(append(parts, name)...)
+}
+
+// shardNarName maps a file directly in narDir (such as the nar/<hash>.nar.xz names nix uses) to
+// its sharded location. Names elsewhere are returned unchanged, as is a leading slash.
+func shardNarName(name string, narDir string, levels int) string {
+	if levels <= 0 {
+		return name
+	}
+	cleaned := path.Clean(strings.TrimPrefix(name, "/"))
+	dir, file := path.Split(cleaned)
+	if path.Clean(dir) != path.Clean(narDir) {
+		return name
+	}
+	sharded := path.Join(dir, shardedName(file, levels))
+	if strings.HasPrefix(name, "/") {
+		return "/" + sharded
+	}
+	return sharded
+}
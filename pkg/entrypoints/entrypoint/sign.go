@@ -38,51 +38,18 @@ func Sign(cmdCtx *CmdContext) error {
 		return errors.Join(&ErrCommand{}, err)
 	}
 
-	signingKeys := []nixtypes.NamedPrivateKey{}
-	if lo.Contains(CLI.Sign.SigningKeys, "*") {
-		cmdCtx.logger.Debug("Sign with ALL private keys")
-		signingKeys = privateKeys
-	} else {
-		desiredKeyNames := lo.SliceToMap(CLI.Sign.SigningKeys, func(item string) (string, struct{}) {
-			return item, struct{}{}
-		})
-		signingKeys = lo.Filter(privateKeys, func(item nixtypes.NamedPrivateKey, index int) bool {
-			return lo.HasKey(desiredKeyNames, item.KeyName)
-		})
+	revoked, err := loadRevocations(l)
+	if err != nil {
+		cmdCtx.logger.Error("Error loading revoked keys", zap.Error(err))
+		return errors.Join(&ErrCommand{}, err)
 	}
-	l.Debug("Signing Keys Set", zap.Int("num_signing_keys", len(signingKeys)))
 
-	if len(signingKeys) == 0 {
-		return errors.Join(&ErrCommand{}, errors.New("no private keys selected"))
-	}
+	signingKeys := selectSigningKeys(l, privateKeys, CLI.Sign.SigningKeys)
+	l.Debug("Signing Keys Set", zap.Int("num_signing_keys", len(signingKeys)))
 
-	var signers resigning.ConditionalResigners
-	if len(CLI.Sign.SigningMap) > 0 || CLI.Sign.SigningMapFile != "" {
-		l.Info("Conditional resigning requested")
-		signers, err = resigning.LoadSigningMap(l,
-			&CLI.Serve.ResigningConfig,
-			privateKeys,
-			publicKeys,
-		)
-		if err != nil {
-			return errors.Join(&ErrCommand{}, err)
-		}
-	} else {
-		l.Info("Unconditional resigning requested")
-		signers = append(signers, func(ninfo *nixtypes.NarInfo) (bool, error) {
-			didSign := false
-			for _, key := range signingKeys {
-				didNewSignature, _, err := ninfo.SignReplaceByName(key)
-				if err != nil {
-					l.Warn("Error during signing", zap.Error(err))
-					return didNewSignature, err
-				}
-				if didNewSignature {
-					didSign = true
-				}
-			}
-			return didSign, nil
-		})
+	signers, err := loadSigners(l, &CLI.Sign.ResigningConfig, signingKeys, privateKeys, publicKeys, revoked)
+	if err != nil {
+		return errors.Join(&ErrCommand{}, err)
 	}
 
 	err = readPaths(cmdCtx, CLI.Sign.NarInfoFiles, func(path *pathlib.Path) error {
@@ -96,17 +63,15 @@ func Sign(cmdCtx *CmdContext) error {
 
 		// Sign the NARinfo with each key
 		errDuringSigning := false
-		didNewSignature := false
-		for _, signer := range signers {
-			didSign, err := signer(&ninfo)
-			if err != nil {
-				l.Warn("Signing Error", zap.String("error", err.Error()))
-				errDuringSigning = true
-				continue
-			}
-			if didSign {
-				didNewSignature = true
-			}
+		decision, err := signers.Resign(cmdCtx.ctx, &ninfo)
+		if err != nil {
+			l.Warn("Signing Error", zap.String("error", err.Error()))
+			errDuringSigning = true
+		}
+		// Removing signatures by revoked keys also rewrites the file
+		didNewSignature := decision.Signed || len(decision.RevokedSignatures) > 0
+		if len(decision.RevokedSignatures) > 0 {
+			l.Info("Removed signatures by revoked keys", zap.Strings("revoked_signatures", decision.RevokedSignatures))
 		}
 		if didNewSignature {
 			l.Debug("Resigned narinfo file", zap.String("name", path.Name()))
@@ -13,7 +13,7 @@ import (
 
 //nolint:gochecknoglobals
 type VerifyConfig struct {
-	ValidateHashes     bool     `help:"Validate file hashes of archive files" default:"false"`
+	ValidateHashes     bool     `help:"Validate the file and NAR hashes of archive files" default:"false"`
 	IncludePrivateKeys bool     `help:"Private Keys should also be used for trust" default:"false"`
 	TrustedKeys        []string `help:"Names of keys to verify with (default all)" default:"*"`
 	NarInfoFiles       []string `arg:"" help:"NARInfo files. - to read from stdin"`
@@ -39,6 +39,19 @@ func Verify(cmdCtx *CmdContext) error {
 		}
 	}
 
+	revoked, err := loadRevocations(cmdCtx.logger)
+	if err != nil {
+		cmdCtx.logger.Error("Error loading revoked keys", zap.Error(err))
+		return errors.Join(&ErrCommand{}, err)
+	}
+	publicKeys = lo.Filter(publicKeys, func(item nixtypes.NamedPublicKey, index int) bool {
+		if revoked.IsRevoked(item) {
+			cmdCtx.logger.Warn("Not trusting revoked key", zap.String("keyname", item.KeyName))
+			return false
+		}
+		return true
+	})
+
 	verifyKeys := []nixtypes.NamedPublicKey{}
 	if lo.Contains(CLI.Verify.TrustedKeys, "*") {
 		cmdCtx.logger.Debug("Verify against ALL public keys")
@@ -68,6 +81,11 @@ func Verify(cmdCtx *CmdContext) error {
 			return nil
 		}
 
+		// Signatures by revoked keys are never trusted, whatever name they're under
+		if removed := ninfo.RemoveRevokedSigs(revoked); len(removed) > 0 {
+			l.Debug("Ignoring signatures by revoked keys", zap.Strings("revoked_signatures", removed))
+		}
+
 		// Sign the NARinfo with each key
 		verifiedKeys := []nixtypes.NamedPublicKey{}
 		for _, key := range verifyKeys {
@@ -90,6 +108,7 @@ func Verify(cmdCtx *CmdContext) error {
 				if hashValid {
 					cmdCtx.stdOut.Write([]byte(color.GreenString("GOODHASH")))
 				} else if err != nil || !hashValid {
+					l.Warn("Hash verification failed", zap.Error(err))
 					cmdCtx.stdOut.Write([]byte(color.RedString("FAILHASH")))
 				}
 			} else {
@@ -107,6 +126,7 @@ func Verify(cmdCtx *CmdContext) error {
 				if hashValid {
 					cmdCtx.stdOut.Write([]byte(color.GreenString("Hash OK")))
 				} else if err != nil || !hashValid {
+					l.Warn("Hash verification failed", zap.Error(err))
 					cmdCtx.stdOut.Write([]byte(color.RedString("Hash Fail")))
 				}
 			}
@@ -0,0 +1,258 @@
+// Package httpcachefs adds write support to a (read-only) Nix HTTP binary cache filesystem by
+// uploading files with the standard binary cache upload protocol: a PUT of each narinfo and NAR
+// file to its path under the cache URL.
+package httpcachefs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/jdxcode/netrc"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+)
+
+var ErrNotSupported = errors.New("operation not supported by the nix HTTP cache upload protocol")
+
+type ErrUploadFailed struct {
+	Name       string
+	StatusCode int
+	Status     string
+}
+
+func (e ErrUploadFailed) Error() string {
+	return fmt.Sprintf("upload of %s failed: %s", e.Name, e.Status)
+}
+
+// HttpCacheFs serves reads from the wrapped filesystem and uploads writes to the cache URL.
+// Directories are implicit in the upload protocol, so creating them always succeeds.
+type HttpCacheFs struct {
+	afero.Fs
+	l         *zap.Logger
+	uploadUrl *url.URL
+	client    *http.Client
+	username  string
+	password  string
+}
+
+// NewHttpCacheFs wraps readFs with uploads to uploadUrl. If netrcFile is set, credentials for the
+// upload host are taken from it and sent as basic auth. A nil client uses http.DefaultClient.
+func NewHttpCacheFs(l *zap.Logger, readFs afero.Fs, uploadUrl *url.URL, netrcFile string, client *http.Client) (*HttpCacheFs, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	fs := &HttpCacheFs{
+		Fs:        readFs,
+		l:         l,
+		uploadUrl: uploadUrl,
+		client:    client,
+	}
+
+	if uploadUrl.User != nil {
+		fs.username = uploadUrl.User.Username()
+		fs.password, _ = uploadUrl.User.Password()
+	}
+
+	if netrcFile != "" {
+		n, err := netrc.Parse(netrcFile)
+		if err != nil {
+			return nil, errors.Join(errors.New("could not parse netrc file"), err)
+		}
+		if machine := n.Machine(uploadUrl.Hostname()); machine != nil {
+			fs.username = machine.Get("login")
+			fs.password = machine.Get("password")
+		} else {
+			l.Debug("No netrc entry for upload host", zap.String("host", uploadUrl.Hostname()))
+		}
+	}
+	return fs, nil
+}
+
+func (fs *HttpCacheFs) Name() string {
+	return "HttpCacheFs"
+}
+
+// contentType returns the content type nix uses when uploading a file of this name
+func contentType(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".narinfo"):
+		return "text/x-nix-narinfo"
+	case strings.HasSuffix(name, ".ls"):
+		return "application/json"
+	case name == "nix-cache-info":
+		return "text/x-nix-cache-info"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// put uploads the content of body to name under the cache URL
+func (fs *HttpCacheFs) put(name string, body io.Reader) error {
+	target := fs.uploadUrl.JoinPath(path.Clean("/" + name))
+	target.User = nil
+
+	req, err := http.NewRequest(http.MethodPut, target.String(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType(path.Base(name)))
+	if fs.username != "" || fs.password != "" {
+		req.SetBasicAuth(fs.username, fs.password)
+	}
+
+	fs.l.Debug("Uploading file", zap.String("url", target.String()))
+	resp, err := fs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &ErrUploadFailed{Name: name, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return nil
+}
+
+func (fs *HttpCacheFs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+}
+
+// OpenFile passes read-only opens through to the wrapped filesystem. Opening for writing starts an
+// upload which completes when the file is closed - appending is not possible.
+func (fs *HttpCacheFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		return fs.Fs.OpenFile(name, flag, perm)
+	}
+	if flag&os.O_APPEND != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrNotSupported}
+	}
+	return newUploadFile(fs, name), nil
+}
+
+func (fs *HttpCacheFs) Mkdir(name string, perm os.FileMode) error {
+	return nil
+}
+
+func (fs *HttpCacheFs) MkdirAll(path string, perm os.FileMode) error {
+	return nil
+}
+
+func (fs *HttpCacheFs) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: ErrNotSupported}
+}
+
+func (fs *HttpCacheFs) RemoveAll(path string) error {
+	return &os.PathError{Op: "removeall", Path: path, Err: ErrNotSupported}
+}
+
+func (fs *HttpCacheFs) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: ErrNotSupported}
+}
+
+// uploadFile streams writes into the body of a PUT request. The result of the upload is returned
+// from Close.
+type uploadFile struct {
+	name    string
+	pw      *io.PipeWriter
+	done    chan error
+	closeMu sync.Mutex
+	closed  bool
+	err     error
+}
+
+func newUploadFile(fs *HttpCacheFs, name string) *uploadFile {
+	pr, pw := io.Pipe()
+	f := &uploadFile{
+		name: name,
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+	go func() {
+		err := fs.put(name, pr)
+		// Unblock any writers if the request finished early
+		_ = pr.CloseWithError(err)
+		f.done <- err
+	}()
+	return f
+}
+
+func (f *uploadFile) Close() error {
+	f.closeMu.Lock()
+	defer f.closeMu.Unlock()
+	if f.closed {
+		return f.err
+	}
+	f.closed = true
+	_ = f.pw.Close()
+	f.err = <-f.done
+	return f.err
+}
+
+// Abort cancels the upload, so the server never receives a complete object
+func (f *uploadFile) Abort(err error) error {
+	f.closeMu.Lock()
+	defer f.closeMu.Unlock()
+	if f.closed {
+		return f.err
+	}
+	f.closed = true
+	_ = f.pw.CloseWithError(err)
+	f.err = <-f.done
+	return f.err
+}
+
+func (f *uploadFile) Name() string {
+	return f.name
+}
+
+func (f *uploadFile) Write(p []byte) (int, error) {
+	return f.pw.Write(p)
+}
+
+func (f *uploadFile) WriteString(s string) (int, error) {
+	return f.pw.Write([]byte(s))
+}
+
+func (f *uploadFile) Read(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: f.name, Err: ErrNotSupported}
+}
+
+func (f *uploadFile) ReadAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: f.name, Err: ErrNotSupported}
+}
+
+func (f *uploadFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: ErrNotSupported}
+}
+
+func (f *uploadFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, &os.PathError{Op: "seek", Path: f.name, Err: ErrNotSupported}
+}
+
+func (f *uploadFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.name, Err: ErrNotSupported}
+}
+
+func (f *uploadFile) Readdirnames(n int) ([]string, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.name, Err: ErrNotSupported}
+}
+
+func (f *uploadFile) Stat() (os.FileInfo, error) {
+	return nil, &os.PathError{Op: "stat", Path: f.name, Err: ErrNotSupported}
+}
+
+func (f *uploadFile) Sync() error {
+	return nil
+}
+
+func (f *uploadFile) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: f.name, Err: ErrNotSupported}
+}
@@ -0,0 +1,149 @@
+package httpcachefs_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/wrouesnel/nix-sigman/pkg/httpcachefs"
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type upload struct {
+	contentType string
+	username    string
+	password    string
+	body        []byte
+}
+
+type HttpCacheFsSuite struct {
+	mtx     sync.Mutex
+	uploads map[string]upload
+	server  *httptest.Server
+	readFs  afero.Fs
+}
+
+var _ = Suite(&HttpCacheFsSuite{})
+
+func (s *HttpCacheFsSuite) SetUpTest(c *C) {
+	s.uploads = map[string]upload{}
+	s.readFs = afero.NewMemMapFs()
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path == "/cache/forbidden.narinfo" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		username, password, _ := r.BasicAuth()
+		s.mtx.Lock()
+		s.uploads[r.URL.Path] = upload{
+			contentType: r.Header.Get("Content-Type"),
+			username:    username,
+			password:    password,
+			body:        body,
+		}
+		s.mtx.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+}
+
+func (s *HttpCacheFsSuite) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+func (s *HttpCacheFsSuite) newFs(c *C, netrcFile string) *httpcachefs.HttpCacheFs {
+	uploadUrl, err := url.Parse(s.server.URL + "/cache")
+	c.Assert(err, IsNil)
+	fs, err := httpcachefs.NewHttpCacheFs(zap.NewNop(), s.readFs, uploadUrl, netrcFile, nil)
+	c.Assert(err, IsNil)
+	return fs
+}
+
+func (s *HttpCacheFsSuite) TestWriteUploads(c *C) {
+	fs := s.newFs(c, "")
+	c.Assert(fs.MkdirAll("/nar", 0o755), IsNil)
+	c.Assert(afero.WriteFile(fs, "/nar/abcd.nar.xz", []byte("nar content"), 0o644), IsNil)
+	c.Assert(afero.WriteFile(fs, "/abcd.narinfo", []byte("StorePath: /nix/store/abcd-test\n"), 0o644), IsNil)
+
+	nar, found := s.uploads["/cache/nar/abcd.nar.xz"]
+	c.Assert(found, Equals, true)
+	c.Check(string(nar.body), Equals, "nar content")
+	c.Check(nar.contentType, Equals, "application/octet-stream")
+	c.Check(nar.username, Equals, "")
+
+	ninfo, found := s.uploads["/cache/abcd.narinfo"]
+	c.Assert(found, Equals, true)
+	c.Check(string(ninfo.body), Equals, "StorePath: /nix/store/abcd-test\n")
+	c.Check(ninfo.contentType, Equals, "text/x-nix-narinfo")
+}
+
+func (s *HttpCacheFsSuite) TestNetrcAuth(c *C) {
+	serverUrl, err := url.Parse(s.server.URL)
+	c.Assert(err, IsNil)
+	netrcFile := filepath.Join(c.MkDir(), "netrc")
+	c.Assert(os.WriteFile(netrcFile,
+		[]byte("machine "+serverUrl.Hostname()+"\n  login pusher\n  password s3cret\n"), 0o600), IsNil)
+
+	fs := s.newFs(c, netrcFile)
+	c.Assert(afero.WriteFile(fs, "/abcd.narinfo", []byte("content"), 0o644), IsNil)
+
+	ninfo, found := s.uploads["/cache/abcd.narinfo"]
+	c.Assert(found, Equals, true)
+	c.Check(ninfo.username, Equals, "pusher")
+	c.Check(ninfo.password, Equals, "s3cret")
+}
+
+func (s *HttpCacheFsSuite) TestRejectedUploadFails(c *C) {
+	fs := s.newFs(c, "")
+	err := afero.WriteFile(fs, "/forbidden.narinfo", []byte("content"), 0o644)
+	c.Assert(err, NotNil)
+	uploadErr, ok := errors.AsType[*httpcachefs.ErrUploadFailed](err)
+	c.Assert(ok, Equals, true)
+	c.Check(uploadErr.StatusCode, Equals, http.StatusForbidden)
+}
+
+func (s *HttpCacheFsSuite) TestAbortedUploadIsNotStored(c *C) {
+	fs := s.newFs(c, "")
+	f, err := fs.OpenFile("/nar/abcd.nar.xz", os.O_CREATE|os.O_WRONLY, 0o644)
+	c.Assert(err, IsNil)
+	_, err = f.Write([]byte("partial"))
+	c.Assert(err, IsNil)
+
+	aborter, ok := f.(interface{ Abort(err error) error })
+	c.Assert(ok, Equals, true)
+	c.Check(aborter.Abort(errors.New("client went away")), NotNil)
+
+	_, found := s.uploads["/cache/nar/abcd.nar.xz"]
+	c.Check(found, Equals, false)
+}
+
+func (s *HttpCacheFsSuite) TestReadsPassThrough(c *C) {
+	c.Assert(afero.WriteFile(s.readFs, "/nix-cache-info", []byte("StoreDir: /nix/store\n"), 0o644), IsNil)
+	fs := s.newFs(c, "")
+	content, err := afero.ReadFile(fs, "/nix-cache-info")
+	c.Assert(err, IsNil)
+	c.Check(string(content), Equals, "StoreDir: /nix/store\n")
+	c.Check(s.uploads, HasLen, 0)
+
+	_, err = fs.OpenFile("/nix-cache-info", os.O_APPEND|os.O_WRONLY, 0o644)
+	c.Check(errors.Is(err, httpcachefs.ErrNotSupported), Equals, true)
+}
@@ -0,0 +1,215 @@
+// Package layeredfs stacks several filesystems into one. Reads fall through the layers in
+// priority order (the way Nix queries multiple substituters) and writes all go to a single
+// configurable layer.
+package layeredfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+type ErrReadOnlyLayer struct {
+	Op    string
+	Path  string
+	Layer int
+}
+
+func (e ErrReadOnlyLayer) Error() string {
+	return fmt.Sprintf("%s %s: still present in read-only layer %d", e.Op, e.Path, e.Layer)
+}
+
+type ErrInvalidWriteLayer struct {
+	WriteLayer int
+	NumLayers  int
+}
+
+func (e ErrInvalidWriteLayer) Error() string {
+	return fmt.Sprintf("write layer %d is out of range for %d layers", e.WriteLayer, e.NumLayers)
+}
+
+// LayeredFs is an afero.Fs over an ordered list of layers. Directories which exist in more than
+// one layer are merged when listed, with entries from higher priority layers taking precedence.
+// Modifications (including removal) only ever apply to the write layer. Removing or renaming a
+// path which is still visible in a read-only layer afterwards returns ErrReadOnlyLayer, rather than
+// reporting success for something the caller can still see.
+type LayeredFs struct {
+	layers     []afero.Fs
+	writeLayer int
+}
+
+// NewLayeredFs stacks layers in priority order (index 0 is consulted first). Writes go to the
+// layer at index writeLayer.
+func NewLayeredFs(layers []afero.Fs, writeLayer int) (*LayeredFs, error) {
+	if len(layers) == 0 {
+		return nil, errors.New("at least one layer is required")
+	}
+	if writeLayer < 0 || writeLayer >= len(layers) {
+		return nil, &ErrInvalidWriteLayer{WriteLayer: writeLayer, NumLayers: len(layers)}
+	}
+	return &LayeredFs{
+		layers:     layers,
+		writeLayer: writeLayer,
+	}, nil
+}
+
+// Layers returns the layers in priority order
+func (fs *LayeredFs) Layers() []afero.Fs {
+	return fs.layers
+}
+
+// WriteLayer returns the layer modifications are made to
+func (fs *LayeredFs) WriteLayer() afero.Fs {
+	return fs.layers[fs.writeLayer]
+}
+
+func (fs *LayeredFs) Name() string {
+	return "LayeredFs"
+}
+
+// lookupErr picks the error to return when no layer has a path. Errors other than the path not
+// existing are preferred since they mean a layer could not answer.
+func lookupErr(errs []error) error {
+	for _, err := range errs {
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return errs[0]
+}
+
+// Stat returns the file info from the first layer which has the path
+func (fs *LayeredFs) Stat(name string) (os.FileInfo, error) {
+	errs := []error{}
+	for _, layer := range fs.layers {
+		st, err := layer.Stat(name)
+		if err == nil {
+			return st, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, lookupErr(errs)
+}
+
+// Open opens the file from the first layer which has it. If the path is a directory, the
+// directories of every layer which has it are merged.
+func (fs *LayeredFs) Open(name string) (afero.File, error) {
+	errs := []error{}
+	dirs := []afero.File{}
+	for _, layer := range fs.layers {
+		st, err := layer.Stat(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		f, err := layer.Open(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !st.IsDir() {
+			if len(dirs) == 0 {
+				return f, nil
+			}
+			// A file in a lower layer is shadowed by the directory above it
+			_ = f.Close()
+			continue
+		}
+		dirs = append(dirs, f)
+	}
+
+	if len(dirs) == 0 {
+		return nil, lookupErr(errs)
+	}
+
+	// Build the merged directory from the bottom up so higher layers take precedence
+	merged := dirs[len(dirs)-1]
+	for i := len(dirs) - 2; i >= 0; i-- {
+		merged = &afero.UnionFile{Base: merged, Layer: dirs[i]}
+	}
+	return merged, nil
+}
+
+// OpenFile opens files for reading through the layers, and for writing on the write layer
+func (fs *LayeredFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		return fs.Open(name)
+	}
+	return fs.WriteLayer().OpenFile(name, flag, perm)
+}
+
+func (fs *LayeredFs) Create(name string) (afero.File, error) {
+	return fs.WriteLayer().Create(name)
+}
+
+func (fs *LayeredFs) Mkdir(name string, perm os.FileMode) error {
+	return fs.WriteLayer().Mkdir(name, perm)
+}
+
+func (fs *LayeredFs) MkdirAll(path string, perm os.FileMode) error {
+	return fs.WriteLayer().MkdirAll(path, perm)
+}
+
+// readOnlyLayerErr returns an ErrReadOnlyLayer if a layer other than the write layer has the path.
+// Layers which can't answer are skipped, since only a path known to be present is an error.
+func (fs *LayeredFs) readOnlyLayerErr(op string, name string) error {
+	for idx, layer := range fs.layers {
+		if idx == fs.writeLayer {
+			continue
+		}
+		if _, err := layer.Stat(name); err == nil {
+			return &ErrReadOnlyLayer{Op: op, Path: name, Layer: idx}
+		}
+	}
+	return nil
+}
+
+// Remove removes the path from the write layer. If it is still present in a read-only layer
+// ErrReadOnlyLayer is returned.
+func (fs *LayeredFs) Remove(name string) error {
+	err := fs.WriteLayer().Remove(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if roErr := fs.readOnlyLayerErr("remove", name); roErr != nil {
+		return roErr
+	}
+	return err
+}
+
+// RemoveAll removes the path from the write layer. If it is still present in a read-only layer
+// ErrReadOnlyLayer is returned.
+func (fs *LayeredFs) RemoveAll(path string) error {
+	if err := fs.WriteLayer().RemoveAll(path); err != nil {
+		return err
+	}
+	return fs.readOnlyLayerErr("remove", path)
+}
+
+// Rename renames a path within the write layer. If the old path is still present in a read-only
+// layer ErrReadOnlyLayer is returned.
+func (fs *LayeredFs) Rename(oldname, newname string) error {
+	err := fs.WriteLayer().Rename(oldname, newname)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if roErr := fs.readOnlyLayerErr("rename", oldname); roErr != nil {
+		return roErr
+	}
+	return err
+}
+
+func (fs *LayeredFs) Chmod(name string, mode os.FileMode) error {
+	return fs.WriteLayer().Chmod(name, mode)
+}
+
+func (fs *LayeredFs) Chown(name string, uid, gid int) error {
+	return fs.WriteLayer().Chown(name, uid, gid)
+}
+
+func (fs *LayeredFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return fs.WriteLayer().Chtimes(name, atime, mtime)
+}
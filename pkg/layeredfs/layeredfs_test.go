@@ -0,0 +1,121 @@
+package layeredfs_test
+
+import (
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/wrouesnel/nix-sigman/pkg/layeredfs"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type LayeredFsSuite struct {
+	top    afero.Fs
+	bottom afero.Fs
+}
+
+var _ = Suite(&LayeredFsSuite{})
+
+func (s *LayeredFsSuite) SetUpTest(c *C) {
+	s.top = afero.NewMemMapFs()
+	s.bottom = afero.NewMemMapFs()
+	c.Assert(afero.WriteFile(s.top, "/shared.narinfo", []byte("top"), 0o644), IsNil)
+	c.Assert(afero.WriteFile(s.top, "/nar/top.nar", []byte("top nar"), 0o644), IsNil)
+	c.Assert(afero.WriteFile(s.bottom, "/shared.narinfo", []byte("bottom"), 0o644), IsNil)
+	c.Assert(afero.WriteFile(s.bottom, "/bottom.narinfo", []byte("bottom only"), 0o644), IsNil)
+	c.Assert(afero.WriteFile(s.bottom, "/nar/bottom.nar", []byte("bottom nar"), 0o644), IsNil)
+}
+
+func (s *LayeredFsSuite) TestReadsFallThrough(c *C) {
+	fs, err := layeredfs.NewLayeredFs([]afero.Fs{s.top, s.bottom}, 0)
+	c.Assert(err, IsNil)
+
+	content, err := afero.ReadFile(fs, "/shared.narinfo")
+	c.Assert(err, IsNil)
+	c.Check(string(content), Equals, "top")
+
+	content, err = afero.ReadFile(fs, "/bottom.narinfo")
+	c.Assert(err, IsNil)
+	c.Check(string(content), Equals, "bottom only")
+
+	_, err = fs.Stat("/missing.narinfo")
+	c.Check(os.IsNotExist(err), Equals, true)
+	_, err = fs.Open("/missing.narinfo")
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *LayeredFsSuite) TestDirectoriesAreMerged(c *C) {
+	fs, err := layeredfs.NewLayeredFs([]afero.Fs{s.top, s.bottom}, 0)
+	c.Assert(err, IsNil)
+
+	names, err := afero.ReadDir(fs, "/")
+	c.Assert(err, IsNil)
+	rootNames := []string{}
+	for _, st := range names {
+		rootNames = append(rootNames, st.Name())
+	}
+	sort.Strings(rootNames)
+	c.Check(rootNames, DeepEquals, []string{"bottom.narinfo", "nar", "shared.narinfo"})
+
+	names, err = afero.ReadDir(fs, "/nar")
+	c.Assert(err, IsNil)
+	narNames := []string{}
+	for _, st := range names {
+		narNames = append(narNames, st.Name())
+	}
+	sort.Strings(narNames)
+	c.Check(narNames, DeepEquals, []string{"bottom.nar", "top.nar"})
+}
+
+func (s *LayeredFsSuite) TestWritesGoToWriteLayer(c *C) {
+	fs, err := layeredfs.NewLayeredFs([]afero.Fs{s.top, s.bottom}, 1)
+	c.Assert(err, IsNil)
+
+	c.Assert(afero.WriteFile(fs, "/new.narinfo", []byte("new"), 0o644), IsNil)
+	exists, err := afero.Exists(s.bottom, "/new.narinfo")
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, true)
+	exists, err = afero.Exists(s.top, "/new.narinfo")
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, false)
+
+	c.Assert(fs.Remove("/new.narinfo"), IsNil)
+	exists, err = afero.Exists(fs, "/new.narinfo")
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, false)
+}
+
+func (s *LayeredFsSuite) TestRemovalFromReadOnlyLayer(c *C) {
+	fs, err := layeredfs.NewLayeredFs([]afero.Fs{s.top, s.bottom}, 1)
+	c.Assert(err, IsNil)
+
+	// The write layer's copy is removed, but the top layer's copy is still visible
+	c.Check(fs.Remove("/shared.narinfo"), FitsTypeOf, &layeredfs.ErrReadOnlyLayer{})
+	exists, err := afero.Exists(s.bottom, "/shared.narinfo")
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, false)
+	content, err := afero.ReadFile(fs, "/shared.narinfo")
+	c.Assert(err, IsNil)
+	c.Check(string(content), Equals, "top")
+
+	// Objects only in a read-only layer can't be removed or renamed
+	c.Check(fs.Remove("/nar/top.nar"), FitsTypeOf, &layeredfs.ErrReadOnlyLayer{})
+	c.Check(fs.RemoveAll("/nar/top.nar"), FitsTypeOf, &layeredfs.ErrReadOnlyLayer{})
+	c.Check(fs.Rename("/nar/top.nar", "/nar/moved.nar"), FitsTypeOf, &layeredfs.ErrReadOnlyLayer{})
+	exists, err = afero.Exists(fs, "/nar/top.nar")
+	c.Assert(err, IsNil)
+	c.Check(exists, Equals, true)
+
+	c.Check(os.IsNotExist(fs.Remove("/missing.narinfo")), Equals, true)
+}
+
+func (s *LayeredFsSuite) TestInvalidWriteLayer(c *C) {
+	_, err := layeredfs.NewLayeredFs([]afero.Fs{s.top, s.bottom}, 2)
+	c.Assert(err, NotNil)
+	_, err = layeredfs.NewLayeredFs([]afero.Fs{}, 0)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,141 @@
+// Package narcheck verifies NAR files against the hashes and sizes recorded in their narinfo.
+// Only NarHash and NarSize are covered by narinfo signatures, so a NAR is only trustworthy once
+// it has been decompressed and checked against them.
+package narcheck
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/1lann/countwriter"
+	"github.com/mholt/archives"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"zombiezen.com/go/nix/nar"
+)
+
+type ErrUnknownCompression struct {
+	Compression string
+}
+
+func (e ErrUnknownCompression) Error() string {
+	return fmt.Sprintf("unknown compression: %s", e.Compression)
+}
+
+type ErrUnsupportedHash struct {
+	HashName string
+}
+
+func (e ErrUnsupportedHash) Error() string {
+	return fmt.Sprintf("unsupported hash: %s", e.HashName)
+}
+
+type ErrHashMismatch struct {
+	Field    string
+	Expected string
+	Obtained string
+}
+
+func (e ErrHashMismatch) Error() string {
+	return fmt.Sprintf("%s mismatch: expected %s got %s", e.Field, e.Expected, e.Obtained)
+}
+
+type noneDecompressor struct{}
+
+func (noneDecompressor) OpenReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+// Decompressor returns a decompressor for the given narinfo compression name
+func Decompressor(compression string) (archives.Decompressor, error) {
+	switch compression {
+	case "none":
+		return noneDecompressor{}, nil
+	case "xz":
+		return archives.Xz{}, nil
+	case "zstd":
+		return archives.Zstd{}, nil
+	case "gzip":
+		return archives.Gz{}, nil
+	case "bzip2":
+		return archives.Bz2{}, nil
+	case "br":
+		return archives.Brotli{}, nil
+	default:
+		return nil, &ErrUnknownCompression{Compression: compression}
+	}
+}
+
+// Check reads a NAR file and checks it against FileHash and FileSize (when set), then
+// decompresses and parses it as a NAR stream and checks it against NarHash and NarSize. The
+// obtained NarHash is returned. Mismatches are returned as ErrHashMismatch.
+func Check(rd io.Reader, ninfo nixtypes.NarInfo) (nixtypes.TypedNixHash, error) {
+	// Only handle sha256 for now. FileHash is optional for uncompressed NARs.
+	if ninfo.NarHash.HashName != "sha256" {
+		return nixtypes.TypedNixHash{}, &ErrUnsupportedHash{HashName: ninfo.NarHash.HashName}
+	}
+	checkFileHash := ninfo.FileHash.HashName != ""
+	if checkFileHash && ninfo.FileHash.HashName != "sha256" {
+		return nixtypes.TypedNixHash{}, &ErrUnsupportedHash{HashName: ninfo.FileHash.HashName}
+	}
+
+	compression := ninfo.Compression
+	if compression == "" {
+		// Nix treats a missing compression field as bzip2
+		compression = "bzip2"
+	}
+	decompressor, err := Decompressor(compression)
+	if err != nil {
+		return nixtypes.TypedNixHash{}, err
+	}
+
+	// file -> filehasher
+	//     \-> decompressor -> narhasher
+	//                     \-> NAR parser
+	fileHasher := sha256.New()
+	fileCounter := countwriter.NewWriter(fileHasher)
+	fileRd := io.TeeReader(rd, fileCounter)
+	decompRd, err := decompressor.OpenReader(fileRd)
+	if err != nil {
+		return nixtypes.TypedNixHash{}, errors.Join(errors.New("could not open decompressor"), err)
+	}
+	defer decompRd.Close()
+
+	narHasher := sha256.New()
+	narCounter := countwriter.NewWriter(narHasher)
+	narRd := nar.NewReader(io.TeeReader(decompRd, narCounter))
+	for {
+		_, err := narRd.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nixtypes.TypedNixHash{}, errors.Join(errors.New("could not parse NAR stream"), err)
+		}
+	}
+
+	// Drain anything left so the hashes and sizes cover the entire stream
+	if _, err := io.Copy(narCounter, decompRd); err != nil {
+		return nixtypes.TypedNixHash{}, errors.Join(errors.New("error while decompressing"), err)
+	}
+	if _, err := io.Copy(io.Discard, fileRd); err != nil {
+		return nixtypes.TypedNixHash{}, err
+	}
+
+	obtainedFileHash := nixtypes.TypedNixHash{HashName: "sha256", Hash: fileHasher.Sum(nil)}
+	obtainedNarHash := nixtypes.TypedNixHash{HashName: "sha256", Hash: narHasher.Sum(nil)}
+
+	switch {
+	case checkFileHash && !bytes.Equal(obtainedFileHash.Hash, ninfo.FileHash.Hash):
+		err = &ErrHashMismatch{Field: "FileHash", Expected: ninfo.FileHash.String(), Obtained: obtainedFileHash.String()}
+	case ninfo.FileSize != 0 && fileCounter.Count() != ninfo.FileSize:
+		err = &ErrHashMismatch{Field: "FileSize", Expected: fmt.Sprintf("%d", ninfo.FileSize), Obtained: fmt.Sprintf("%d", fileCounter.Count())}
+	case !bytes.Equal(obtainedNarHash.Hash, ninfo.NarHash.Hash):
+		err = &ErrHashMismatch{Field: "NarHash", Expected: ninfo.NarHash.String(), Obtained: obtainedNarHash.String()}
+	case narCounter.Count() != ninfo.NarSize:
+		err = &ErrHashMismatch{Field: "NarSize", Expected: fmt.Sprintf("%d", ninfo.NarSize), Obtained: fmt.Sprintf("%d", narCounter.Count())}
+	}
+	return obtainedNarHash, err
+}
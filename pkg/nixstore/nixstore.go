@@ -1,6 +1,7 @@
 package nixstore
 
 import (
+	"context"
 	"database/sql"
 	"encoding/hex"
 	"errors"
@@ -39,6 +40,8 @@ type NixStore interface {
 	GetNarInfo(path string) (nixtypes.NarInfo, time.Time, error)
 	GetNar(path string) (io.ReadCloser, *nixtypes.NarInfo, time.Time, error)
 	GetStorePathByFileHash(fileHash string) (string, error)
+	// Ping checks the database is still reachable
+	Ping(ctx context.Context) error
 }
 
 // NOTE: there is a danger to this - it'll always match something if the database
@@ -112,6 +115,10 @@ type nixStore struct {
 	hashingAlg string
 }
 
+func (n *nixStore) Ping(ctx context.Context) error {
+	return n.db.PingContext(ctx)
+}
+
 func (n *nixStore) GetNarInfo(path string) (nixtypes.NarInfo, time.Time, error) {
 	// Extract the hashname
 	trimmed, _, _ := strings.Cut(filepath.Base(path), ".")
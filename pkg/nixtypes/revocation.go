@@ -0,0 +1,90 @@
+package nixtypes
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// RevocationList is a set of revoked signing keys. A key revoked by name revokes every signature
+// with that key name. A key revoked by its <name>:<base64> public key revokes every signature the
+// key made, whatever name it was given.
+type RevocationList struct {
+	Names []string
+	Keys  []NamedPublicKey
+}
+
+// ParseRevocation parses a key name, or a <name>:<base64> public key
+func ParseRevocation(revocation string) (RevocationList, error) {
+	if !strings.Contains(revocation, ":") {
+		return RevocationList{Names: []string{revocation}}, nil
+	}
+	key := NamedPublicKey{}
+	if err := key.UnmarshalText([]byte(revocation)); err != nil {
+		return RevocationList{}, err
+	}
+	return RevocationList{Keys: []NamedPublicKey{key}}, nil
+}
+
+// ParseRevocations parses a file of key names and public keys, one per line
+func ParseRevocations(reader io.Reader) (RevocationList, error) {
+	revoked := RevocationList{}
+	lines, err := commentedLineParser(reader)
+	if err != nil {
+		return revoked, err
+	}
+	for _, line := range lines {
+		revocation, err := ParseRevocation(line)
+		if err != nil {
+			return revoked, err
+		}
+		revoked = revoked.Merge(revocation)
+	}
+	return revoked, nil
+}
+
+// Merge returns a list with the revocations of both lists
+func (r RevocationList) Merge(other RevocationList) RevocationList {
+	return RevocationList{
+		Names: append(append([]string{}, r.Names...), other.Names...),
+		Keys:  append(append([]NamedPublicKey{}, r.Keys...), other.Keys...),
+	}
+}
+
+// IsEmpty reports if nothing is revoked
+func (r RevocationList) IsEmpty() bool {
+	return len(r.Names) == 0 && len(r.Keys) == 0
+}
+
+// IsRevoked reports if a public key is revoked by name or by value
+func (r RevocationList) IsRevoked(key NamedPublicKey) bool {
+	if lo.Contains(r.Names, key.KeyName) {
+		return true
+	}
+	return lo.ContainsBy(r.Keys, func(item NamedPublicKey) bool { return bytes.Equal(item.Key, key.Key) })
+}
+
+// RemoveRevokedSigs removes every signature made by a revoked key, and returns the names of the
+// removed signatures.
+func (n *NarInfo) RemoveRevokedSigs(revoked RevocationList) []string {
+	if revoked.IsEmpty() {
+		return nil
+	}
+	removed := lo.Filter(n.Sig, func(item NixSignature, _ int) bool {
+		return lo.Contains(revoked.Names, item.KeyName)
+	})
+	n.RemoveSigsByNames(revoked.Names...)
+
+	for _, key := range revoked.Keys {
+		_, matches := n.Verify(key)
+		for _, match := range matches {
+			n.Sig = lo.Reject(n.Sig, func(item NixSignature, _ int) bool {
+				return bytes.Equal(item.Signature, match.Signature)
+			})
+		}
+		removed = append(removed, matches...)
+	}
+	return lo.Uniq(lo.Map(removed, func(item NixSignature, _ int) string { return item.KeyName }))
+}
@@ -0,0 +1,56 @@
+package nixtypes
+
+import (
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type RevocationSuite struct{}
+
+var _ = Suite(&RevocationSuite{})
+
+func (s *RevocationSuite) TestParseRevocations(c *C) {
+	revoked, err := ParseRevocations(strings.NewReader(`
+# Leaked in the 2026 incident
+internal-1
+test-key-1:fLPd//RXMYq4eTB5Nf4RUB15BpGH9HxWc7KN1pTS2YU=
+`))
+	c.Assert(err, IsNil)
+	c.Check(revoked.Names, DeepEquals, []string{"internal-1"})
+	c.Assert(revoked.Keys, HasLen, 1)
+	c.Check(revoked.Keys[0].KeyName, Equals, "test-key-1")
+
+	_, err = ParseRevocations(strings.NewReader("bad-key:notbase64\n"))
+	c.Check(err, NotNil)
+}
+
+func (s *RevocationSuite) TestRemoveRevokedSigs(c *C) {
+	ninfo := NarInfo{}
+	c.Assert(ninfo.UnmarshalText([]byte(narInfo)), IsNil)
+	byName, err := GeneratePrivateKey("by-name")
+	c.Assert(err, IsNil)
+	byKey, err := GeneratePrivateKey("by-key")
+	c.Assert(err, IsNil)
+	for _, key := range []NamedPrivateKey{byName, byKey} {
+		_, _, err := ninfo.Sign(key)
+		c.Assert(err, IsNil)
+	}
+	// A copy of the revoked key under another name is still revoked
+	renamed := byKey
+	renamed.KeyName = "by-key-renamed"
+	_, _, err = ninfo.SignReplaceByName(renamed)
+	c.Assert(err, IsNil)
+	c.Assert(ninfo.Sig, HasLen, 4)
+
+	revoked := RevocationList{Names: []string{"by-name"}, Keys: []NamedPublicKey{byKey.PublicKey()}}
+	c.Check(revoked.IsRevoked(byName.PublicKey()), Equals, true)
+	c.Check(revoked.IsRevoked(renamed.PublicKey()), Equals, true)
+
+	removed := ninfo.RemoveRevokedSigs(revoked)
+	c.Check(removed, DeepEquals, []string{"by-name", "by-key", "by-key-renamed"})
+	c.Assert(ninfo.Sig, HasLen, 1)
+	c.Check(ninfo.Sig[0].KeyName, Equals, "cache.nixos.org-1")
+
+	c.Check(ninfo.RemoveRevokedSigs(RevocationList{}), HasLen, 0)
+}
@@ -1,5 +1,166 @@
 package resigning
 
+import (
+	"context"
+	"sync"
+
+	"github.com/samber/lo"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
 // ResigningManager abstracts common functionality for managing NAR resigning.
 type ResigningManager interface {
+	// Resign evaluates every rule against the narinfo in order, and signs it with the keys of
+	// each rule which matches. Rules see the signatures added by the rules before them.
+	Resign(ctx context.Context, ninfo *nixtypes.NarInfo) (Decision, error)
+	// Rules returns the rules in the order they are evaluated
+	Rules() []SigningRule
+}
+
+// RuleDecision is the outcome of evaluating one rule against a narinfo
+type RuleDecision struct {
+	Rule    string `json:"rule"`
+	Matched bool   `json:"matched"`
+	// Reason is why the rule matched or, if it didn't, the first condition which failed
+	Reason string `json:"reason"`
+	// VerifiedKeys and FailedKeys are the required public keys which did and did not have valid
+	// signatures
+	VerifiedKeys []string `json:"verified_keys,omitempty"`
+	FailedKeys   []string `json:"failed_keys,omitempty"`
+	// SignedWith are the private keys which added a new signature
+	SignedWith []string `json:"signed_with,omitempty"`
+}
+
+// Decision is the outcome of resigning a narinfo
+type Decision struct {
+	StorePath string `json:"store_path"`
+	// Signed is true if any new signature was added
+	Signed bool `json:"signed"`
+	// RevokedSignatures are the names of signatures by revoked keys, which were removed before
+	// the rules were evaluated
+	RevokedSignatures []string       `json:"revoked_signatures,omitempty"`
+	Rules             []RuleDecision `json:"rules"`
+}
+
+// SignedWith returns every private key which added a new signature
+func (d Decision) SignedWith() []string {
+	return lo.FlatMap(d.Rules, func(item RuleDecision, _ int) []string { return item.SignedWith })
+}
+
+// Manager is the ResigningManager used by the commands. Its rules can be replaced with Reload
+// while it is in use. A nil Manager has no rules.
+//
+// Signatures by revoked keys are removed from every narinfo it resigns, revoked public keys never
+// verify and revoked private keys are never signed with.
+type Manager struct {
+	l       *zap.Logger
+	mtx     sync.RWMutex
+	rules   []*signingRule
+	revoked nixtypes.RevocationList
+}
+
+var _ ResigningManager = &Manager{}
+
+// NewManager builds a Manager from rules, resolving the keys they name
+func NewManager(l *zap.Logger, rules []SigningRule, privateKeys []nixtypes.NamedPrivateKey,
+	publicKeys []nixtypes.NamedPublicKey, revoked nixtypes.RevocationList) (*Manager, error) {
+	m := &Manager{l: l}
+	if err := m.Reload(rules, privateKeys, publicKeys, revoked); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload replaces the rules and revoked keys of the manager. If any rule is invalid the current
+// rules are kept.
+func (m *Manager) Reload(rules []SigningRule, privateKeys []nixtypes.NamedPrivateKey,
+	publicKeys []nixtypes.NamedPublicKey, revoked nixtypes.RevocationList) error {
+	privMap := lo.SliceToMap(privateKeys, func(item nixtypes.NamedPrivateKey) (string, nixtypes.NamedPrivateKey) {
+		return item.KeyName, item
+	})
+
+	pubMap := lo.SliceToMap(publicKeys, func(item nixtypes.NamedPublicKey) (string, nixtypes.NamedPublicKey) {
+		return item.KeyName, item
+	})
+
+	var setupErr error
+	compiledRules := make([]*signingRule, 0, len(rules))
+	for _, rule := range rules {
+		compiled, err := compileSigningRule(rule, pubMap, privMap, revoked)
+		if err != nil {
+			setupErr = multierr.Append(setupErr, err)
+			continue
+		}
+		compiledRules = append(compiledRules, compiled)
+	}
+	if setupErr != nil {
+		return setupErr
+	}
+	for _, rule := range compiledRules {
+		if len(rule.revokedSigningKeys) > 0 {
+			m.l.Warn("Rule signs with revoked keys, which will not be used", zap.String("rule", rule.Name),
+				zap.Strings("revoked_keys", rule.revokedSigningKeys))
+		}
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.rules = compiledRules
+	m.revoked = revoked
+	return nil
+}
+
+// Rules implements ResigningManager
+func (m *Manager) Rules() []SigningRule {
+	if m == nil {
+		return nil
+	}
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return lo.Map(m.rules, func(item *signingRule, _ int) SigningRule { return item.SigningRule })
+}
+
+// Resign implements ResigningManager. On error the decision has the rules evaluated so far.
+func (m *Manager) Resign(ctx context.Context, ninfo *nixtypes.NarInfo) (Decision, error) {
+	decision := Decision{StorePath: ninfo.StorePath, Rules: []RuleDecision{}}
+	if m == nil {
+		return decision, nil
+	}
+	m.mtx.RLock()
+	rules := m.rules
+	revoked := m.revoked
+	m.mtx.RUnlock()
+
+	nl := m.l.With(zap.String("store_path", ninfo.StorePath))
+	decision.RevokedSignatures = ninfo.RemoveRevokedSigs(revoked)
+	if len(decision.RevokedSignatures) > 0 {
+		nl.Debug("Removed signatures by revoked keys", zap.Strings("revoked_signatures", decision.RevokedSignatures))
+	}
+	for _, rule := range rules {
+		if err := ctx.Err(); err != nil {
+			return decision, err
+		}
+		ruleDecision := rule.evaluate(ninfo)
+		if ruleDecision.Matched {
+			signedWith, err := rule.sign(ninfo)
+			ruleDecision.SignedWith = signedWith
+			if err != nil {
+				decision.Rules = append(decision.Rules, ruleDecision)
+				nl.Warn("Signing Error", zap.String("rule", rule.Name), zap.String("error", err.Error()))
+				return decision, err
+			}
+			if len(signedWith) > 0 {
+				decision.Signed = true
+			}
+		}
+		decision.Rules = append(decision.Rules, ruleDecision)
+	}
+	if decision.Signed {
+		nl.Debug("Resigned narinfo file", zap.Strings("signed_with", decision.SignedWith()))
+	} else {
+		nl.Debug("No match narinfo file")
+	}
+	return decision, nil
 }
@@ -0,0 +1,116 @@
+package resigning
+
+import (
+	"context"
+
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+)
+
+func (s *RulesSuite) TestManagerDecisionReasons(c *C) {
+	manager, err := NewManager(zap.NewNop(), []SigningRule{
+		{Name: "tools", StorePathName: "tool-*", SignWith: []string{"internal-1"}},
+		{Name: "upstream", RequireSignatures: []string{"cache.nixos.org-1", "internal-1"}, SignWith: []string{"internal-1"}},
+	}, s.privateKeys, s.publicKeys, nixtypes.RevocationList{})
+	c.Assert(err, IsNil)
+	c.Check(manager.Rules(), HasLen, 2)
+
+	ninfo := s.narInfo(c, "hello-2.12")
+	decision, err := manager.Resign(context.Background(), ninfo)
+	c.Assert(err, IsNil)
+	c.Check(decision.StorePath, Equals, ninfo.StorePath)
+	c.Check(decision.Signed, Equals, false)
+	c.Assert(decision.Rules, HasLen, 2)
+	c.Check(decision.Rules[0], DeepEquals, RuleDecision{
+		Rule:   "tools",
+		Reason: `store path name "hello-2.12" does not match "tool-*"`,
+	})
+	c.Check(decision.Rules[1], DeepEquals, RuleDecision{
+		Rule:         "upstream",
+		Reason:       "no valid signature from: internal-1",
+		VerifiedKeys: []string{"cache.nixos.org-1"},
+		FailedKeys:   []string{"internal-1"},
+	})
+
+	// The second rule sees the signature added by the first
+	ninfo = s.narInfo(c, "tool-1.0")
+	decision, err = manager.Resign(context.Background(), ninfo)
+	c.Assert(err, IsNil)
+	c.Check(decision.Signed, Equals, true)
+	c.Check(decision.SignedWith(), DeepEquals, []string{"internal-1"})
+	c.Check(decision.Rules[0].Matched, Equals, true)
+	c.Check(decision.Rules[0].Reason, Equals, "all conditions matched")
+	c.Check(decision.Rules[1].Matched, Equals, true)
+	c.Check(decision.Rules[1].SignedWith, HasLen, 0)
+}
+
+func (s *RulesSuite) TestManagerReloadKeepsRulesOnError(c *C) {
+	manager, err := NewManager(zap.NewNop(), []SigningRule{
+		{Name: "all", SignWith: []string{"internal-1"}},
+	}, s.privateKeys, s.publicKeys, nixtypes.RevocationList{})
+	c.Assert(err, IsNil)
+
+	err = manager.Reload([]SigningRule{
+		{Name: "ok", SignWith: []string{"internal-1"}},
+		{Name: "missing-key", SignWith: []string{"not-loaded"}},
+	}, s.privateKeys, s.publicKeys, nixtypes.RevocationList{})
+	c.Assert(err, NotNil)
+	c.Assert(manager.Rules(), HasLen, 1)
+	c.Check(manager.Rules()[0].Name, Equals, "all")
+
+	c.Assert(manager.Reload(nil, s.privateKeys, s.publicKeys, nixtypes.RevocationList{}), IsNil)
+	decision, err := manager.Resign(context.Background(), s.narInfo(c, "hello-2.12"))
+	c.Assert(err, IsNil)
+	c.Check(decision.Signed, Equals, false)
+	c.Check(decision.Rules, HasLen, 0)
+}
+
+func (s *RulesSuite) TestNilManager(c *C) {
+	var manager *Manager
+	c.Check(manager.Rules(), HasLen, 0)
+	decision, err := manager.Resign(context.Background(), s.narInfo(c, "hello-2.12"))
+	c.Assert(err, IsNil)
+	c.Check(decision.Signed, Equals, false)
+}
+
+func (s *RulesSuite) TestManagerCancelledContext(c *C) {
+	manager, err := NewManager(zap.NewNop(), []SigningRule{
+		{Name: "all", SignWith: []string{"internal-1"}},
+	}, s.privateKeys, s.publicKeys, nixtypes.RevocationList{})
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ninfo := s.narInfo(c, "hello-2.12")
+	_, err = manager.Resign(ctx, ninfo)
+	c.Check(err, Equals, context.Canceled)
+	c.Check(s.signedByInternal(ninfo), Equals, false)
+}
+
+func (s *RulesSuite) TestManagerRevokedKeys(c *C) {
+	rules := []SigningRule{
+		{Name: "upstream", RequireSignatures: []string{"cache.nixos.org-1"}, SignWith: []string{"internal-1"}},
+	}
+	manager, err := NewManager(zap.NewNop(), rules, s.privateKeys, s.publicKeys,
+		nixtypes.RevocationList{Names: []string{"cache.nixos.org-1"}})
+	c.Assert(err, IsNil)
+
+	ninfo := s.narInfo(c, "hello-2.12")
+	decision, err := manager.Resign(context.Background(), ninfo)
+	c.Assert(err, IsNil)
+	c.Check(decision.RevokedSignatures, DeepEquals, []string{"cache.nixos.org-1"})
+	c.Check(ninfo.Sig, HasLen, 0)
+	c.Check(decision.Signed, Equals, false)
+	c.Check(decision.Rules[0].FailedKeys, DeepEquals, []string{"cache.nixos.org-1"})
+
+	// A revoked private key is never signed with
+	c.Assert(manager.Reload(rules, s.privateKeys, s.publicKeys,
+		nixtypes.RevocationList{Keys: []nixtypes.NamedPublicKey{s.internalKey.PublicKey()}}), IsNil)
+	ninfo = s.narInfo(c, "hello-2.12")
+	decision, err = manager.Resign(context.Background(), ninfo)
+	c.Assert(err, IsNil)
+	c.Check(decision.Rules[0].Matched, Equals, true)
+	c.Check(decision.Signed, Equals, false)
+	c.Check(s.signedByInternal(ninfo), Equals, false)
+}
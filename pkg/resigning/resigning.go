@@ -2,6 +2,7 @@ package resigning
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"strings"
 
@@ -9,51 +10,36 @@ import (
 	"github.com/samber/lo"
 	"github.com/spf13/afero"
 	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
-	"go.uber.org/multierr"
 	"go.uber.org/zap"
 )
 
 type ResigningConfig struct {
 	SigningMap                  map[string]string `help:"Map of public key names to private key names to sign if present"`
 	SigningMapFile              string            `help:"File to load the signing map from"`
+	SigningRulesFile            string            `help:"YAML file of structured signing rules (matching on store path name, deriver, CA and NarSize)"`
 	AllowUnsignedResigning      bool              `help:"Allow signing unsigned packages via the empty key specifier"`
 	AllowUnconditionalResigning bool              `help:"Allow signing packages unconditionally"`
 	UnsignedResigningKeys       []string          `help:"List of key names to be used for signing unsigned packages"`
 	UnconditionalResigningKeys  []string          `help:"List of key names which will be used to unconditionally resign all packages"`
 }
 
-type ConditionalResigners []func(ninfo *nixtypes.NarInfo) (bool, error)
-
-// MaybeResign will evaluate the resigning conditions for a NARinfo file and resign it if needed
-func (c ConditionalResigners) MaybeResign(l *zap.Logger, ninfo *nixtypes.NarInfo) (bool, error) {
-	nl := l.With(zap.String("store_path", ninfo.StorePath))
-	didNewSignature := false
-	for _, signer := range c {
-		didSign, err := signer(ninfo)
-		if err != nil {
-			nl.Warn("Signing Error", zap.String("error", err.Error()))
-			return didNewSignature, err
-		}
-		if !didNewSignature && didSign {
-			didNewSignature = didSign
-		}
-	}
-	if didNewSignature {
-		nl.Debug("Resigned narinfo file")
-	} else {
-		nl.Debug("No match narinfo file")
-	}
-	return didNewSignature, nil
+// HasSigningRules reports if a signing map or signing rules are configured
+func (c *ResigningConfig) HasSigningRules() bool {
+	return len(c.SigningMap) > 0 || c.SigningMapFile != "" || c.SigningRulesFile != ""
 }
 
-func LoadSigningMap(l *zap.Logger, signingConfig *ResigningConfig, privateKeys []nixtypes.NamedPrivateKey, publicKeys []nixtypes.NamedPublicKey) (signers ConditionalResigners, err error) {
+// ConfigRules collects the signing rules from a resigning config, in the order they are
+// evaluated: signing map entries, the rules file, unsigned resigning and then unconditional
+// resigning.
+func ConfigRules(l *zap.Logger, signingConfig *ResigningConfig) ([]SigningRule, error) {
 	signingMap := make(map[string]string, 0)
 
 	if signingConfig.SigningMapFile != "" {
+		var err error
 		signingMap, err = loadSigningMapFile(signingConfig.SigningMapFile)
 		if err != nil {
 			l.Error("Signing map file specified but could not be loaded")
-			return
+			return nil, err
 		}
 	}
 
@@ -64,90 +50,100 @@ func LoadSigningMap(l *zap.Logger, signingConfig *ResigningConfig, privateKeys [
 		signingMap[k] = v
 	}
 
-	l.Info("Building resigning map")
-	signers, err = buildSigningMap(publicKeys, privateKeys, signingMap)
-	if err != nil {
-		return
+	rules := signingMapRules(signingMap)
+	if signingConfig.SigningRulesFile != "" {
+		fileRules, err := LoadSigningRulesFile(signingConfig.SigningRulesFile)
+		if err != nil {
+			l.Error("Signing rules file specified but could not be loaded")
+			return nil, err
+		}
+		rules = append(rules, fileRules...)
 	}
 
-	// Validate the unsigned keys
-	privateKeyMap := lo.SliceToMap(privateKeys, func(item nixtypes.NamedPrivateKey) (string, nixtypes.NamedPrivateKey) {
-		return item.KeyName, item
-	})
-
 	if signingConfig.AllowUnsignedResigning {
-		var unsignedErr error
 		if len(lo.CoalesceSliceOrEmpty(signingConfig.UnsignedResigningKeys)) == 0 {
 			l.Warn("Unsigned Resigning Activated but no keys specified - unsigned packages will not be resigned")
 		} else {
-			unsignedResigningKeys := []nixtypes.NamedPrivateKey{}
-			for _, keyName := range signingConfig.UnsignedResigningKeys {
-				if pKey, found := privateKeyMap[keyName]; found {
-					unsignedResigningKeys = append(unsignedResigningKeys, pKey)
-				} else {
-					unsignedErr = multierr.Append(unsignedErr, fmt.Errorf("requested private key not loaded: %s", pKey.KeyName))
-				}
-			}
-
-			err = multierr.Combine(err, unsignedErr)
-
 			l.Warn("Unsigned Resigning Activated: all unsigned packages will have these keys applied",
 				zap.Strings("unsigned_resigning_keys", signingConfig.UnsignedResigningKeys))
-			// Add the unsigned singer to the map
-			signers = append(signers, func(ninfo *nixtypes.NarInfo) (bool, error) {
-				if len(ninfo.Sig) > 0 {
-					// Don't sign package with signature already.
-					return false, nil
-				}
-				l.Info("Signing unsigned package with unsigned package keys")
-				for _, pkey := range unsignedResigningKeys {
-					_, _, err := ninfo.Sign(pkey)
-					if err != nil {
-						return false, err
-					}
-				}
-				return true, nil
+			rules = append(rules, SigningRule{
+				Name:     UnsignedRuleName,
+				Unsigned: true,
+				SignWith: signingConfig.UnsignedResigningKeys,
 			})
 		}
-	} else if len(lo.CoalesceSliceOrEmpty(signingConfig.UnconditionalResigningKeys)) > 0 {
+	} else if len(lo.CoalesceSliceOrEmpty(signingConfig.UnsignedResigningKeys)) > 0 {
 		l.Warn("Unsigned Resigning Keys specified but unsigned resigning is not being allowed")
 	}
 
 	if signingConfig.AllowUnconditionalResigning {
-		var unconditionalErr error
 		if len(lo.CoalesceSliceOrEmpty(signingConfig.UnconditionalResigningKeys)) == 0 {
 			l.Warn("Unconditional Resigning Activated but no keys specified - no keys will be unconditionally applied")
 		} else {
-			unconditionalResigningKeys := []nixtypes.NamedPrivateKey{}
-			for _, keyName := range signingConfig.UnconditionalResigningKeys {
-				if pKey, found := privateKeyMap[keyName]; found {
-					unconditionalResigningKeys = append(unconditionalResigningKeys, pKey)
-				} else {
-					unconditionalErr = multierr.Append(unconditionalErr, fmt.Errorf("requested private key not loaded: %s", pKey.KeyName))
-				}
-			}
-
-			err = multierr.Combine(err, unconditionalErr)
-
 			l.Warn("Unconditional Resigning Activated: all packages will have these keys applied",
 				zap.Strings("unconditional_resigning_keys", signingConfig.UnconditionalResigningKeys))
-			// Add the unsigned singer to the map
-			signers = append(signers, func(ninfo *nixtypes.NarInfo) (bool, error) {
-				l.Info("Signing package with unconditional keys")
-				for _, pkey := range unconditionalResigningKeys {
-					_, _, err := ninfo.Sign(pkey)
-					if err != nil {
-						return false, err
-					}
-				}
-				return true, nil
+			rules = append(rules, SigningRule{
+				Name:     UnconditionalRuleName,
+				SignWith: signingConfig.UnconditionalResigningKeys,
 			})
 		}
 	} else if len(lo.CoalesceSliceOrEmpty(signingConfig.UnconditionalResigningKeys)) > 0 {
 		l.Warn("Unconditional Resigning Keys specified but unconditional resigning is not being allowed")
 	}
 
-	return
+	return rules, nil
+}
+
+// LoadManager builds a Manager from a resigning config
+func LoadManager(l *zap.Logger, signingConfig *ResigningConfig, privateKeys []nixtypes.NamedPrivateKey,
+	publicKeys []nixtypes.NamedPublicKey, revoked nixtypes.RevocationList) (*Manager, error) {
+	rules, err := ConfigRules(l, signingConfig)
+	if err != nil {
+		return nil, err
+	}
+	l.Info("Building resigning map", zap.Int("num_rules", len(rules)))
+	return NewManager(l, rules, privateKeys, publicKeys, revoked)
+}
+
+// ConditionalResigners resign a narinfo if their conditions match it.
+//
+// Deprecated: use Manager, which reports why each rule did or didn't match.
+type ConditionalResigners []func(ninfo *nixtypes.NarInfo) (bool, error)
+
+// MaybeResign will evaluate the resigning conditions for a NARinfo file and resign it if needed
+//
+// Deprecated: use Manager.Resign.
+func (c ConditionalResigners) MaybeResign(l *zap.Logger, ninfo *nixtypes.NarInfo) (bool, error) {
+	nl := l.With(zap.String("store_path", ninfo.StorePath))
+	didNewSignature := false
+	for _, signer := range c {
+		didSign, err := signer(ninfo)
+		if err != nil {
+			nl.Warn("Signing Error", zap.String("error", err.Error()))
+			return didNewSignature, err
+		}
+		didNewSignature = didNewSignature || didSign
+	}
+	if didNewSignature {
+		nl.Debug("Resigned narinfo file")
+	} else {
+		nl.Debug("No match narinfo file")
+	}
+	return didNewSignature, nil
+}
+
+// LoadSigningMap builds ConditionalResigners from a resigning config. No keys are revoked.
+//
+// Deprecated: use LoadManager.
+func LoadSigningMap(l *zap.Logger, signingConfig *ResigningConfig, privateKeys []nixtypes.NamedPrivateKey, publicKeys []nixtypes.NamedPublicKey) (ConditionalResigners, error) {
+	manager, err := LoadManager(l, signingConfig, privateKeys, publicKeys, nixtypes.RevocationList{})
+	if err != nil {
+		return nil, err
+	}
+	return ConditionalResigners{func(ninfo *nixtypes.NarInfo) (bool, error) {
+		decision, err := manager.Resign(context.Background(), ninfo)
+		return decision.Signed, err
+	}}, nil
 }
 
 func loadSigningMapFile(path string) (map[string]string, error) {
@@ -174,62 +170,3 @@ func loadSigningMapFile(path string) (map[string]string, error) {
 	}
 	return signingMap, nil
 }
-
-// buildSigningMap builds the data structures for doing conditional signing
-func buildSigningMap(publicKeys []nixtypes.NamedPublicKey,
-	privateKeys []nixtypes.NamedPrivateKey, signingMap map[string]string) (signers ConditionalResigners, setupErr error) {
-
-	privMap := lo.SliceToMap(privateKeys, func(item nixtypes.NamedPrivateKey) (string, nixtypes.NamedPrivateKey) {
-		return item.KeyName, item
-	})
-
-	pubMap := lo.SliceToMap(publicKeys, func(item nixtypes.NamedPublicKey) (string, nixtypes.NamedPublicKey) {
-		return item.KeyName, item
-	})
-
-	for k, v := range signingMap {
-		requiredPublicKeys := strings.Split(k, "&")
-		requiredPrivateKeys := strings.Split(v, ",")
-
-		requiredKeys := []nixtypes.NamedPublicKey{}
-		for _, key := range requiredPublicKeys {
-			if !lo.HasKey(pubMap, key) && key != "" {
-				setupErr = multierr.Append(setupErr, fmt.Errorf("requested public key not loaded: %s", key))
-			} else if key != "" {
-				requiredKeys = append(requiredKeys, pubMap[key])
-			}
-		}
-
-		signingKeys := []nixtypes.NamedPrivateKey{}
-		for _, key := range requiredPrivateKeys {
-			if !lo.HasKey(privMap, key) {
-				setupErr = multierr.Append(setupErr, fmt.Errorf("requested private key not loaded: %s", key))
-			} else {
-				signingKeys = append(signingKeys, privMap[key])
-			}
-		}
-
-		signers = append(signers, func(ninfo *nixtypes.NarInfo) (bool, error) {
-			// Abort as soon as something doesn't match
-			for _, key := range requiredKeys {
-				match, _ := ninfo.Verify(key)
-				if !match {
-					return false, nil
-				}
-			}
-			didNewSignature := false
-			// Good signatures - resign
-			for _, key := range signingKeys {
-				didSign, _, err := ninfo.Sign(key)
-				if err != nil {
-					return didSign, err
-				}
-				if didSign {
-					didNewSignature = true
-				}
-			}
-			return didNewSignature, nil
-		})
-	}
-	return
-}
@@ -0,0 +1,243 @@
+package resigning
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/samber/lo"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"go.uber.org/multierr"
+)
+
+type ErrInvalidSigningRule struct {
+	Rule   string
+	Reason string
+}
+
+func (e ErrInvalidSigningRule) Error() string {
+	return fmt.Sprintf("invalid signing rule %s: %s", e.Rule, e.Reason)
+}
+
+// SigningRule resigns narinfo files which match all of its conditions with its private keys.
+// Conditions which are not set always match.
+type SigningRule struct {
+	// Name identifies the rule in logs and errors
+	Name string `yaml:"name"`
+	// RequireSignatures are the names of public keys which must all have signed the narinfo
+	RequireSignatures []string `yaml:"require-signatures,omitempty"`
+	// StorePathName is a glob matched against the store path name (i.e. without the hash)
+	StorePathName string `yaml:"store-path-name,omitempty"`
+	// StorePathRegex is a regular expression matched against the store path name
+	StorePathRegex string `yaml:"store-path-regex,omitempty"`
+	// Deriver is a glob matched against the deriver name (i.e. without the hash). It never
+	// matches narinfo files without a deriver.
+	Deriver string `yaml:"deriver,omitempty"`
+	// DeriverRegex is a regular expression matched against the deriver name
+	DeriverRegex string `yaml:"deriver-regex,omitempty"`
+	// ContentAddressed matches on whether the narinfo has a CA field
+	ContentAddressed *bool `yaml:"content-addressed,omitempty"`
+	// MinNarSize and MaxNarSize bound the NarSize in bytes (0 for no bound)
+	MinNarSize uint64 `yaml:"min-nar-size,omitempty"`
+	MaxNarSize uint64 `yaml:"max-nar-size,omitempty"`
+	// Unsigned only matches narinfo files which have no signatures at all
+	Unsigned bool `yaml:"unsigned,omitempty"`
+	// SignWith are the names of the private keys to sign matching narinfo files with
+	SignWith []string `yaml:"sign-with"`
+	// ReplaceExisting replaces existing signatures with the same key names, rather than keeping
+	// them if they're already present
+	ReplaceExisting bool `yaml:"replace-existing,omitempty"`
+}
+
+// Names of the rules built from the unsigned and unconditional resigning options
+const (
+	UnsignedRuleName      = "unsigned-resigning"
+	UnconditionalRuleName = "unconditional-resigning"
+)
+
+// signingRulesFile is the format of the structured rules file
+type signingRulesFile struct {
+	Rules []SigningRule `yaml:"rules"`
+}
+
+// LoadSigningRulesFile loads a YAML file of signing rules, which are applied in order:
+//
+//	rules:
+//	  - name: ourcompany
+//	    require-signatures: [cache.nixos.org-1]
+//	    store-path-name: "*-ourcompany-*"
+//	    max-nar-size: 1073741824
+//	    sign-with: [internal-1]
+func LoadSigningRulesFile(path string) ([]SigningRule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rulesFile := signingRulesFile{}
+	if err := yaml.UnmarshalWithOptions(content, &rulesFile, yaml.DisallowUnknownField()); err != nil {
+		return nil, err
+	}
+	for idx := range rulesFile.Rules {
+		if rulesFile.Rules[idx].Name == "" {
+			rulesFile.Rules[idx].Name = fmt.Sprintf("rule-%d", idx+1)
+		}
+	}
+	return rulesFile.Rules, nil
+}
+
+// signingMapRules converts signing map entries (public key names joined with & to private key
+// names joined with ,) to the equivalent signing rules. They are sorted so the order of
+// evaluation is stable.
+func signingMapRules(signingMap map[string]string) []SigningRule {
+	rules := []SigningRule{}
+	for _, publicKeys := range lo.Keys(signingMap) {
+		rules = append(rules, SigningRule{
+			Name: fmt.Sprintf("%s=%s", publicKeys, signingMap[publicKeys]),
+			RequireSignatures: lo.Filter(strings.Split(publicKeys, "&"), func(item string, _ int) bool {
+				return item != ""
+			}),
+			SignWith: strings.Split(signingMap[publicKeys], ","),
+		})
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules
+}
+
+// signingRule is a SigningRule with its keys resolved and patterns compiled
+type signingRule struct {
+	SigningRule
+	requiredKeys   []nixtypes.NamedPublicKey
+	signingKeys    []nixtypes.NamedPrivateKey
+	storePathRegex *regexp.Regexp
+	deriverRegex   *regexp.Regexp
+	revoked        nixtypes.RevocationList
+	// revokedSigningKeys are the SignWith keys which are revoked, and so left out of signingKeys
+	revokedSigningKeys []string
+}
+
+// compileSigningRule checks a rule and resolves the keys it names
+func compileSigningRule(rule SigningRule, pubMap map[string]nixtypes.NamedPublicKey,
+	privMap map[string]nixtypes.NamedPrivateKey, revoked nixtypes.RevocationList) (*signingRule, error) {
+	compiled := &signingRule{SigningRule: rule, revoked: revoked}
+
+	var setupErr error
+	for _, key := range rule.RequireSignatures {
+		if publicKey, found := pubMap[key]; found {
+			compiled.requiredKeys = append(compiled.requiredKeys, publicKey)
+		} else {
+			setupErr = multierr.Append(setupErr, fmt.Errorf("requested public key not loaded: %s", key))
+		}
+	}
+	if len(rule.SignWith) == 0 {
+		setupErr = multierr.Append(setupErr, &ErrInvalidSigningRule{Rule: rule.Name, Reason: "no keys to sign with"})
+	}
+	for _, key := range rule.SignWith {
+		if privateKey, found := privMap[key]; !found {
+			setupErr = multierr.Append(setupErr, fmt.Errorf("requested private key not loaded: %s", key))
+		} else if revoked.IsRevoked(privateKey.PublicKey()) {
+			compiled.revokedSigningKeys = append(compiled.revokedSigningKeys, key)
+		} else {
+			compiled.signingKeys = append(compiled.signingKeys, privateKey)
+		}
+	}
+
+	for _, pattern := range []string{rule.StorePathName, rule.Deriver} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			setupErr = multierr.Append(setupErr, &ErrInvalidSigningRule{Rule: rule.Name, Reason: fmt.Sprintf("bad glob: %s", pattern)})
+		}
+	}
+	var err error
+	if rule.StorePathRegex != "" {
+		if compiled.storePathRegex, err = regexp.Compile(rule.StorePathRegex); err != nil {
+			setupErr = multierr.Append(setupErr, &ErrInvalidSigningRule{Rule: rule.Name, Reason: err.Error()})
+		}
+	}
+	if rule.DeriverRegex != "" {
+		if compiled.deriverRegex, err = regexp.Compile(rule.DeriverRegex); err != nil {
+			setupErr = multierr.Append(setupErr, &ErrInvalidSigningRule{Rule: rule.Name, Reason: err.Error()})
+		}
+	}
+	if rule.MaxNarSize != 0 && rule.MaxNarSize < rule.MinNarSize {
+		setupErr = multierr.Append(setupErr, &ErrInvalidSigningRule{Rule: rule.Name, Reason: "max-nar-size is less than min-nar-size"})
+	}
+	return compiled, setupErr
+}
+
+// storeName returns the name part of a store path or deriver (after the hash)
+func storeName(storePath string) string {
+	_, name, _ := strings.Cut(path.Base(storePath), "-")
+	return name
+}
+
+// evaluate checks the narinfo against every condition of the rule. Signatures are always checked
+// so the decision can report them, but the reason is the first condition which failed. Revoked
+// keys always fail.
+func (r *signingRule) evaluate(ninfo *nixtypes.NarInfo) RuleDecision {
+	decision := RuleDecision{Rule: r.Name}
+	for _, key := range r.requiredKeys {
+		if match, _ := ninfo.Verify(key); match && !r.revoked.IsRevoked(key) {
+			decision.VerifiedKeys = append(decision.VerifiedKeys, key.KeyName)
+		} else {
+			decision.FailedKeys = append(decision.FailedKeys, key.KeyName)
+		}
+	}
+
+	name := storeName(ninfo.StorePath)
+	deriverName := storeName(ninfo.Deriver)
+	switch {
+	case r.StorePathName != "" && !globMatch(r.StorePathName, name):
+		decision.Reason = fmt.Sprintf("store path name %q does not match %q", name, r.StorePathName)
+	case r.storePathRegex != nil && !r.storePathRegex.MatchString(name):
+		decision.Reason = fmt.Sprintf("store path name %q does not match regex %q", name, r.StorePathRegex)
+	case (r.Deriver != "" || r.deriverRegex != nil) && ninfo.Deriver == "":
+		decision.Reason = "narinfo has no deriver"
+	case r.Deriver != "" && !globMatch(r.Deriver, deriverName):
+		decision.Reason = fmt.Sprintf("deriver %q does not match %q", deriverName, r.Deriver)
+	case r.deriverRegex != nil && !r.deriverRegex.MatchString(deriverName):
+		decision.Reason = fmt.Sprintf("deriver %q does not match regex %q", deriverName, r.DeriverRegex)
+	case r.ContentAddressed != nil && *r.ContentAddressed != (ninfo.CA != ""):
+		decision.Reason = fmt.Sprintf("content addressed is %t", ninfo.CA != "")
+	case r.MinNarSize != 0 && ninfo.NarSize < r.MinNarSize:
+		decision.Reason = fmt.Sprintf("NarSize %d is less than %d", ninfo.NarSize, r.MinNarSize)
+	case r.MaxNarSize != 0 && ninfo.NarSize > r.MaxNarSize:
+		decision.Reason = fmt.Sprintf("NarSize %d is greater than %d", ninfo.NarSize, r.MaxNarSize)
+	case r.Unsigned && len(ninfo.Sig) > 0:
+		decision.Reason = "narinfo is already signed"
+	case len(decision.FailedKeys) > 0:
+		decision.Reason = fmt.Sprintf("no valid signature from: %s", strings.Join(decision.FailedKeys, ", "))
+	default:
+		decision.Matched = true
+		decision.Reason = "all conditions matched"
+	}
+	return decision
+}
+
+func globMatch(pattern string, name string) bool {
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+// sign signs the narinfo with the rule's keys, and returns the keys which added a new signature
+func (r *signingRule) sign(ninfo *nixtypes.NarInfo) ([]string, error) {
+	signedWith := []string{}
+	for _, key := range r.signingKeys {
+		var didSign bool
+		var err error
+		if r.ReplaceExisting {
+			didSign, _, err = ninfo.SignReplaceByName(key)
+		} else {
+			didSign, _, err = ninfo.Sign(key)
+		}
+		if err != nil {
+			return signedWith, err
+		}
+		if didSign {
+			signedWith = append(signedWith, key.KeyName)
+		}
+	}
+	return signedWith, nil
+}
@@ -0,0 +1,155 @@
+package resigning
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type RulesSuite struct {
+	upstreamKey nixtypes.NamedPrivateKey
+	internalKey nixtypes.NamedPrivateKey
+	publicKeys  []nixtypes.NamedPublicKey
+	privateKeys []nixtypes.NamedPrivateKey
+}
+
+var _ = Suite(&RulesSuite{})
+
+func (s *RulesSuite) SetUpSuite(c *C) {
+	var err error
+	s.upstreamKey, err = nixtypes.GeneratePrivateKey("cache.nixos.org-1")
+	c.Assert(err, IsNil)
+	s.internalKey, err = nixtypes.GeneratePrivateKey("internal-1")
+	c.Assert(err, IsNil)
+	s.publicKeys = []nixtypes.NamedPublicKey{s.upstreamKey.PublicKey(), s.internalKey.PublicKey()}
+	s.privateKeys = []nixtypes.NamedPrivateKey{s.internalKey}
+}
+
+// narInfo returns a narinfo signed by the upstream key
+func (s *RulesSuite) narInfo(c *C, name string) *nixtypes.NarInfo {
+	ninfo := &nixtypes.NarInfo{
+		StorePath:  "/nix/store/58br4vk3q5akf4g8lx0pqzfhn47k3j8d-" + name,
+		URL:        "nar/test.nar",
+		NarHash:    nixtypes.TypedNixHash{HashName: "sha256", Hash: make([]byte, 32)},
+		NarSize:    4096,
+		References: []string{},
+		Deriver:    "0fxc9c3ag05l0zl3ax1yq5bwkl57lj2m-" + name + ".drv",
+		Extra:      map[string]string{},
+	}
+	_, _, err := ninfo.Sign(s.upstreamKey)
+	c.Assert(err, IsNil)
+	return ninfo
+}
+
+func (s *RulesSuite) signedByInternal(ninfo *nixtypes.NarInfo) bool {
+	return lo.ContainsBy(ninfo.Sig, func(sig nixtypes.NixSignature) bool { return sig.KeyName == "internal-1" })
+}
+
+func (s *RulesSuite) writeRules(c *C, content string) string {
+	rulesFile := filepath.Join(c.MkDir(), "rules.yaml")
+	c.Assert(os.WriteFile(rulesFile, []byte(content), 0o600), IsNil)
+	return rulesFile
+}
+
+func (s *RulesSuite) TestRulesFile(c *C) {
+	rulesFile := s.writeRules(c, `
+rules:
+  - name: ourcompany
+    require-signatures: [cache.nixos.org-1]
+    store-path-name: "*-ourcompany-*"
+    deriver-regex: "\\.drv$"
+    content-addressed: false
+    max-nar-size: 8192
+    sign-with: [internal-1]
+`)
+	signers, err := LoadManager(zap.NewNop(), &ResigningConfig{SigningRulesFile: rulesFile}, s.privateKeys, s.publicKeys, nixtypes.RevocationList{})
+	c.Assert(err, IsNil)
+	c.Assert(signers.Rules(), HasLen, 1)
+
+	ninfo := s.narInfo(c, "tool-ourcompany-1.0")
+	decision, err := signers.Resign(context.Background(), ninfo)
+	c.Assert(err, IsNil)
+	c.Check(decision.Signed, Equals, true)
+	c.Check(s.signedByInternal(ninfo), Equals, true)
+
+	for _, ninfo := range []*nixtypes.NarInfo{
+		s.narInfo(c, "hello-2.12"),
+		func() *nixtypes.NarInfo {
+			ninfo := s.narInfo(c, "big-ourcompany-1.0")
+			ninfo.NarSize = 16384
+			return ninfo
+		}(),
+		func() *nixtypes.NarInfo {
+			ninfo := s.narInfo(c, "ca-ourcompany-1.0")
+			ninfo.CA = "fixed:r:sha256:1b4sb93wp679q4zx9k1ignby1yna3z7c4c2ri3wphylbc2dwsys0"
+			return ninfo
+		}(),
+		func() *nixtypes.NarInfo {
+			ninfo := s.narInfo(c, "noderiver-ourcompany-1.0")
+			ninfo.Deriver = ""
+			return ninfo
+		}(),
+		func() *nixtypes.NarInfo {
+			ninfo := s.narInfo(c, "unsigned-ourcompany-1.0")
+			ninfo.Sig = nil
+			return ninfo
+		}(),
+	} {
+		decision, err := signers.Resign(context.Background(), ninfo)
+		c.Assert(err, IsNil)
+		c.Check(decision.Signed, Equals, false, Commentf("%s", ninfo.StorePath))
+	}
+}
+
+func (s *RulesSuite) TestSigningMapStillWorks(c *C) {
+	signers, err := LoadManager(zap.NewNop(), &ResigningConfig{
+		SigningMap: map[string]string{"cache.nixos.org-1": "internal-1"},
+	}, s.privateKeys, s.publicKeys, nixtypes.RevocationList{})
+	c.Assert(err, IsNil)
+
+	ninfo := s.narInfo(c, "hello-2.12")
+	decision, err := signers.Resign(context.Background(), ninfo)
+	c.Assert(err, IsNil)
+	c.Check(decision.Signed, Equals, true)
+}
+
+func (s *RulesSuite) TestDeprecatedSigningMap(c *C) {
+	signers, err := LoadSigningMap(zap.NewNop(), &ResigningConfig{
+		SigningMap: map[string]string{"cache.nixos.org-1": "internal-1"},
+	}, s.privateKeys, s.publicKeys)
+	c.Assert(err, IsNil)
+
+	ninfo := s.narInfo(c, "hello-2.12")
+	signed, err := signers.MaybeResign(zap.NewNop(), ninfo)
+	c.Assert(err, IsNil)
+	c.Check(signed, Equals, true)
+	c.Check(s.signedByInternal(ninfo), Equals, true)
+
+	// Already signed, so nothing new is added
+	signed, err = signers.MaybeResign(zap.NewNop(), ninfo)
+	c.Assert(err, IsNil)
+	c.Check(signed, Equals, false)
+}
+
+func (s *RulesSuite) TestInvalidRules(c *C) {
+	for _, content := range []string{
+		"rules:\n  - name: bad-field\n    store-path-nmae: \"*\"\n    sign-with: [internal-1]\n",
+		"rules:\n  - name: bad-regex\n    store-path-regex: \"(\"\n    sign-with: [internal-1]\n",
+		"rules:\n  - name: missing-key\n    sign-with: [not-loaded]\n",
+		"rules:\n  - name: no-keys\n    store-path-name: \"*\"\n",
+		"rules:\n  - name: bad-size\n    min-nar-size: 10\n    max-nar-size: 5\n    sign-with: [internal-1]\n",
+	} {
+		_, err := LoadManager(zap.NewNop(), &ResigningConfig{SigningRulesFile: s.writeRules(c, content)},
+			s.privateKeys, s.publicKeys, nixtypes.RevocationList{})
+		c.Check(err, NotNil, Commentf("%s", content))
+	}
+}
@@ -0,0 +1,399 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/chigopher/pathlib"
+	"github.com/wrouesnel/nix-sigman/pkg/narcheck"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+type ErrNotFound struct {
+	Name string
+}
+
+func (e ErrNotFound) Error() string {
+	return fmt.Sprintf("not found in any upstream: %s", e.Name)
+}
+
+type ErrUntrusted struct {
+	StorePath string
+}
+
+func (e ErrUntrusted) Error() string {
+	return fmt.Sprintf("upstream narinfo is not signed by a trusted key: %s", e.StorePath)
+}
+
+type ErrNoTrustedKeys struct{}
+
+func (e ErrNoTrustedKeys) Error() string {
+	return "no trusted keys specified for upstream verification"
+}
+
+type ErrHashMismatch struct {
+	Name     string
+	Expected string
+	Obtained string
+}
+
+func (e ErrHashMismatch) Error() string {
+	return fmt.Sprintf("hash mismatch for %s: expected %s got %s", e.Name, e.Expected, e.Obtained)
+}
+
+type ErrInvalidName struct {
+	Name string
+}
+
+func (e ErrInvalidName) Error() string {
+	return fmt.Sprintf("not a cacheable object name: %s", e.Name)
+}
+
+// Upstream implements pull-through caching from one or more Nix HTTP binary caches. Upstreams
+// are queried in order and the first one holding a trusted narinfo file wins.
+type Upstream struct {
+	l           *zap.Logger
+	urls        []*url.URL
+	keysMtx     sync.RWMutex
+	trustedKeys []nixtypes.NamedPublicKey
+	client      *http.Client
+	// fetches de-duplicates concurrent requests for the same object
+	fetches singleflight.Group
+}
+
+// NewUpstream initializes a new pull-through cache. trustedKeys must be non-empty, since
+// there is no way to safely cache an unverified narinfo file.
+func NewUpstream(l *zap.Logger, urls []*url.URL, trustedKeys []nixtypes.NamedPublicKey, client *http.Client) (*Upstream, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("no upstream URLs specified")
+	}
+	if len(trustedKeys) == 0 {
+		return nil, &ErrNoTrustedKeys{}
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Upstream{
+		l:           l,
+		urls:        urls,
+		trustedKeys: trustedKeys,
+		client:      client,
+	}, nil
+}
+
+// get requests a path relative to the given upstream. A 404 is returned as ErrNotFound.
+func (u *Upstream) get(ctx context.Context, base *url.URL, name string) (io.ReadCloser, error) {
+	ref, err := url.Parse(strings.TrimPrefix(name, "/"))
+	if err != nil {
+		return nil, err
+	}
+	// Ensure relative resolution keeps any path prefix on the upstream URL.
+	baseDir := *base
+	if !strings.HasSuffix(baseDir.Path, "/") {
+		baseDir.Path = baseDir.Path + "/"
+	}
+	target := baseDir.ResolveReference(ref)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound, http.StatusForbidden:
+		resp.Body.Close()
+		return nil, &ErrNotFound{Name: name}
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status from upstream %s: %s", base.Redacted(), resp.Status)
+	}
+}
+
+// SetTrustedKeys replaces the keys upstream narinfo files are verified with
+func (u *Upstream) SetTrustedKeys(trustedKeys []nixtypes.NamedPublicKey) error {
+	if len(trustedKeys) == 0 {
+		return &ErrNoTrustedKeys{}
+	}
+	u.keysMtx.Lock()
+	defer u.keysMtx.Unlock()
+	u.trustedKeys = trustedKeys
+	return nil
+}
+
+// trusted checks if the narinfo is signed by any of the trusted keys
+func (u *Upstream) trusted(ninfo *nixtypes.NarInfo) bool {
+	u.keysMtx.RLock()
+	trustedKeys := u.trustedKeys
+	u.keysMtx.RUnlock()
+	for _, key := range trustedKeys {
+		if verified, _ := ninfo.Verify(key); verified {
+			return true
+		}
+	}
+	return false
+}
+
+// FetchNarInfo retrieves and verifies a narinfo file from the upstreams. The upstream it was
+// found on is returned so the NAR file can be retrieved from the same place.
+func (u *Upstream) FetchNarInfo(ctx context.Context, hashPart string) (nixtypes.NarInfo, *url.URL, error) {
+	name := fmt.Sprintf("%s.narinfo", hashPart)
+	var lastErr error = &ErrNotFound{Name: name}
+	for _, base := range u.urls {
+		l := u.l.With(zap.String("upstream", base.Redacted()), zap.String("name", name))
+		body, err := u.get(ctx, base, name)
+		if err != nil {
+			if _, notFound := errors.AsType[*ErrNotFound](err); !notFound {
+				l.Warn("Error fetching narinfo from upstream", zap.Error(err))
+				lastErr = err
+			}
+			continue
+		}
+		ninfoBytes, err := io.ReadAll(io.LimitReader(body, 1024*1024))
+		body.Close()
+		if err != nil {
+			l.Warn("Error reading narinfo from upstream", zap.Error(err))
+			lastErr = err
+			continue
+		}
+
+		ninfo := nixtypes.NarInfo{}
+		if err := ninfo.UnmarshalText(ninfoBytes); err != nil {
+			l.Warn("Could not parse narinfo from upstream", zap.Error(err))
+			lastErr = err
+			continue
+		}
+
+		if ninfo.NixHash() != hashPart {
+			l.Warn("Upstream narinfo does not match the requested path", zap.String("store_path", ninfo.StorePath))
+			lastErr = &ErrInvalidName{Name: name}
+			continue
+		}
+
+		if !u.trusted(&ninfo) {
+			l.Warn("Upstream narinfo is not signed by a trusted key", zap.String("store_path", ninfo.StorePath))
+			lastErr = &ErrUntrusted{StorePath: ninfo.StorePath}
+			continue
+		}
+
+		return ninfo, base, nil
+	}
+	return nixtypes.NarInfo{}, nil, lastErr
+}
+
+// NarRelPath validates the URL field of a narinfo as a relative path which can be safely
+// stored under the cache root, and returns it cleaned.
+func NarRelPath(narURL string) (string, error) {
+	parsed, err := url.Parse(narURL)
+	if err != nil {
+		return "", err
+	}
+	if parsed.IsAbs() || parsed.Host != "" || path.IsAbs(parsed.Path) {
+		return "", &ErrInvalidName{Name: narURL}
+	}
+	cleaned := path.Clean(parsed.Path)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", &ErrInvalidName{Name: narURL}
+	}
+	return cleaned, nil
+}
+
+// CacheNarInfo fetches a narinfo file and its NAR from upstream and writes them both under root.
+// The NAR is always written (and verified) before the narinfo so a narinfo is never visible
+// without its NAR.
+func (u *Upstream) CacheNarInfo(ctx context.Context, root *pathlib.Path, hashPart string) (nixtypes.NarInfo, error) {
+	result, err, _ := u.fetches.Do(fmt.Sprintf("%s.narinfo", hashPart), func() (interface{}, error) {
+		l := u.l.With(zap.String("hash", hashPart))
+		ninfo, base, err := u.FetchNarInfo(ctx, hashPart)
+		if err != nil {
+			return nixtypes.NarInfo{}, err
+		}
+
+		narRel, err := NarRelPath(ninfo.URL)
+		if err != nil {
+			l.Warn("Upstream narinfo has an unusable NAR URL", zap.String("url", ninfo.URL))
+			return nixtypes.NarInfo{}, err
+		}
+
+		narPath := root.Join(narRel)
+		expectedHash, expectedSize := ninfo.FileHash, ninfo.FileSize
+		if expectedHash.HashName == "" && (ninfo.Compression == "" || ninfo.Compression == "none") {
+			expectedHash, expectedSize = ninfo.NarHash, ninfo.NarSize
+		}
+
+		fetched := false
+		if cachedFileValid(narPath, expectedHash, expectedSize) {
+			l.Debug("NAR file already present in cache", zap.String("nar_path", narPath.String()))
+		} else {
+			if _, err, _ := u.fetches.Do(narRel, func() (interface{}, error) {
+				return nil, u.fetchVerified(ctx, base, ninfo.URL, narPath, expectedHash, expectedSize)
+			}); err != nil {
+				return nixtypes.NarInfo{}, err
+			}
+			fetched = true
+		}
+
+		// URL and FileHash aren't covered by the signature, so the NAR is only trusted once its
+		// content matches the signed NarHash and NarSize.
+		if err := checkNar(narPath, ninfo); err != nil {
+			l.Warn("Upstream NAR does not match the signed narinfo", zap.String("nar_path", narPath.String()), zap.Error(err))
+			if fetched {
+				if err := narPath.Remove(); err != nil {
+					l.Error("Could not remove unverified NAR file", zap.Error(err))
+				}
+			}
+			return nixtypes.NarInfo{}, err
+		}
+
+		ninfoBytes, err := ninfo.MarshalText()
+		if err != nil {
+			return nixtypes.NarInfo{}, err
+		}
+		ninfoPath := root.Join(fmt.Sprintf("%s.narinfo", hashPart))
+		if err := ninfoPath.WriteFileMode(ninfoBytes, os.FileMode(0644)); err != nil {
+			l.Error("Could not write narinfo file to cache", zap.Error(err))
+			return nixtypes.NarInfo{}, err
+		}
+		l.Info("Cached narinfo from upstream", zap.String("store_path", ninfo.StorePath), zap.String("upstream", base.Redacted()))
+		return ninfo, nil
+	})
+	if err != nil {
+		return nixtypes.NarInfo{}, err
+	}
+	return result.(nixtypes.NarInfo), nil
+}
+
+// CacheNar fetches a NAR file by name directly. Since there's no narinfo to verify it against,
+// this is only possible for names which embed their file hash (i.e. nar/<filehash>.nar.<ext>)
+// which is checked against the downloaded content.
+func (u *Upstream) CacheNar(ctx context.Context, root *pathlib.Path, name string) error {
+	narRel, err := NarRelPath(strings.TrimPrefix(name, "/"))
+	if err != nil {
+		return err
+	}
+	hashStr, _, _ := strings.Cut(path.Base(narRel), ".")
+	fileHash := nixtypes.NixBase32Field{}
+	if err := fileHash.UnmarshalText([]byte(hashStr)); err != nil || len(fileHash) != sha256.Size {
+		return &ErrInvalidName{Name: name}
+	}
+	expectedHash := nixtypes.TypedNixHash{HashName: "sha256", Hash: fileHash}
+
+	_, err, _ = u.fetches.Do(narRel, func() (interface{}, error) {
+		var lastErr error = &ErrNotFound{Name: narRel}
+		for _, base := range u.urls {
+			err := u.fetchVerified(ctx, base, narRel, root.Join(narRel), expectedHash, 0)
+			if err == nil {
+				return nil, nil
+			}
+			if _, notFound := errors.AsType[*ErrNotFound](err); !notFound {
+				lastErr = err
+			}
+		}
+		return nil, lastErr
+	})
+	return err
+}
+
+// cachedFileValid checks if a file already in the cache has the expected hash and size, so a
+// truncated or corrupt earlier fetch is replaced rather than trusted.
+func cachedFileValid(dest *pathlib.Path, expectedHash nixtypes.TypedNixHash, expectedSize uint64) bool {
+	if st, err := dest.Stat(); err != nil || uint64(st.Size()) != expectedSize {
+		return false
+	}
+	if expectedHash.HashName != "sha256" {
+		return false
+	}
+	fh, err := dest.Open()
+	if err != nil {
+		return false
+	}
+	defer fh.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, fh); err != nil {
+		return false
+	}
+	return bytes.Equal(hasher.Sum(nil), expectedHash.Hash)
+}
+
+// checkNar decompresses a cached NAR file and checks it against the narinfo
+func checkNar(narPath *pathlib.Path, ninfo nixtypes.NarInfo) error {
+	fh, err := narPath.Open()
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	_, err = narcheck.Check(fh, ninfo)
+	return err
+}
+
+// fetchVerified downloads a file from upstream to dest, checking the hash (and size if non-zero)
+// as it is written. On any failure the destination file is removed.
+func (u *Upstream) fetchVerified(ctx context.Context, base *url.URL, name string, dest *pathlib.Path,
+	expectedHash nixtypes.TypedNixHash, expectedSize uint64) error {
+	l := u.l.With(zap.String("upstream", base.Redacted()), zap.String("name", name))
+
+	if expectedHash.HashName != "sha256" {
+		l.Warn("Unsupported hash", zap.String("hash_name", expectedHash.HashName))
+		return errors.New("unsupported hash")
+	}
+
+	body, err := u.get(ctx, base, name)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if err := dest.Parent().MkdirAllMode(os.FileMode(0755)); err != nil {
+		l.Warn("Could not create NAR directory", zap.Error(err))
+	}
+
+	fh, err := dest.OpenFile(os.O_CREATE | os.O_WRONLY | os.O_TRUNC)
+	if err != nil {
+		l.Error("Could not create file in cache", zap.Error(err))
+		return err
+	}
+
+	hasher := sha256.New()
+	nbytes, err := io.Copy(io.MultiWriter(fh, hasher), body)
+	closeErr := fh.Close()
+
+	obtainedHash := nixtypes.TypedNixHash{HashName: "sha256", Hash: hasher.Sum(nil)}
+	switch {
+	case err != nil || closeErr != nil:
+		err = errors.Join(err, closeErr)
+		l.Error("Error writing upstream file to cache", zap.Error(err))
+	case !bytes.Equal(obtainedHash.Hash, expectedHash.Hash):
+		err = &ErrHashMismatch{Name: name, Expected: expectedHash.String(), Obtained: obtainedHash.String()}
+		l.Warn("Upstream file failed hash verification", zap.Error(err))
+	case expectedSize != 0 && uint64(nbytes) != expectedSize:
+		err = fmt.Errorf("size mismatch for %s: expected %d got %d", name, expectedSize, nbytes)
+		l.Warn("Upstream file failed size verification", zap.Error(err))
+	}
+
+	if err != nil {
+		l.Debug("Attempting to remove partially written file")
+		if err := dest.Remove(); err != nil {
+			l.Error("Could not remove partially written file", zap.Error(err))
+		}
+		return err
+	}
+
+	l.Info("Cached file from upstream", zap.Int64("nbytes", nbytes))
+	return nil
+}
@@ -0,0 +1,211 @@
+package upstream_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chigopher/pathlib"
+	"github.com/spf13/afero"
+	"github.com/wrouesnel/nix-sigman/pkg/narcheck"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"github.com/wrouesnel/nix-sigman/pkg/upstream"
+	"go.uber.org/zap"
+	. "gopkg.in/check.v1"
+	"zombiezen.com/go/nix/nar"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type UpstreamSuite struct {
+	key    nixtypes.NamedPrivateKey
+	files  map[string][]byte
+	server *httptest.Server
+}
+
+var _ = Suite(&UpstreamSuite{})
+
+const testStorePath = "/nix/store/58br4vk3q5akf4g8lx0pqzfhn47k3j8d-bash-5.2p37"
+const testHashPart = "58br4vk3q5akf4g8lx0pqzfhn47k3j8d"
+
+func (s *UpstreamSuite) SetUpTest(c *C) {
+	var err error
+	s.key, err = nixtypes.GeneratePrivateKey("upstream-test-1")
+	c.Assert(err, IsNil)
+	s.files = map[string][]byte{}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, found := s.files[r.URL.Path]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(content)
+	}))
+}
+
+func (s *UpstreamSuite) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+// testNar returns a NAR of a single file with random content
+func testNar(c *C) []byte {
+	content := make([]byte, 4096)
+	_, err := rand.Read(content)
+	c.Assert(err, IsNil)
+	contentPath := filepath.Join(c.MkDir(), "content")
+	c.Assert(os.WriteFile(contentPath, content, 0o644), IsNil)
+	narBuf := &bytes.Buffer{}
+	c.Assert(nar.DumpPath(narBuf, contentPath), IsNil)
+	return narBuf.Bytes()
+}
+
+// addPath adds an uncompressed NAR and a narinfo signed with the given key to the upstream server.
+func (s *UpstreamSuite) addPath(c *C, key nixtypes.NamedPrivateKey) ([]byte, nixtypes.NarInfo) {
+	narBytes := testNar(c)
+	fileHash := sha256.Sum256(narBytes)
+	typedHash := nixtypes.TypedNixHash{HashName: "sha256", Hash: fileHash[:]}
+
+	ninfo := nixtypes.NarInfo{
+		StorePath:   testStorePath,
+		URL:         fmt.Sprintf("nar/%s.nar", typedHash.Hash.String()),
+		Compression: "none",
+		FileHash:    typedHash,
+		FileSize:    uint64(len(narBytes)),
+		NarHash:     typedHash,
+		NarSize:     uint64(len(narBytes)),
+		References:  []string{},
+		Extra:       map[string]string{},
+	}
+	_, _, err := ninfo.Sign(key)
+	c.Assert(err, IsNil)
+
+	ninfoBytes, err := ninfo.MarshalText()
+	c.Assert(err, IsNil)
+	s.files[fmt.Sprintf("/%s.narinfo", testHashPart)] = ninfoBytes
+	s.files["/"+ninfo.URL] = narBytes
+	return narBytes, ninfo
+}
+
+func (s *UpstreamSuite) newUpstream(c *C) *upstream.Upstream {
+	upstreamUrl, err := url.Parse(s.server.URL)
+	c.Assert(err, IsNil)
+	u, err := upstream.NewUpstream(zap.NewNop(), []*url.URL{upstreamUrl}, []nixtypes.NamedPublicKey{s.key.PublicKey()}, nil)
+	c.Assert(err, IsNil)
+	return u
+}
+
+func (s *UpstreamSuite) TestCacheNarInfo(c *C) {
+	narBytes, ninfo := s.addPath(c, s.key)
+	root := pathlib.NewPath("/cache", pathlib.PathWithAfero(afero.NewMemMapFs()))
+
+	cached, err := s.newUpstream(c).CacheNarInfo(context.Background(), root, testHashPart)
+	c.Assert(err, IsNil)
+	c.Assert(cached.StorePath, Equals, testStorePath)
+
+	storedNar, err := root.Join(ninfo.URL).ReadFile()
+	c.Assert(err, IsNil)
+	c.Assert(storedNar, DeepEquals, narBytes)
+
+	storedNinfoBytes, err := root.Join(testHashPart + ".narinfo").ReadFile()
+	c.Assert(err, IsNil)
+	storedNinfo := nixtypes.NarInfo{}
+	c.Assert(storedNinfo.UnmarshalText(storedNinfoBytes), IsNil)
+	verified, _ := storedNinfo.Verify(s.key.PublicKey())
+	c.Assert(verified, Equals, true)
+}
+
+func (s *UpstreamSuite) TestCacheNarInfoUntrusted(c *C) {
+	otherKey, err := nixtypes.GeneratePrivateKey("untrusted-1")
+	c.Assert(err, IsNil)
+	_, ninfo := s.addPath(c, otherKey)
+	root := pathlib.NewPath("/cache", pathlib.PathWithAfero(afero.NewMemMapFs()))
+
+	_, err = s.newUpstream(c).CacheNarInfo(context.Background(), root, testHashPart)
+	c.Assert(err, FitsTypeOf, &upstream.ErrUntrusted{})
+
+	exists, _ := root.Join(ninfo.URL).Exists()
+	c.Assert(exists, Equals, false)
+	exists, _ = root.Join(testHashPart + ".narinfo").Exists()
+	c.Assert(exists, Equals, false)
+}
+
+func (s *UpstreamSuite) TestCacheNarInfoCorruptNar(c *C) {
+	_, ninfo := s.addPath(c, s.key)
+	s.files["/"+ninfo.URL][0] ^= 0xff
+	root := pathlib.NewPath("/cache", pathlib.PathWithAfero(afero.NewMemMapFs()))
+
+	_, err := s.newUpstream(c).CacheNarInfo(context.Background(), root, testHashPart)
+	c.Assert(err, FitsTypeOf, &upstream.ErrHashMismatch{})
+
+	exists, _ := root.Join(ninfo.URL).Exists()
+	c.Assert(exists, Equals, false, Commentf("corrupt NAR should be removed"))
+	exists, _ = root.Join(testHashPart + ".narinfo").Exists()
+	c.Assert(exists, Equals, false, Commentf("narinfo must not be written without its NAR"))
+}
+
+func (s *UpstreamSuite) TestCacheNarInfoNarHashMismatch(c *C) {
+	// A correctly signed narinfo whose URL and FileHash point at a different NAR
+	otherNar, _ := s.addPath(c, s.key)
+	_, ninfo := s.addPath(c, s.key)
+	otherHash := sha256.Sum256(otherNar)
+	ninfo.URL = fmt.Sprintf("nar/%s.nar", nixtypes.NixBase32Field(otherHash[:]).String())
+	ninfo.FileHash = nixtypes.TypedNixHash{HashName: "sha256", Hash: otherHash[:]}
+	ninfo.FileSize = uint64(len(otherNar))
+	ninfoBytes, err := ninfo.MarshalText()
+	c.Assert(err, IsNil)
+	s.files[fmt.Sprintf("/%s.narinfo", testHashPart)] = ninfoBytes
+	s.files["/"+ninfo.URL] = otherNar
+	root := pathlib.NewPath("/cache", pathlib.PathWithAfero(afero.NewMemMapFs()))
+
+	_, err = s.newUpstream(c).CacheNarInfo(context.Background(), root, testHashPart)
+	c.Assert(err, FitsTypeOf, &narcheck.ErrHashMismatch{})
+	c.Check(err.(*narcheck.ErrHashMismatch).Field, Equals, "NarHash")
+
+	exists, _ := root.Join(ninfo.URL).Exists()
+	c.Assert(exists, Equals, false, Commentf("unverified NAR should be removed"))
+	exists, _ = root.Join(testHashPart + ".narinfo").Exists()
+	c.Assert(exists, Equals, false, Commentf("narinfo must not be written for an unverified NAR"))
+}
+
+func (s *UpstreamSuite) TestCacheNarInfoReplacesCorruptCachedNar(c *C) {
+	narBytes, ninfo := s.addPath(c, s.key)
+	root := pathlib.NewPath("/cache", pathlib.PathWithAfero(afero.NewMemMapFs()))
+	c.Assert(root.Join("nar").MkdirAll(), IsNil)
+	// A corrupt earlier fetch of the right size must not be trusted
+	c.Assert(root.Join(ninfo.URL).WriteFile(make([]byte, len(narBytes))), IsNil)
+
+	_, err := s.newUpstream(c).CacheNarInfo(context.Background(), root, testHashPart)
+	c.Assert(err, IsNil)
+	storedNar, err := root.Join(ninfo.URL).ReadFile()
+	c.Assert(err, IsNil)
+	c.Check(storedNar, DeepEquals, narBytes)
+}
+
+func (s *UpstreamSuite) TestCacheNarInfoNotFound(c *C) {
+	root := pathlib.NewPath("/cache", pathlib.PathWithAfero(afero.NewMemMapFs()))
+	_, err := s.newUpstream(c).CacheNarInfo(context.Background(), root, testHashPart)
+	c.Assert(err, FitsTypeOf, &upstream.ErrNotFound{})
+}
+
+func (s *UpstreamSuite) TestCacheNar(c *C) {
+	narBytes, ninfo := s.addPath(c, s.key)
+	root := pathlib.NewPath("/cache", pathlib.PathWithAfero(afero.NewMemMapFs()))
+
+	err := s.newUpstream(c).CacheNar(context.Background(), root, "/"+ninfo.URL)
+	c.Assert(err, IsNil)
+	storedNar, err := root.Join(ninfo.URL).ReadFile()
+	c.Assert(err, IsNil)
+	c.Assert(storedNar, DeepEquals, narBytes)
+
+	err = s.newUpstream(c).CacheNar(context.Background(), root, "/nar/not-a-hash.nar.xz")
+	c.Assert(err, FitsTypeOf, &upstream.ErrInvalidName{})
+}